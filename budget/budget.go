@@ -0,0 +1,205 @@
+// Package budget limits how large a built site may grow.
+package budget
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	"github.com/mitchdennett/hugo-s3-deploy/service/storage"
+)
+
+// Manifest lists the size of every file in a built site, by key.
+type Manifest struct {
+	Files map[string]int64 `json:"files"`
+	// Headers identifies the header settings the files were uploaded
+	// with.
+	Headers string `json:"headers,omitempty"`
+}
+
+// Scan builds the manifest of the files under dir, with the same keys and
+// symbolic link handling as uploads, leaving out the keys skip reports.
+func Scan(dir string, symlinks storage.Symlinks, skip func(key string) bool) (*Manifest, error) {
+	manifest := &Manifest{Files: map[string]int64{}}
+	err := storage.Walk(dir, symlinks, func(path string, key string, info os.FileInfo) error {
+		if !skip(key) {
+			manifest.Files[key] = info.Size()
+		}
+		return nil
+	}, nil)
+	return manifest, err
+}
+
+func (manifest *Manifest) Total() int64 {
+	total := int64(0)
+	for _, size := range manifest.Files {
+		total += size
+	}
+	return total
+}
+
+// FileLimit is the largest a file whose key matches Pattern may be.
+type FileLimit struct {
+	Pattern string
+	MaxSize int64
+	re      *regexp.Regexp
+}
+
+// Budget is the limits on a built site. A zero limit isn't checked.
+type Budget struct {
+	TotalSize  int64
+	Files      int
+	MaxGrowth  int64
+	FileLimits []*FileLimit
+	// Warn reports budgets that are exceeded without failing the deploy.
+	Warn bool
+}
+
+// FromConfig reads a [budget] section.
+func FromConfig(settings map[string]interface{}) (*Budget, error) {
+	budget := &Budget{}
+	var err error
+	if budget.TotalSize, err = sizeSetting(settings, "totalsize"); err != nil {
+		return nil, err
+	}
+	if budget.MaxGrowth, err = sizeSetting(settings, "maxgrowth"); err != nil {
+		return nil, err
+	}
+	if files, ok := settings["files"].(int64); ok {
+		budget.Files = int(files)
+	}
+
+	switch action, _ := settings["action"].(string); action {
+	case "", "fail":
+	case "warn":
+		budget.Warn = true
+	default:
+		return nil, fmt.Errorf("budget.action %q must be fail or warn", action)
+	}
+
+	entries, _ := settings["file"].([]interface{})
+	for i, entry := range entries {
+		values, _ := entry.(map[string]interface{})
+		limit := &FileLimit{}
+		limit.Pattern, _ = values["pattern"].(string)
+		if limit.re, err = regexp.Compile(limit.Pattern); err != nil || limit.Pattern == "" {
+			return nil, fmt.Errorf("budget.file entry %d: invalid pattern %q", i+1, limit.Pattern)
+		}
+		if limit.MaxSize, err = sizeSetting(values, "maxsize"); err != nil || limit.MaxSize == 0 {
+			return nil, fmt.Errorf("budget.file entry %d: maxsize must be set to a size such as \"500KB\"", i+1)
+		}
+		budget.FileLimits = append(budget.FileLimits, limit)
+	}
+	return budget, nil
+}
+
+func sizeSetting(settings map[string]interface{}, key string) (int64, error) {
+	switch value := settings[key].(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return value, nil
+	case string:
+		size, err := ParseSize(value)
+		if err != nil {
+			return 0, fmt.Errorf("budget %s: %v", key, err)
+		}
+		return size, nil
+	}
+	return 0, fmt.Errorf("budget %s must be a number of bytes or a size such as \"100MB\"", key)
+}
+
+var sizePattern = regexp.MustCompile(`^(?i)\s*([0-9.]+)\s*(b|kb|mb|gb)?\s*$`)
+
+// ParseSize reads a size such as "500KB" or "1.5GB". Units are powers of
+// 1024.
+func ParseSize(size string) (int64, error) {
+	match := sizePattern.FindStringSubmatch(size)
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	number, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	switch strings.ToLower(match[2]) {
+	case "kb":
+		number *= 1 << 10
+	case "mb":
+		number *= 1 << 20
+	case "gb":
+		number *= 1 << 30
+	}
+	return int64(number), nil
+}
+
+// Change is a file that was added or changed size since the last deploy.
+type Change struct {
+	Key   string
+	Size  int64
+	Delta int64
+}
+
+// Diff lists the files that grew or were added since previous, largest
+// growth first, and the files that were removed.
+func Diff(current *Manifest, previous *Manifest) ([]*Change, []string) {
+	grown := []*Change{}
+	removed := []string{}
+	for key, size := range current.Files {
+		if delta := size - previous.Files[key]; delta > 0 {
+			grown = append(grown, &Change{Key: key, Size: size, Delta: delta})
+		}
+	}
+	for key := range previous.Files {
+		if _, ok := current.Files[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Slice(grown, func(i, j int) bool {
+		if grown[i].Delta != grown[j].Delta {
+			return grown[i].Delta > grown[j].Delta
+		}
+		return grown[i].Key < grown[j].Key
+	})
+	sort.Strings(removed)
+	return grown, removed
+}
+
+// Check returns every budget current exceeds. previous is the manifest of
+// the last deploy, or nil for the first one.
+func (budget *Budget) Check(current *Manifest, previous *Manifest) []string {
+	problems := []string{}
+	total := current.Total()
+	if budget.TotalSize > 0 && total > budget.TotalSize {
+		problems = append(problems, fmt.Sprintf("the site is %s, over the total size budget of %s", output.FormatSize(total), output.FormatSize(budget.TotalSize)))
+	}
+	if budget.Files > 0 && len(current.Files) > budget.Files {
+		problems = append(problems, fmt.Sprintf("the site has %d files, over the budget of %d", len(current.Files), budget.Files))
+	}
+	if budget.MaxGrowth > 0 && previous != nil {
+		if growth := total - previous.Total(); growth > budget.MaxGrowth {
+			problems = append(problems, fmt.Sprintf("the site grew by %s since the last deploy, over the growth budget of %s", output.FormatSize(growth), output.FormatSize(budget.MaxGrowth)))
+		}
+	}
+
+	keys := []string{}
+	for key := range current.Files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, limit := range budget.FileLimits {
+			if limit.re.MatchString(key) {
+				if size := current.Files[key]; size > limit.MaxSize {
+					problems = append(problems, fmt.Sprintf("%s is %s, over the budget of %s for %s", key, output.FormatSize(size), output.FormatSize(limit.MaxSize), limit.Pattern))
+				}
+				break
+			}
+		}
+	}
+	return problems
+}
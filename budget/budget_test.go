@@ -0,0 +1,147 @@
+package budget
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mitchdennett/hugo-s3-deploy/service/storage"
+	"github.com/pelletier/go-toml"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want int64
+	}{
+		{"100", 100},
+		{"100B", 100},
+		{"500KB", 500 << 10},
+		{"500kb", 500 << 10},
+		{" 2 MB ", 2 << 20},
+		{"1.5GB", 3 << 29},
+		{"0", 0},
+	}
+	for _, test := range tests {
+		if got, err := ParseSize(test.size); err != nil || got != test.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", test.size, got, err, test.want)
+		}
+	}
+	for _, size := range []string{"", "MB", "5TB", "-1KB", "1.2.3MB", "five"} {
+		if _, err := ParseSize(size); err == nil {
+			t.Errorf("ParseSize(%q) didn't fail", size)
+		}
+	}
+}
+
+func fromConfig(t *testing.T, config string) (*Budget, error) {
+	tree, err := toml.Load(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return FromConfig(tree.ToMap())
+}
+
+func TestFromConfig(t *testing.T) {
+	budget, err := fromConfig(t, `
+totalsize = "10MB"
+maxgrowth = 1024
+files = 3
+action = "warn"
+[[file]]
+pattern = '\.js$'
+maxsize = "1KB"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget.TotalSize != 10<<20 || budget.MaxGrowth != 1024 || budget.Files != 3 || !budget.Warn {
+		t.Errorf("FromConfig = %+v", budget)
+	}
+	if len(budget.FileLimits) != 1 || budget.FileLimits[0].Pattern != `\.js$` || budget.FileLimits[0].MaxSize != 1024 {
+		t.Errorf("file limits = %+v", budget.FileLimits)
+	}
+
+	for _, config := range []string{
+		`totalsize = "lots"`,
+		`maxgrowth = true`,
+		`action = "ignore"`,
+		"[[file]]\nmaxsize = \"1KB\"",
+		"[[file]]\npattern = \"(\"\nmaxsize = \"1KB\"",
+		"[[file]]\npattern = \"js\"",
+	} {
+		if _, err := fromConfig(t, config); err == nil {
+			t.Errorf("%q didn't fail", config)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	previous := &Manifest{Files: map[string]int64{"index.html": 1000, "app.js": 1000}}
+	current := &Manifest{Files: map[string]int64{"index.html": 1000, "app.js": 3000, "vendor.js": 500}}
+	tests := []struct {
+		config   string
+		previous *Manifest
+		problems []string
+	}{
+		{"", previous, []string{}},
+		{`totalsize = "5KB"`, previous, []string{}},
+		{`totalsize = "4000"`, previous, []string{"the site is 4.4 KB, over the total size budget of 3.9 KB"}},
+		{"files = 2", previous, []string{"the site has 3 files, over the budget of 2"}},
+		{"maxgrowth = 2000", previous, []string{"the site grew by 2.4 KB since the last deploy, over the growth budget of 2.0 KB"}},
+		// The first deploy has nothing to grow from.
+		{"maxgrowth = 2000", nil, []string{}},
+		// Only the first pattern a file matches applies.
+		{"[[file]]\npattern = 'vendor'\nmaxsize = 600\n[[file]]\npattern = '\\.js$'\nmaxsize = 400", previous,
+			[]string{"app.js is 2.9 KB, over the budget of 400 B for \\.js$"}},
+	}
+	for _, test := range tests {
+		budget, err := fromConfig(t, test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if problems := budget.Check(current, test.previous); !reflect.DeepEqual(problems, test.problems) {
+			t.Errorf("%q: Check = %q, want %q", test.config, problems, test.problems)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	previous := &Manifest{Files: map[string]int64{"index.html": 1000, "app.js": 1000, "old.html": 10, "shrunk.css": 50}}
+	current := &Manifest{Files: map[string]int64{"index.html": 1000, "app.js": 1200, "new.html": 300, "shrunk.css": 40}}
+	grown, removed := Diff(current, previous)
+	want := []*Change{{Key: "new.html", Size: 300, Delta: 300}, {Key: "app.js", Size: 1200, Delta: 200}}
+	if !reflect.DeepEqual(grown, want) {
+		t.Errorf("grown = %+v, want %+v", grown, want)
+	}
+	if !reflect.DeepEqual(removed, []string{"old.html"}) {
+		t.Errorf("removed = %v, want [old.html]", removed)
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+	for name, size := range map[string]int{"index.html": 10, "post/index.html": 20, "drafts/index.html": 30} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest, err := Scan(dir, storage.FollowSymlinks, func(key string) bool {
+		return strings.HasPrefix(key, "drafts/")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"index.html": 10, "post/index.html": 20}; !reflect.DeepEqual(manifest.Files, want) {
+		t.Errorf("Files = %v, want %v", manifest.Files, want)
+	}
+	if manifest.Total() != 30 {
+		t.Errorf("Total = %d, want 30", manifest.Total())
+	}
+}
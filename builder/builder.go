@@ -0,0 +1,122 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/mitchdennett/hugo-s3-deploy/hugo"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+)
+
+// Builder generates a site into a directory that is then deployed as is.
+type Builder interface {
+	// Build generates the site. An empty baseURL or environment leaves the
+	// generator's own setting in place.
+	Build(baseURL string, environment string) error
+	// PublishDir is the directory the generated site is written to.
+	PublishDir() string
+}
+
+// Hugo builds the site with the hugo command.
+type Hugo struct {
+	Dir   string
+	Theme string
+	Site  *hugo.SiteConfig
+}
+
+func NewHugo(dir string, site *hugo.SiteConfig) *Hugo {
+	builder := new(Hugo)
+	builder.Dir = dir
+	builder.Site = site
+	return builder
+}
+
+func (builder *Hugo) SetTheme(theme string) {
+	builder.Theme = theme
+}
+
+func (builder *Hugo) Build(baseURL string, environment string) error {
+	args := []string{}
+	if builder.Theme != "" {
+		args = append(args, "-t", builder.Theme)
+	}
+	if environment != "" {
+		args = append(args, "--environment", environment)
+	}
+	if baseURL != "" {
+		args = append(args, "--baseURL", baseURL)
+	}
+	return run(exec.Command("hugo", args...), builder.Dir)
+}
+
+// PublishDir is the site config's publishDir, which Hugo resolves against
+// the site directory.
+func (builder *Hugo) PublishDir() string {
+	return resolve(builder.Dir, builder.Site.PublishDir)
+}
+
+// Command builds the site by running a shell command, for generators such
+// as Zola, Jekyll or Eleventy. The base URL and environment are passed in
+// the BASE_URL and DEPLOY_ENV environment variables.
+type Command struct {
+	Dir     string
+	Command string
+	Publish string
+}
+
+func NewCommand(dir string, command string, publishDir string) *Command {
+	builder := new(Command)
+	builder.Dir = dir
+	builder.Command = command
+	builder.Publish = publishDir
+	return builder
+}
+
+func (builder *Command) Build(baseURL string, environment string) error {
+	cmd := exec.Command("sh", "-c", builder.Command)
+	cmd.Env = append(os.Environ(), "BASE_URL="+baseURL, "DEPLOY_ENV="+environment)
+	return run(cmd, builder.Dir)
+}
+
+func (builder *Command) PublishDir() string {
+	return resolve(builder.Dir, builder.Publish)
+}
+
+// Folder deploys a directory that is already built.
+type Folder struct {
+	Dir string
+}
+
+func NewFolder(dir string, publishDir string) *Folder {
+	builder := new(Folder)
+	builder.Dir = resolve(dir, publishDir)
+	return builder
+}
+
+func (builder *Folder) Build(baseURL string, environment string) error {
+	output.Println("Nothing to build, uploading " + builder.Dir)
+	return nil
+}
+
+func (builder *Folder) PublishDir() string {
+	return builder.Dir
+}
+
+func run(cmd *exec.Cmd, dir string) error {
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed with %s\n%s", filepath.Base(cmd.Path), err, out)
+	}
+	output.Printf("combined out:\n%s\n", string(out))
+	return nil
+}
+
+func resolve(dir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+)
+
+// gitInfo describes the commit a site is deployed from.
+type gitInfo struct {
+	Commit string
+	Branch string
+	Tag    string
+	Dirty  bool
+}
+
+// loadGitInfo reads the state of the git repository around dir. It returns
+// nil when dir isn't in a repository. Only changes to tracked files make the
+// tree dirty, so build output and other files git doesn't know about don't
+// block deploys.
+func loadGitInfo(dir string) *gitInfo {
+	if _, err := gitOutput(dir, "rev-parse", "--show-toplevel"); err != nil {
+		return nil
+	}
+	info := &gitInfo{}
+	info.Commit, _ = gitOutput(dir, "rev-parse", "HEAD")
+	info.Branch, _ = gitOutput(dir, "rev-parse", "--abbrev-ref", "HEAD")
+	info.Tag, _ = gitOutput(dir, "describe", "--tags", "--exact-match")
+	status, _ := gitOutput(dir, "status", "--porcelain", "--untracked-files=no")
+	info.Dirty = status != ""
+	return info
+}
+
+func (info *gitInfo) ShortCommit() string {
+	if len(info.Commit) > 7 {
+		return info.Commit[:7]
+	}
+	return info.Commit
+}
+
+type versionFile struct {
+	Commit    string    `json:"commit"`
+	Branch    string    `json:"branch"`
+	Tag       string    `json:"tag,omitempty"`
+	Dirty     bool      `json:"dirty,omitempty"`
+	BuildTime time.Time `json:"buildTime"`
+}
+
+// version describes the commit the site was built from, for the version
+// file uploaded with it.
+func (info *gitInfo) version(built time.Time) *versionFile {
+	return &versionFile{
+		Commit:    info.Commit,
+		Branch:    info.Branch,
+		Tag:       info.Tag,
+		Dirty:     info.Dirty,
+		BuildTime: built,
+	}
+}
+
+// uploadVersionFile uploads version to key on every deploy, with the same
+// metadata as uploaded files, and returns its size. It isn't written into the
+// publish directory, so it can't be left behind by the unchanged-file check or
+// taken for part of the built site.
+func uploadVersionFile(s *site, key string, version *versionFile) (int64, error) {
+	dat, err := json.MarshalIndent(version, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err := s.bucket.UploadJSON(key, version); err != nil {
+		return 0, err
+	}
+	output.Println("upload " + key)
+	s.out.File("upload", "", key)
+	return int64(len(dat)), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func git(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+}
+
+func TestLoadGitInfo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	dir := t.TempDir()
+	if loadGitInfo(dir) != nil {
+		t.Fatal("a directory outside a repository has git info")
+	}
+	git(t, dir, "init", "-q", "-b", "main")
+	ioutil.WriteFile(filepath.Join(dir, "config.toml"), []byte(`title = "a"`), 0644)
+	git(t, dir, "add", "config.toml")
+	git(t, dir, "commit", "-q", "-m", "a")
+	git(t, dir, "tag", "v1")
+
+	info := loadGitInfo(dir)
+	if info == nil || len(info.Commit) != 40 || info.Branch != "main" || info.Tag != "v1" || info.Dirty {
+		t.Fatalf("git info is %+v", info)
+	}
+
+	// Untracked files don't make the tree dirty.
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644)
+	if info := loadGitInfo(dir); info.Dirty {
+		t.Error("an untracked file made the tree dirty")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "config.toml"), []byte(`title = "b"`), 0644)
+	if info := loadGitInfo(dir); !info.Dirty {
+		t.Error("a changed file didn't make the tree dirty")
+	}
+}
+
+func TestUploadVersionFile(t *testing.T) {
+	fake := &fakeS3{objects: map[string]*fakeObject{}}
+	s, bucket := fakeSite(t, fake)
+	bucket.SetMetadata(map[string]string{"git-sha": "3fa2c1e"})
+	built := time.Date(2026, 3, 1, 10, 15, 0, 0, time.UTC)
+	version := (&gitInfo{Commit: "3fa2c1e", Branch: "main"}).version(built)
+	size, err := uploadVersionFile(s, "version.json", version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object := fake.objects["version.json"]
+	if object == nil {
+		t.Fatal("version.json wasn't uploaded")
+	}
+	if size != int64(len(object.body)) {
+		t.Errorf("size is %d, want %d", size, len(object.body))
+	}
+	if sha := object.header.Get("X-Amz-Meta-Git-Sha"); sha != "3fa2c1e" {
+		t.Errorf("version.json has git-sha %q, want 3fa2c1e", sha)
+	}
+	if contentType := object.header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("version.json has content type %q", contentType)
+	}
+	var uploaded versionFile
+	if err := json.Unmarshal(object.body, &uploaded); err != nil || uploaded != *version {
+		t.Errorf("version.json is %s", object.body)
+	}
+}
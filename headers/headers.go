@@ -0,0 +1,220 @@
+package headers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type Header struct {
+	Name  string
+	Value string
+}
+
+type Rule struct {
+	Path    string
+	Headers []Header
+}
+
+// Load parses the first _headers file found at the given paths. It returns no
+// rules when none of them exist.
+func Load(paths ...string) ([]*Rule, error) {
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		rules, err := Parse(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return rules, nil
+	}
+	return nil, nil
+}
+
+// Parse reads rules in Netlify's _headers syntax: a path on its own line
+// followed by indented "Name: value" lines.
+func Parse(r io.Reader) ([]*Rule, error) {
+	rules := []*Rule{}
+	var rule *Rule
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if text[0] != ' ' && text[0] != '\t' {
+			if !strings.HasPrefix(trimmed, "/") {
+				return nil, fmt.Errorf("line %d: expected a path starting with /", line)
+			}
+			rule = &Rule{Path: trimmed}
+			rules = append(rules, rule)
+			continue
+		}
+
+		if rule == nil {
+			return nil, fmt.Errorf("line %d: header given before any path", line)
+		}
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("line %d: expected \"Name: value\"", line)
+		}
+		rule.add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return rules, scanner.Err()
+}
+
+// FromConfig reads rules from the [headers] table of deploy.toml, which maps
+// each path to a table of header names and values.
+func FromConfig(values map[string]interface{}) ([]*Rule, error) {
+	paths := []string{}
+	for path := range values {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	rules := []*Rule{}
+	for _, path := range paths {
+		table, ok := values[path].(map[string]interface{})
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("headers.%q must be a table for a path starting with /", path)
+		}
+		rule := &Rule{Path: path}
+		names := []string{}
+		for name := range table {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, ok := table[name].(string)
+			if !ok {
+				return nil, fmt.Errorf("headers.%q.%s must be a string", path, name)
+			}
+			rule.add(name, value)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// add sets a header, joining repeated headers with a comma as Netlify does.
+func (rule *Rule) add(name string, value string) {
+	for i, header := range rule.Headers {
+		if strings.EqualFold(header.Name, name) {
+			rule.Headers[i].Value += ", " + value
+			return
+		}
+	}
+	rule.Headers = append(rule.Headers, Header{Name: name, Value: value})
+}
+
+func (rule *Rule) set(header Header) {
+	for i := range rule.Headers {
+		if strings.EqualFold(rule.Headers[i].Name, header.Name) {
+			rule.Headers[i] = header
+			return
+		}
+	}
+	rule.Headers = append(rule.Headers, header)
+}
+
+// IsDefault reports whether the rule applies to every path.
+func (rule *Rule) IsDefault() bool {
+	return rule.PathPattern() == "/*"
+}
+
+// PathPattern converts the rule's path into a CloudFront path pattern, which
+// has no named placeholders. Different paths can share a pattern, such as
+// /blog/:slug and /blog/*.
+func (rule *Rule) PathPattern() string {
+	segments := strings.Split(rule.Path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = "*"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// Compile merges rules into the headers sent on every response and one rule
+// per CloudFront path pattern, ordered most specific first. CloudFront
+// applies a single policy per request, so each pattern's rule carries the
+// headers of every rule matching its paths: the defaults, then broader
+// patterns, then its own. Where they set the same header, the more specific
+// rule wins, and among rules with the same pattern the later one does.
+func Compile(rules []*Rule) ([]Header, []*Rule) {
+	defaults := &Rule{Path: "/*"}
+	byPattern := map[string]*Rule{}
+	paths := []*Rule{}
+	for _, rule := range rules {
+		if rule.IsDefault() {
+			for _, header := range rule.Headers {
+				defaults.set(header)
+			}
+			continue
+		}
+		pattern := rule.PathPattern()
+		if _, ok := byPattern[pattern]; !ok {
+			byPattern[pattern] = &Rule{Path: pattern}
+			paths = append(paths, byPattern[pattern])
+		}
+		for _, header := range rule.Headers {
+			byPattern[pattern].set(header)
+		}
+	}
+
+	sort.SliceStable(paths, func(i, j int) bool {
+		a, b := paths[i].Path, paths[j].Path
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return strings.Count(a, "*")+strings.Count(a, "?") < strings.Count(b, "*")+strings.Count(b, "?")
+	})
+	compiled := []*Rule{}
+	for i, rule := range paths {
+		merged := &Rule{Path: rule.Path, Headers: append([]Header{}, defaults.Headers...)}
+		for j := len(paths) - 1; j > i; j-- {
+			if covers(paths[j].Path, rule.Path) {
+				for _, header := range paths[j].Headers {
+					merged.set(header)
+				}
+			}
+		}
+		for _, header := range rule.Headers {
+			merged.set(header)
+		}
+		compiled = append(compiled, merged)
+	}
+	return defaults.Headers, compiled
+}
+
+// covers reports whether the path pattern general matches every path that
+// specific matches, treating the wildcards in specific as literal text.
+func covers(general string, specific string) bool {
+	var expr strings.Builder
+	for _, c := range general {
+		switch c {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return regexp.MustCompile("^" + expr.String() + "$").MatchString(specific)
+}
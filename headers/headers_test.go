@@ -0,0 +1,176 @@
+package headers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	rules, err := Parse(strings.NewReader(`# security
+/*
+  X-Frame-Options: DENY
+  Link: </a.css>
+  Link: </b.css>
+
+/embed/*
+	X-Frame-Options: SAMEORIGIN
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Rule{
+		{Path: "/*", Headers: []Header{{"X-Frame-Options", "DENY"}, {"Link", "</a.css>, </b.css>"}}},
+		{Path: "/embed/*", Headers: []Header{{"X-Frame-Options", "SAMEORIGIN"}}},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("Parse = %+v, want %+v", rules, want)
+	}
+
+	for input, message := range map[string]string{
+		"embed/*\n  X: y": "line 1: expected a path starting with /",
+		"  X: y":          "line 1: header given before any path",
+		"/*\n  X":         `line 2: expected "Name: value"`,
+		"/*\n  : y":       `line 2: expected "Name: value"`,
+	} {
+		if _, err := Parse(strings.NewReader(input)); err == nil || err.Error() != message {
+			t.Errorf("Parse(%q) error = %v, want %q", input, err, message)
+		}
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	rules, err := FromConfig(map[string]interface{}{
+		"/b/*": map[string]interface{}{"X-B": "b"},
+		"/*":   map[string]interface{}{"X-Z": "z", "X-A": "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Rule{
+		{Path: "/*", Headers: []Header{{"X-A", "a"}, {"X-Z", "z"}}},
+		{Path: "/b/*", Headers: []Header{{"X-B", "b"}}},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("FromConfig = %+v, want %+v", rules, want)
+	}
+
+	if _, err := FromConfig(map[string]interface{}{"b": map[string]interface{}{}}); err == nil {
+		t.Error("FromConfig accepted a path without a leading /")
+	}
+	if _, err := FromConfig(map[string]interface{}{"/*": map[string]interface{}{"X": 1}}); err == nil {
+		t.Error("FromConfig accepted a value that isn't a string")
+	}
+}
+
+func TestPathPattern(t *testing.T) {
+	tests := map[string]string{
+		"/*":                "/*",
+		"/blog/:slug":       "/blog/*",
+		"/blog/:year/:slug": "/blog/*/*",
+		"/:lang/about":      "/*/about",
+		"/a.html":           "/a.html",
+	}
+	for path, want := range tests {
+		if got := (&Rule{Path: path}).PathPattern(); got != want {
+			t.Errorf("PathPattern(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []*Rule
+		defaults []Header
+		paths    []*Rule
+	}{
+		{
+			name: "defaults only",
+			rules: []*Rule{
+				{Path: "/*", Headers: []Header{{"X-A", "1"}}},
+				{Path: "/:any", Headers: []Header{{"X-B", "2"}}},
+			},
+			defaults: []Header{{"X-A", "1"}, {"X-B", "2"}},
+			paths:    []*Rule{},
+		},
+		{
+			name: "paths carry the defaults they don't override",
+			rules: []*Rule{
+				{Path: "/*", Headers: []Header{{"X-Frame-Options", "DENY"}, {"X-A", "1"}}},
+				{Path: "/embed/*", Headers: []Header{{"X-Frame-Options", "SAMEORIGIN"}}},
+			},
+			defaults: []Header{{"X-Frame-Options", "DENY"}, {"X-A", "1"}},
+			paths: []*Rule{
+				{Path: "/embed/*", Headers: []Header{{"X-Frame-Options", "SAMEORIGIN"}, {"X-A", "1"}}},
+			},
+		},
+		{
+			name: "paths with the same pattern are merged",
+			rules: []*Rule{
+				{Path: "/blog/:slug", Headers: []Header{{"X-A", "1"}, {"X-B", "1"}}},
+				{Path: "/blog/*", Headers: []Header{{"X-B", "2"}, {"X-C", "2"}}},
+			},
+			paths: []*Rule{
+				{Path: "/blog/*", Headers: []Header{{"X-A", "1"}, {"X-B", "2"}, {"X-C", "2"}}},
+			},
+		},
+		{
+			name: "nested patterns carry the broader ones",
+			rules: []*Rule{
+				{Path: "/*", Headers: []Header{{"X-A", "default"}}},
+				{Path: "/blog/*", Headers: []Header{{"X-A", "blog"}, {"X-B", "blog"}}},
+				{Path: "/blog/special/*", Headers: []Header{{"X-C", "special"}}},
+				{Path: "/docs/*", Headers: []Header{{"X-D", "docs"}}},
+			},
+			defaults: []Header{{"X-A", "default"}},
+			paths: []*Rule{
+				{Path: "/blog/special/*", Headers: []Header{{"X-A", "blog"}, {"X-B", "blog"}, {"X-C", "special"}}},
+				{Path: "/blog/*", Headers: []Header{{"X-A", "blog"}, {"X-B", "blog"}}},
+				{Path: "/docs/*", Headers: []Header{{"X-A", "default"}, {"X-D", "docs"}}},
+			},
+		},
+		{
+			name: "literal paths come before wildcards of the same length",
+			rules: []*Rule{
+				{Path: "/a/*", Headers: []Header{{"X-A", "any"}}},
+				{Path: "/a/b", Headers: []Header{{"X-B", "b"}}},
+			},
+			paths: []*Rule{
+				{Path: "/a/b", Headers: []Header{{"X-A", "any"}, {"X-B", "b"}}},
+				{Path: "/a/*", Headers: []Header{{"X-A", "any"}}},
+			},
+		},
+	}
+	for _, test := range tests {
+		defaults, paths := Compile(test.rules)
+		if len(defaults) != 0 || len(test.defaults) != 0 {
+			if !reflect.DeepEqual(defaults, test.defaults) {
+				t.Errorf("%s: defaults = %+v, want %+v", test.name, defaults, test.defaults)
+			}
+		}
+		if !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("%s: paths = %s, want %s", test.name, describe(paths), describe(test.paths))
+		}
+
+		seen := map[string]bool{}
+		for _, rule := range paths {
+			if seen[rule.PathPattern()] {
+				t.Errorf("%s: pattern %s compiled twice", test.name, rule.PathPattern())
+			}
+			seen[rule.PathPattern()] = true
+		}
+	}
+}
+
+func describe(rules []*Rule) string {
+	lines := []string{}
+	for _, rule := range rules {
+		line := rule.Path
+		for _, header := range rule.Headers {
+			line += " " + header.Name + "=" + header.Value
+		}
+		lines = append(lines, line)
+	}
+	return "[" + strings.Join(lines, "; ") + "]"
+}
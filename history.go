@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchdennett/hugo-s3-deploy/budget"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	"github.com/mitchdennett/hugo-s3-deploy/service/storage"
+)
+
+// historyLimit is how many deploys history lists.
+const historyLimit = 20
+
+// deployRecord describes a successful deploy. Records are written once and
+// never changed.
+type deployRecord struct {
+	Id             string    `json:"id"`
+	Site           string    `json:"site"`
+	Environment    string    `json:"environment,omitempty"`
+	Started        time.Time `json:"started"`
+	Duration       string    `json:"duration"`
+	Commit         string    `json:"commit,omitempty"`
+	Branch         string    `json:"branch,omitempty"`
+	User           string    `json:"user"`
+	Host           string    `json:"host"`
+	CI             string    `json:"ci,omitempty"`
+	Release        string    `json:"release,omitempty"`
+	FilesTotal     int       `json:"filesTotal"`
+	FilesUploaded  int       `json:"filesUploaded"`
+	BytesUploaded  int64     `json:"bytesUploaded"`
+	DistributionId string    `json:"distributionId,omitempty"`
+	InvalidationId string    `json:"invalidationId,omitempty"`
+}
+
+func historyPrefix() string {
+	return statePrefix() + "history/"
+}
+
+// newDeployRecord starts the record for a deploy, identifying the commit
+// and who ran it.
+func newDeployRecord(s *site, git *gitInfo, started time.Time) *deployRecord {
+	user, host := identity()
+	record := &deployRecord{
+		Id:          started.Format("20060102T150405Z") + "-" + randomId()[:6],
+		Site:        s.Name,
+		Environment: *envName,
+		Started:     started,
+		User:        user,
+		Host:        host,
+		CI:          ciIdentity(),
+	}
+	if git != nil {
+		record.Commit = git.Commit
+		record.Branch = git.Branch
+	}
+	return record
+}
+
+// ciIdentity names the CI job running the deploy, if any.
+func ciIdentity() string {
+	switch {
+	case os.Getenv("GITHUB_ACTIONS") == "true":
+		return "GitHub Actions run " + os.Getenv("GITHUB_RUN_ID") + " by " + os.Getenv("GITHUB_ACTOR")
+	case os.Getenv("GITLAB_CI") == "true":
+		return "GitLab job " + os.Getenv("CI_JOB_ID") + " by " + os.Getenv("GITLAB_USER_LOGIN")
+	case os.Getenv("CIRCLECI") == "true":
+		return "CircleCI build " + os.Getenv("CIRCLE_BUILD_NUM") + " by " + os.Getenv("CIRCLE_USERNAME")
+	case os.Getenv("BUILDKITE") == "true":
+		return "Buildkite build " + os.Getenv("BUILDKITE_BUILD_NUMBER") + " by " + os.Getenv("BUILDKITE_BUILD_CREATOR")
+	case os.Getenv("CI") != "":
+		return "CI"
+	}
+	return ""
+}
+
+// countFiles records how many files the site has and the size of the ones
+// that were uploaded.
+func (record *deployRecord) countFiles(manifest *budget.Manifest, keyPrefix string, uploaded []string) {
+	record.FilesTotal = len(manifest.Files)
+	record.FilesUploaded = len(uploaded)
+	for _, key := range uploaded {
+		record.BytesUploaded += manifest.Files[strings.TrimPrefix(key, keyPrefix)]
+	}
+}
+
+func (record *deployRecord) save(bucket storage.Storage) error {
+	created, err := bucket.CreateJSON(historyPrefix()+record.Id+".json", record)
+	if err == nil && !created {
+		err = errors.New("Deploy record " + record.Id + " already exists")
+	}
+	return err
+}
+
+// history lists recent deploys, newest first, or shows one in full.
+func history(s *site, args []string) error {
+	keys, err := s.bucket.ListKeys(historyPrefix())
+	if err != nil {
+		return err
+	}
+	// Ids start with the deploy time, so reverse order puts the newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+
+	if len(args) > 0 {
+		for _, key := range keys {
+			if strings.HasPrefix(strings.TrimPrefix(key, historyPrefix()), args[0]) {
+				return showDeployRecord(s, key)
+			}
+		}
+		return fmt.Errorf("No deploy %q in the history of %s", args[0], s.Name)
+	}
+
+	records := []*deployRecord{}
+	if len(keys) == 0 {
+		output.Println(s.Name + ": no deploys recorded")
+		return s.out.Summary(map[string]interface{}{"deploys": records, "total": 0})
+	}
+	output.Println(s.Name + ":")
+	for i, key := range keys {
+		if i == historyLimit {
+			output.Printf("... and %d older deploys\n", len(keys)-historyLimit)
+			break
+		}
+		record := &deployRecord{}
+		if _, err := s.bucket.GetJSON(key, record); err != nil {
+			return err
+		}
+		records = append(records, record)
+		commit := record.Commit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		output.Printf("%s  %s  %-8s %-16s %-12s %4d/%d files  %s\n", record.Id, record.Started.Local().Format("2006-01-02 15:04"),
+			commit, record.Branch, record.User, record.FilesUploaded, record.FilesTotal, record.Duration)
+	}
+	return s.out.Summary(map[string]interface{}{"deploys": records, "total": len(keys)})
+}
+
+func showDeployRecord(s *site, key string) error {
+	record := &deployRecord{}
+	if _, err := s.bucket.GetJSON(key, record); err != nil {
+		return err
+	}
+	dat, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	output.Println(string(dat))
+	return s.out.Summary(map[string]interface{}{"deploy": record})
+}
@@ -0,0 +1,108 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+)
+
+// The stages of a deploy hooks can run at, in the order they happen.
+var Stages = []string{"pre-build", "post-build", "pre-upload", "post-upload", "post-deploy"}
+
+const defaultTimeout = 5 * time.Minute
+
+type Hook struct {
+	Stage       string
+	Command     string
+	Timeout     time.Duration
+	FailOnError bool
+}
+
+// FromConfig reads the [[hooks]] entries of deploy.toml. Hooks fail the
+// deploy when they fail unless failonerror is false.
+func FromConfig(entries []map[string]interface{}) ([]*Hook, error) {
+	hooks := []*Hook{}
+	for i, entry := range entries {
+		hook := &Hook{Timeout: defaultTimeout, FailOnError: true}
+		hook.Stage, _ = entry["stage"].(string)
+		if !isStage(hook.Stage) {
+			return nil, fmt.Errorf("hooks entry %d: stage %q is not one of %v", i+1, hook.Stage, Stages)
+		}
+		hook.Command, _ = entry["command"].(string)
+		if hook.Command == "" {
+			return nil, fmt.Errorf("hooks entry %d: command is not set", i+1)
+		}
+
+		switch timeout := entry["timeout"].(type) {
+		case nil:
+		case int64:
+			hook.Timeout = time.Duration(timeout) * time.Second
+		case string:
+			duration, err := time.ParseDuration(timeout)
+			if err != nil {
+				return nil, fmt.Errorf("hooks entry %d: invalid timeout %q", i+1, timeout)
+			}
+			hook.Timeout = duration
+		default:
+			return nil, fmt.Errorf("hooks entry %d: timeout must be a number of seconds or a duration such as \"2m\"", i+1)
+		}
+
+		if failOnError, ok := entry["failonerror"].(bool); ok {
+			hook.FailOnError = failOnError
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+func isStage(stage string) bool {
+	for _, s := range Stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// Run runs the hooks for stage in dir, in the order they were configured,
+// with env added to their environment.
+func Run(hooks []*Hook, stage string, dir string, env []string) error {
+	for _, hook := range hooks {
+		if hook.Stage != stage {
+			continue
+		}
+		output.Println("Running " + stage + " hook: " + hook.Command)
+		if err := hook.run(dir, env); err != nil {
+			if hook.FailOnError {
+				return err
+			}
+			output.Println(err)
+		}
+	}
+	return nil
+}
+
+func (hook *Hook) run(dir string, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hook.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook.Command)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	// Output goes straight to the terminal, so processes the hook leaves
+	// behind can't hold up a timeout by keeping a pipe open.
+	cmd.Stdout = output.Text()
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s hook %q timed out after %s", hook.Stage, hook.Command, hook.Timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook %q failed with %s", hook.Stage, hook.Command, err)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package hugo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Hugo looks for its site config under these names, in this order.
+var configFiles = []string{
+	"hugo.toml", "hugo.yaml", "hugo.yml", "hugo.json",
+	"config.toml", "config.yaml", "config.yml", "config.json",
+}
+
+type SiteConfig struct {
+	Path       string
+	BaseURL    string
+	PublishDir string
+	// Languages lists the languages published under their own
+	// subdirectory, which is every language but the default one unless
+	// defaultContentLanguageInSubdir is set.
+	Languages  []string
+	Deployment Deployment
+}
+
+type Deployment struct {
+	Targets  []*Target
+	Matchers []*Matcher
+}
+
+type Target struct {
+	Name                     string
+	URL                      string
+	CloudFrontDistributionID string
+}
+
+type Matcher struct {
+	Pattern         string
+	CacheControl    string
+	ContentType     string
+	ContentEncoding string
+	Gzip            bool
+	Force           bool
+	re              *regexp.Regexp
+}
+
+// LoadSiteConfig reads the Hugo site config in dir. A site without a config
+// file yields an empty SiteConfig so callers can fall back to defaults.
+func LoadSiteConfig(dir string) (*SiteConfig, error) {
+	site := &SiteConfig{PublishDir: "public"}
+
+	for _, name := range configFiles {
+		path := filepath.Join(dir, name)
+		dat, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		values, err := decode(name, dat)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %v", name, err)
+		}
+		site.Path = path
+		if err := site.load(values); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		break
+	}
+
+	return site, nil
+}
+
+func decode(name string, dat []byte) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	switch filepath.Ext(name) {
+	case ".toml":
+		tree, err := toml.LoadBytes(dat)
+		if err != nil {
+			return nil, err
+		}
+		values = tree.ToMap()
+	case ".yaml", ".yml":
+		var raw map[interface{}]interface{}
+		if err := yaml.Unmarshal(dat, &raw); err != nil {
+			return nil, err
+		}
+		values = normalize(raw).(map[string]interface{})
+	case ".json":
+		if err := json.Unmarshal(dat, &values); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// normalize converts the map[interface{}]interface{} values produced by the
+// yaml package into the map[string]interface{} form used for TOML and JSON.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalize(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalize(item)
+		}
+	}
+	return value
+}
+
+func (site *SiteConfig) load(values map[string]interface{}) error {
+	site.BaseURL = getString(values, "baseURL")
+	if publishDir := getString(values, "publishDir"); publishDir != "" {
+		site.PublishDir = publishDir
+	}
+
+	defaultLanguage := getString(values, "defaultContentLanguage")
+	if defaultLanguage == "" {
+		defaultLanguage = "en"
+	}
+	if languages, ok := get(values, "languages").(map[string]interface{}); ok {
+		for language := range languages {
+			if strings.EqualFold(language, defaultLanguage) && !getBool(values, "defaultContentLanguageInSubdir") {
+				continue
+			}
+			site.Languages = append(site.Languages, strings.ToLower(language))
+		}
+		sort.Strings(site.Languages)
+	}
+
+	deployment, _ := get(values, "deployment").(map[string]interface{})
+	if deployment == nil {
+		return nil
+	}
+
+	for _, item := range getTables(deployment, "targets") {
+		site.Deployment.Targets = append(site.Deployment.Targets, &Target{
+			Name:                     getString(item, "name"),
+			URL:                      getString(item, "URL"),
+			CloudFrontDistributionID: getString(item, "cloudFrontDistributionID"),
+		})
+	}
+
+	for _, item := range getTables(deployment, "matchers") {
+		matcher := &Matcher{
+			Pattern:         getString(item, "pattern"),
+			CacheControl:    getString(item, "cacheControl"),
+			ContentType:     getString(item, "contentType"),
+			ContentEncoding: getString(item, "contentEncoding"),
+			Gzip:            getBool(item, "gzip"),
+			Force:           getBool(item, "force"),
+		}
+		re, err := regexp.Compile(matcher.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid deployment matcher pattern %q: %v", matcher.Pattern, err)
+		}
+		matcher.re = re
+		site.Deployment.Matchers = append(site.Deployment.Matchers, matcher)
+	}
+
+	return nil
+}
+
+// Target returns the deployment target with the given name, or the first
+// target when name is empty.
+func (deployment *Deployment) Target(name string) *Target {
+	for _, target := range deployment.Targets {
+		if name == "" || strings.EqualFold(target.Name, name) {
+			return target
+		}
+	}
+	return nil
+}
+
+// Matcher returns the first matcher whose pattern matches key, mirroring the
+// first-match-wins behaviour of hugo deploy.
+func (deployment *Deployment) Matcher(key string) *Matcher {
+	for _, matcher := range deployment.Matchers {
+		if matcher.Matches(key) {
+			return matcher
+		}
+	}
+	return nil
+}
+
+// HeadersHash identifies the headers the matchers give files, so a deploy
+// can tell whether they have changed since the last one.
+func (deployment *Deployment) HeadersHash() string {
+	hash := sha256.New()
+	for _, matcher := range deployment.Matchers {
+		fmt.Fprintf(hash, "%q %q %q %q %v\n", matcher.Pattern, matcher.CacheControl, matcher.ContentType, matcher.ContentEncoding, matcher.Gzip)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (matcher *Matcher) Matches(key string) bool {
+	return matcher.re != nil && matcher.re.MatchString(key)
+}
+
+// Bucket returns the bucket name and region from an s3:// target URL.
+func (target *Target) Bucket() (string, string, error) {
+	u, err := url.Parse(target.URL)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "s3" {
+		return "", "", fmt.Errorf("deployment target %q is not an s3:// URL", target.Name)
+	}
+	return u.Host, u.Query().Get("region"), nil
+}
+
+// Hugo config keys are case-insensitive.
+func get(values map[string]interface{}, key string) interface{} {
+	for k, v := range values {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
+
+func getString(values map[string]interface{}, key string) string {
+	s, _ := get(values, key).(string)
+	return s
+}
+
+func getBool(values map[string]interface{}, key string) bool {
+	b, _ := get(values, key).(bool)
+	return b
+}
+
+func getTables(values map[string]interface{}, key string) []map[string]interface{} {
+	tables := []map[string]interface{}{}
+	switch v := get(values, key).(type) {
+	case []map[string]interface{}:
+		tables = v
+	case []interface{}:
+		for _, item := range v {
+			if table, ok := item.(map[string]interface{}); ok {
+				tables = append(tables, table)
+			}
+		}
+	}
+	return tables
+}
@@ -0,0 +1,259 @@
+package hugo
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const tomlConfig = `
+baseURL = "https://example.com/"
+publishDir = "dist"
+defaultContentLanguage = "en"
+[languages.en]
+weight = 1
+[languages.FR]
+weight = 2
+[deployment]
+[[deployment.targets]]
+name = "production"
+URL = "s3://example-com?region=eu-west-1"
+cloudFrontDistributionID = "E123"
+[[deployment.matchers]]
+pattern = "^.+\\.(js|css)$"
+cacheControl = "max-age=31536000"
+gzip = true
+[[deployment.matchers]]
+pattern = "^feed\\.xml$"
+contentType = "application/rss+xml"
+force = true
+`
+
+const yamlConfig = `
+baseURL: https://example.com/
+publishDir: dist
+defaultContentLanguage: en
+languages:
+  en:
+    weight: 1
+  FR:
+    weight: 2
+deployment:
+  targets:
+    - name: production
+      URL: s3://example-com?region=eu-west-1
+      cloudFrontDistributionID: E123
+  matchers:
+    - pattern: ^.+\.(js|css)$
+      cacheControl: max-age=31536000
+      gzip: true
+    - pattern: ^feed\.xml$
+      contentType: application/rss+xml
+      force: true
+`
+
+const jsonConfig = `{
+  "baseURL": "https://example.com/",
+  "publishDir": "dist",
+  "defaultContentLanguage": "en",
+  "languages": {"en": {"weight": 1}, "FR": {"weight": 2}},
+  "deployment": {
+    "targets": [{"name": "production", "URL": "s3://example-com?region=eu-west-1", "cloudFrontDistributionID": "E123"}],
+    "matchers": [
+      {"pattern": "^.+\\.(js|css)$", "cacheControl": "max-age=31536000", "gzip": true},
+      {"pattern": "^feed\\.xml$", "contentType": "application/rss+xml", "force": true}
+    ]
+  }
+}`
+
+func writeConfig(t *testing.T, name string, config string) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLoadSiteConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"hugo.toml", tomlConfig},
+		{"config.toml", tomlConfig},
+		{"hugo.yaml", yamlConfig},
+		{"config.yml", yamlConfig},
+		{"hugo.json", jsonConfig},
+		// Keys are case-insensitive.
+		{"config.toml", strings.Replace(strings.Replace(tomlConfig, "baseURL", "baseurl", 1), "deployment", "Deployment", -1)},
+	}
+	for _, test := range tests {
+		site, err := LoadSiteConfig(writeConfig(t, test.name, test.config))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if site.BaseURL != "https://example.com/" || site.PublishDir != "dist" || filepath.Base(site.Path) != test.name {
+			t.Errorf("%s: loaded %+v", test.name, site)
+		}
+		if !reflect.DeepEqual(site.Languages, []string{"fr"}) {
+			t.Errorf("%s: Languages = %v, want [fr]", test.name, site.Languages)
+		}
+		want := []*Target{{Name: "production", URL: "s3://example-com?region=eu-west-1", CloudFrontDistributionID: "E123"}}
+		if !reflect.DeepEqual(site.Deployment.Targets, want) {
+			t.Errorf("%s: Targets = %+v", test.name, site.Deployment.Targets)
+		}
+		matchers := site.Deployment.Matchers
+		if len(matchers) != 2 || matchers[0].CacheControl != "max-age=31536000" || !matchers[0].Gzip || matchers[0].Force ||
+			matchers[1].ContentType != "application/rss+xml" || !matchers[1].Force {
+			t.Errorf("%s: Matchers = %+v", test.name, matchers)
+		}
+	}
+}
+
+func TestLoadSiteConfigOrder(t *testing.T) {
+	dir := writeConfig(t, "config.toml", `publishDir = "old"`)
+	if err := os.WriteFile(filepath.Join(dir, "hugo.yaml"), []byte("publishDir: new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	site, err := LoadSiteConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if site.PublishDir != "new" {
+		t.Errorf("PublishDir = %q, want hugo.yaml to win over config.toml", site.PublishDir)
+	}
+
+	// Without a config the defaults are used.
+	site, err = LoadSiteConfig(t.TempDir())
+	if err != nil || site.PublishDir != "public" || site.Path != "" {
+		t.Errorf("LoadSiteConfig without a config = %+v, %v", site, err)
+	}
+}
+
+func TestLoadSiteConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"config.toml", "baseURL = "},
+		{"config.yaml", "baseURL: [unclosed"},
+		{"config.json", "{"},
+		{"config.toml", "[[deployment.matchers]]\npattern = \"(\""},
+	}
+	for _, test := range tests {
+		if _, err := LoadSiteConfig(writeConfig(t, test.name, test.config)); err == nil {
+			t.Errorf("%s %q didn't fail", test.name, test.config)
+		}
+	}
+}
+
+func TestLanguages(t *testing.T) {
+	tests := []struct {
+		config string
+		want   []string
+	}{
+		{"", nil},
+		{"[languages.en]\n[languages.de]", []string{"de"}},
+		{"defaultContentLanguage = \"de\"\n[languages.en]\n[languages.de]", []string{"en"}},
+		{"defaultContentLanguageInSubdir = true\n[languages.en]\n[languages.de]", []string{"de", "en"}},
+	}
+	for _, test := range tests {
+		site, err := LoadSiteConfig(writeConfig(t, "hugo.toml", test.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(site.Languages, test.want) {
+			t.Errorf("%q: Languages = %v, want %v", test.config, site.Languages, test.want)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	site, err := LoadSiteConfig(writeConfig(t, "hugo.toml", tomlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key     string
+		pattern string
+	}{
+		{"css/style.css", `^.+\.(js|css)$`},
+		{"app.js", `^.+\.(js|css)$`},
+		{"app.json", ""},
+		{"feed.xml", `^feed\.xml$`},
+		{"blog/feed.xml", ""},
+	}
+	for _, test := range tests {
+		matcher := site.Deployment.Matcher(test.key)
+		pattern := ""
+		if matcher != nil {
+			pattern = matcher.Pattern
+		}
+		if pattern != test.pattern {
+			t.Errorf("Matcher(%q) = %q, want %q", test.key, pattern, test.pattern)
+		}
+	}
+	if (&Matcher{Pattern: ".*"}).Matches("index.html") {
+		t.Error("a matcher without a compiled pattern matched")
+	}
+}
+
+func TestTarget(t *testing.T) {
+	deployment := &Deployment{Targets: []*Target{
+		{Name: "staging", URL: "s3://staging-example-com"},
+		{Name: "production", URL: "s3://example-com?region=eu-west-1"},
+		{Name: "gcs", URL: "gs://example-com"},
+	}}
+	tests := []struct {
+		name   string
+		bucket string
+		region string
+		fails  bool
+	}{
+		{"", "staging-example-com", "", false},
+		{"Production", "example-com", "eu-west-1", false},
+		{"gcs", "", "", true},
+	}
+	for _, test := range tests {
+		target := deployment.Target(test.name)
+		if target == nil {
+			t.Fatalf("Target(%q) = nil", test.name)
+		}
+		bucket, region, err := target.Bucket()
+		if (err != nil) != test.fails || bucket != test.bucket || region != test.region {
+			t.Errorf("Target(%q).Bucket() = %q, %q, %v", test.name, bucket, region, err)
+		}
+	}
+	if deployment.Target("missing") != nil {
+		t.Error("found a target that doesn't exist")
+	}
+}
+
+func TestHeadersHash(t *testing.T) {
+	site, err := LoadSiteConfig(writeConfig(t, "hugo.toml", tomlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := site.Deployment.HeadersHash()
+	same, err := LoadSiteConfig(writeConfig(t, "hugo.yaml", yamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same.Deployment.HeadersHash() != hash {
+		t.Error("the same matchers hashed differently")
+	}
+	// force doesn't change the headers a file gets.
+	same.Deployment.Matchers[1].Force = false
+	if same.Deployment.HeadersHash() != hash {
+		t.Error("force changed the hash")
+	}
+	site.Deployment.Matchers[0].CacheControl = "no-cache"
+	if site.Deployment.HeadersHash() == hash {
+		t.Error("a changed cacheControl kept the hash")
+	}
+	if (&Deployment{}).HeadersHash() == hash {
+		t.Error("no matchers hashed like some")
+	}
+}
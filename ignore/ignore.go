@@ -0,0 +1,159 @@
+// Package ignore matches keys against gitignore-style patterns.
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Defaults are left out of every upload unless a pattern includes them
+// again. The last two keep a pulled copy of the bucket from overwriting the
+// tool's own state when it is uploaded again.
+var Defaults = []string{".DS_Store", "Thumbs.db", "desktop.ini", "*.swp", "*.swo", "*~", ".hugo-s3-deploy-pull.json", ".hugo-s3-deploy/"}
+
+type rule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// Matcher holds patterns in order. The last pattern matching a key decides
+// whether it is ignored, and a pattern starting with ! includes keys again.
+type Matcher struct {
+	rules []*rule
+}
+
+func NewMatcher() *Matcher {
+	return new(Matcher)
+}
+
+// Add appends patterns. Blank lines and lines starting with # are skipped.
+func (matcher *Matcher) Add(patterns ...string) error {
+	for _, line := range patterns {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := &rule{pattern: line}
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		// Patterns with a slash are relative to the root, others match
+		// at any depth.
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		expr := globToRegexp(line)
+		if !anchored {
+			expr = "(?:.*/)?" + expr
+		}
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return fmt.Errorf("Invalid ignore pattern %q, %v", r.pattern, err)
+		}
+		r.re = re
+		matcher.rules = append(matcher.rules, r)
+	}
+	return nil
+}
+
+// AddFile appends the patterns in file, one per line. A missing file adds
+// nothing.
+func (matcher *Matcher) AddFile(file string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := matcher.Add(lines...); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}
+
+// Ignored reports whether key, a slash separated path, is ignored. A
+// pattern matching one of its directories matches the key too. A nil
+// Matcher ignores nothing.
+func (matcher *Matcher) Ignored(key string) bool {
+	if matcher == nil {
+		return false
+	}
+	ignored := false
+	for _, r := range matcher.rules {
+		if r.matches(key) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+func (r *rule) matches(key string) bool {
+	if !r.dirOnly && r.re.MatchString(key) {
+		return true
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] == '/' && r.re.MatchString(key[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// globToRegexp translates *, ?, ** and [...] classes.
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String()
+}
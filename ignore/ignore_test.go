@@ -0,0 +1,86 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnored(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		key      string
+		ignored  bool
+	}{
+		{Defaults, ".DS_Store", true},
+		{Defaults, "img/.DS_Store", true},
+		{Defaults, "post/index.html.swp", true},
+		{Defaults, "post/index.html~", true},
+		{Defaults, ".hugo-s3-deploy/lock.json", true},
+		{Defaults, "index.html", false},
+
+		// Without a slash a pattern matches at any depth, with one it is
+		// relative to the root.
+		{[]string{"*.map"}, "js/app.js.map", true},
+		{[]string{"/app.js"}, "app.js", true},
+		{[]string{"/app.js"}, "js/app.js", false},
+		{[]string{"js/*.js"}, "js/app.js", true},
+		{[]string{"js/*.js"}, "js/vendor/app.js", false},
+		{[]string{"js/**/*.js"}, "js/vendor/app.js", true},
+		{[]string{"js/**/*.js"}, "js/app.js", true},
+		{[]string{"**/drafts"}, "blog/drafts/post.html", true},
+		{[]string{"drafts/**"}, "drafts/a/b.html", true},
+		{[]string{"page?.html"}, "page2.html", true},
+		{[]string{"page?.html"}, "page10.html", false},
+		{[]string{"page[0-9].html"}, "page2.html", true},
+		{[]string{"page[!0-9].html"}, "page2.html", false},
+		{[]string{`\!important.html`}, "!important.html", true},
+
+		// A pattern ending in / only matches directories, and so the keys
+		// inside them.
+		{[]string{"downloads/"}, "downloads/app.zip", true},
+		{[]string{"downloads/"}, "downloads", false},
+		{[]string{"downloads"}, "downloads", true},
+		{[]string{"downloads/"}, "old/downloads/app.zip", true},
+		{[]string{"/downloads/"}, "old/downloads/app.zip", false},
+
+		// The last matching pattern wins.
+		{[]string{"*.map", "!vendor.js.map"}, "vendor.js.map", false},
+		{[]string{"*.map", "!vendor.js.map"}, "app.js.map", true},
+		{[]string{"!vendor.js.map", "*.map"}, "vendor.js.map", true},
+		{append(Defaults, "!.DS_Store"), ".DS_Store", false},
+		{[]string{"# a comment", "", "  "}, "# a comment", false},
+	}
+	for _, test := range tests {
+		matcher := NewMatcher()
+		if err := matcher.Add(test.patterns...); err != nil {
+			t.Fatalf("Add(%q): %v", test.patterns, err)
+		}
+		if ignored := matcher.Ignored(test.key); ignored != test.ignored {
+			t.Errorf("%q: Ignored(%q) = %v, want %v", test.patterns, test.key, ignored, test.ignored)
+		}
+	}
+
+	var matcher *Matcher
+	if matcher.Ignored("index.html") {
+		t.Error("a nil Matcher ignored a key")
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	dir := t.TempDir()
+	matcher := NewMatcher()
+	if err := matcher.AddFile(filepath.Join(dir, ".deployignore")); err != nil {
+		t.Fatalf("a missing file failed: %v", err)
+	}
+	file := filepath.Join(dir, ".deployignore")
+	if err := os.WriteFile(file, []byte("# drafts\r\ndrafts/\r\n!drafts/keep.html\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := matcher.AddFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if !matcher.Ignored("drafts/post.html") || matcher.Ignored("drafts/keep.html") {
+		t.Errorf("%s wasn't applied", file)
+	}
+}
@@ -0,0 +1,413 @@
+// Package links finds broken links in a built site.
+package links
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchdennett/hugo-s3-deploy/ignore"
+	"golang.org/x/net/html"
+)
+
+// Client sends the requests checking external links. *http.Client
+// satisfies it.
+type Client interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Broken is a link that doesn't resolve.
+type Broken struct {
+	Page    string `json:"page"`
+	URL     string `json:"url"`
+	Problem string `json:"problem"`
+}
+
+// linkAttrs are the attributes holding a URL, by element.
+var linkAttrs = map[string][]string{
+	"a":      {"href"},
+	"area":   {"href"},
+	"link":   {"href"},
+	"img":    {"src", "srcset"},
+	"source": {"src", "srcset"},
+	"script": {"src"},
+	"iframe": {"src"},
+	"embed":  {"src"},
+	"video":  {"src", "poster"},
+	"audio":  {"src"},
+	"track":  {"src"},
+}
+
+// page is a parsed HTML file.
+type page struct {
+	ids   map[string]bool
+	links []string
+}
+
+// Checker resolves every internal href and src in the HTML files under Dir
+// against the built files. External links are fetched when External is set.
+type Checker struct {
+	Dir           string
+	InternalHosts map[string]bool
+	BasePath      string
+	Paths         map[string]bool
+	External      bool
+	Concurrency   int
+	CacheFile     string
+	CacheTTL      time.Duration
+	Client        Client
+	Ignore        *ignore.Matcher
+	pages         map[string]*page
+}
+
+func NewChecker(dir string) *Checker {
+	checker := new(Checker)
+	checker.Dir = dir
+	checker.InternalHosts = map[string]bool{}
+	checker.BasePath = "/"
+	checker.Paths = map[string]bool{}
+	checker.Concurrency = 8
+	checker.CacheTTL = 24 * time.Hour
+	checker.Client = &http.Client{Timeout: 10 * time.Second}
+	return checker
+}
+
+// SetInternalHosts sets the hosts whose absolute links point into the site,
+// such as its own domain.
+func (checker *Checker) SetInternalHosts(hosts []string) {
+	for _, host := range hosts {
+		checker.InternalHosts[strings.ToLower(host)] = true
+	}
+}
+
+// SetBasePath sets the path the site is served under, the path of its
+// baseURL, such as /docs/ for https://example.com/docs/.
+func (checker *Checker) SetBasePath(p string) {
+	checker.BasePath = strings.TrimSuffix(path.Clean("/"+p), "/") + "/"
+}
+
+// AddPaths marks paths as existing even though no file is built for them,
+// such as the sources of redirects.
+func (checker *Checker) AddPaths(paths []string) {
+	for _, p := range paths {
+		checker.Paths[p] = true
+	}
+}
+
+// SetExternal turns on checking external links, at most concurrency at a
+// time. Links that worked are remembered in cacheFile, when set, for ttl.
+func (checker *Checker) SetExternal(concurrency int, cacheFile string, ttl time.Duration) {
+	checker.External = true
+	if concurrency > 0 {
+		checker.Concurrency = concurrency
+	}
+	checker.CacheFile = cacheFile
+	checker.CacheTTL = ttl
+}
+
+func (checker *Checker) SetClient(client Client) {
+	checker.Client = client
+}
+
+// SetIgnore leaves out the files the upload leaves out, both as pages to
+// check and as link targets.
+func (checker *Checker) SetIgnore(matcher *ignore.Matcher) {
+	checker.Ignore = matcher
+}
+
+// Check returns the broken links in the site, and how many links it checked.
+// External links only count as checked when they are fetched.
+func (checker *Checker) Check() ([]*Broken, int, error) {
+	if err := checker.parse(); err != nil {
+		return nil, 0, err
+	}
+
+	broken := []*Broken{}
+	external := map[string][]string{}
+	checked := 0
+	for _, name := range checker.pageNames() {
+		base := &url.URL{Path: checker.BasePath + name}
+		for _, raw := range checker.pages[name].links {
+			target, err := url.Parse(strings.TrimSpace(raw))
+			if err != nil {
+				broken = append(broken, &Broken{Page: name, URL: raw, Problem: "invalid URL"})
+				continue
+			}
+			switch target.Scheme {
+			case "", "http", "https":
+			default:
+				// mailto:, tel:, data: and the like.
+				continue
+			}
+			if target.Host != "" && !checker.InternalHosts[strings.ToLower(target.Hostname())] {
+				if !checker.External {
+					continue
+				}
+				checked++
+				if target.Scheme == "" {
+					target.Scheme = "https"
+				}
+				target.Fragment = ""
+				link := target.String()
+				if pages := external[link]; len(pages) == 0 || pages[len(pages)-1] != name {
+					external[link] = append(pages, name)
+				}
+				continue
+			}
+			resolved := base.ResolveReference(target)
+			p, ok := checker.sitePath(resolved.Path)
+			if !ok {
+				// Elsewhere on the domain, outside the site.
+				continue
+			}
+			checked++
+			if problem := checker.resolve(p, resolved.Fragment); problem != "" {
+				broken = append(broken, &Broken{Page: name, URL: raw, Problem: problem})
+			}
+		}
+	}
+
+	if len(external) > 0 {
+		broken = append(broken, checker.checkExternal(external)...)
+	}
+	return broken, checked, nil
+}
+
+func (checker *Checker) pageNames() []string {
+	names := []string{}
+	for name := range checker.pages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parse reads the ids and links of every HTML file.
+func (checker *Checker) parse() error {
+	checker.pages = map[string]*page{}
+	return filepath.Walk(checker.Dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if ext := strings.ToLower(filepath.Ext(file)); ext != ".html" && ext != ".htm" {
+			return nil
+		}
+		rel, err := filepath.Rel(checker.Dir, file)
+		if err != nil {
+			return err
+		}
+		if checker.Ignore.Ignored(filepath.ToSlash(rel)) {
+			return nil
+		}
+		body, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		parsed, err := parsePage(body)
+		if err != nil {
+			return fmt.Errorf("Unable to parse %s, %v", file, err)
+		}
+		checker.pages[filepath.ToSlash(rel)] = parsed
+		return nil
+	})
+}
+
+func parsePage(body io.Reader) (*page, error) {
+	parsed := &page{ids: map[string]bool{}}
+	tokens := html.NewTokenizer(body)
+	for {
+		switch tokens.Next() {
+		case html.ErrorToken:
+			if err := tokens.Err(); err != io.EOF {
+				return nil, err
+			}
+			return parsed, nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokens.Token()
+			attrs := linkAttrs[token.Data]
+			for _, attr := range token.Attr {
+				if attr.Key == "id" || (token.Data == "a" && attr.Key == "name") {
+					parsed.ids[attr.Val] = true
+				}
+				for _, key := range attrs {
+					if attr.Key != key || attr.Val == "" {
+						continue
+					}
+					if key == "srcset" {
+						parsed.links = append(parsed.links, srcsetURLs(attr.Val)...)
+					} else {
+						parsed.links = append(parsed.links, attr.Val)
+					}
+				}
+			}
+		}
+	}
+}
+
+// srcsetURLs splits a srcset into its URLs, dropping the width and density
+// descriptors.
+func srcsetURLs(srcset string) []string {
+	urls := []string{}
+	for _, candidate := range strings.Split(srcset, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) > 0 {
+			urls = append(urls, fields[0])
+		}
+	}
+	return urls
+}
+
+// sitePath returns p relative to the site's base path, or false when p is
+// outside it.
+func (checker *Checker) sitePath(p string) (string, bool) {
+	if p+"/" == checker.BasePath {
+		return "/", true
+	}
+	if !strings.HasPrefix(p, checker.BasePath) {
+		return "", false
+	}
+	return "/" + strings.TrimPrefix(p, checker.BasePath), true
+}
+
+// resolve finds the built file for an internal path, and the anchor within
+// it. It returns what's wrong, or "" when the link works.
+func (checker *Checker) resolve(p string, fragment string) string {
+	if checker.Paths[p] || checker.Paths[strings.TrimSuffix(p, "/")] {
+		return ""
+	}
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if strings.HasSuffix(p, "/") {
+		name = path.Join(name, "index.html")
+	}
+
+	info, err := os.Stat(filepath.Join(checker.Dir, filepath.FromSlash(name)))
+	if err == nil && info.IsDir() {
+		// The website endpoint redirects /dir to /dir/.
+		name = path.Join(name, "index.html")
+		info, err = os.Stat(filepath.Join(checker.Dir, filepath.FromSlash(name)))
+	}
+	if err != nil {
+		return "no such file " + name
+	}
+	if checker.Ignore.Ignored(name) {
+		return name + " is ignored, so it isn't uploaded"
+	}
+
+	if fragment == "" || fragment == "top" {
+		return ""
+	}
+	target, ok := checker.pages[name]
+	if ok && !target.ids[fragment] {
+		return "no anchor #" + fragment + " in " + name
+	}
+	return ""
+}
+
+// checkExternal fetches each external URL once. links maps each URL to the
+// pages linking to it.
+func (checker *Checker) checkExternal(links map[string][]string) []*Broken {
+	cache := checker.loadCache()
+	problems := map[string]string{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, checker.Concurrency)
+	for link := range links {
+		if checked, ok := cache[link]; ok && time.Since(checked) < checker.CacheTTL {
+			continue
+		}
+		wg.Add(1)
+		go func(link string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			problem := checker.fetch(link)
+			mu.Lock()
+			defer mu.Unlock()
+			if problem == "" {
+				cache[link] = time.Now()
+			} else {
+				problems[link] = problem
+			}
+		}(link)
+	}
+	wg.Wait()
+	checker.saveCache(cache)
+
+	broken := []*Broken{}
+	for link, problem := range problems {
+		for _, name := range links[link] {
+			broken = append(broken, &Broken{Page: name, URL: link, Problem: problem})
+		}
+	}
+	sort.Slice(broken, func(i, j int) bool {
+		if broken[i].Page != broken[j].Page {
+			return broken[i].Page < broken[j].Page
+		}
+		return broken[i].URL < broken[j].URL
+	})
+	return broken
+}
+
+// fetch requests an external URL, trying GET for servers that refuse HEAD.
+func (checker *Checker) fetch(link string) string {
+	status := 0
+	for _, method := range []string{"HEAD", "GET"} {
+		req, err := http.NewRequest(method, link, nil)
+		if err != nil {
+			return err.Error()
+		}
+		req.Header.Set("User-Agent", "hugo-s3-deploy link checker")
+		resp, err := checker.Client.Do(req)
+		if err != nil {
+			return err.Error()
+		}
+		resp.Body.Close()
+		status = resp.StatusCode
+		if status < 400 || status == http.StatusTooManyRequests {
+			// A rate limited link isn't known to be broken.
+			return ""
+		}
+	}
+	return fmt.Sprintf("status %d", status)
+}
+
+func (checker *Checker) loadCache() map[string]time.Time {
+	cache := map[string]time.Time{}
+	if checker.CacheFile == "" {
+		return cache
+	}
+	if dat, err := ioutil.ReadFile(checker.CacheFile); err == nil {
+		json.Unmarshal(dat, &cache)
+	}
+	return cache
+}
+
+func (checker *Checker) saveCache(cache map[string]time.Time) {
+	if checker.CacheFile == "" {
+		return
+	}
+	for link, checked := range cache {
+		if time.Since(checked) >= checker.CacheTTL {
+			delete(cache, link)
+		}
+	}
+	dat, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(checker.CacheFile), 0755); err == nil {
+		ioutil.WriteFile(checker.CacheFile, dat, 0644)
+	}
+}
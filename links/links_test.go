@@ -0,0 +1,139 @@
+package links
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mitchdennett/hugo-s3-deploy/ignore"
+)
+
+func site(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, body := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func problems(broken []*Broken) map[string]string {
+	found := map[string]string{}
+	for _, link := range broken {
+		found[link.Page+" "+link.URL] = link.Problem
+	}
+	return found
+}
+
+func TestCheck(t *testing.T) {
+	dir := site(t, map[string]string{
+		"index.html": `<a href="/about/">about</a>
+<a href="/about/#team">team</a>
+<a href="/about/#nobody">nobody</a>
+<a href="docs">docs</a>
+<a href="/missing/">missing</a>
+<a href="/old">redirected</a>
+<a href="https://example.com/about/">own domain</a>
+<a href="https://other.example/">external</a>
+<a href="mailto:me@example.com">mail</a>
+<img src="/drafts/plan.png" srcset="/img/a.png 1x, /img/b.png 2x">`,
+		"about/index.html": `<h2 id="team">Team</h2>`,
+		"docs/index.html":  `<a href="../index.html">home</a>`,
+		"img/a.png":        "",
+		"img/b.png":        "",
+		"drafts/plan.png":  "",
+		// Ignored pages aren't uploaded, so their links aren't checked.
+		"drafts/index.html": `<a href="/nowhere/">nowhere</a>`,
+	})
+	matcher := ignore.NewMatcher()
+	if err := matcher.Add("drafts/"); err != nil {
+		t.Fatal(err)
+	}
+
+	checker := NewChecker(dir)
+	checker.SetInternalHosts([]string{"example.com"})
+	checker.AddPaths([]string{"/old"})
+	checker.SetIgnore(matcher)
+	broken, checked, err := checker.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"index.html /about/#nobody":   "no anchor #nobody in about/index.html",
+		"index.html /missing/":        "no such file missing/index.html",
+		"index.html /drafts/plan.png": "drafts/plan.png is ignored, so it isn't uploaded",
+	}
+	if got := problems(broken); !reflect.DeepEqual(got, want) {
+		t.Errorf("broken = %v, want %v", got, want)
+	}
+	// The external link and mailto: aren't checked.
+	if checked != 11 {
+		t.Errorf("checked = %d, want 11", checked)
+	}
+}
+
+func TestCheckExternal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir := site(t, map[string]string{
+		"index.html": `<a href="` + server.URL + `/ok">ok</a><a href="` + server.URL + `/gone">gone</a>`,
+		"other.html": `<a href="` + server.URL + `/ok">ok</a>`,
+	})
+	checker := NewChecker(dir)
+	checker.SetExternal(2, "", 0)
+	checker.SetClient(server.Client())
+	broken, checked, err := checker.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(broken) != 1 || broken[0].URL != server.URL+"/gone" || broken[0].Page != "index.html" {
+		t.Errorf("broken = %v, want %s/gone on index.html", problems(broken), server.URL)
+	}
+	if checked != 3 {
+		t.Errorf("checked = %d, want 3", checked)
+	}
+}
+
+func TestCheckBasePath(t *testing.T) {
+	dir := site(t, map[string]string{
+		"index.html": `<a href="/docs/about/">about</a>
+<a href="https://example.com/docs/about/#team">own domain</a>
+<a href="about/">relative</a>
+<a href="/docs">base</a>
+<a href="/docs/old">redirected</a>
+<a href="/docs/missing/">missing</a>
+<a href="/blog/">elsewhere on the domain</a>`,
+		"about/index.html": `<h2 id="team">Team</h2><a href="../">home</a><a href="/about/">outside</a>`,
+	})
+	checker := NewChecker(dir)
+	checker.SetInternalHosts([]string{"example.com"})
+	checker.SetBasePath("/docs/")
+	checker.AddPaths([]string{"/old"})
+	broken, checked, err := checker.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"index.html /docs/missing/": "no such file missing/index.html",
+	}
+	if got := problems(broken); !reflect.DeepEqual(got, want) {
+		t.Errorf("broken = %v, want %v", got, want)
+	}
+	// Links outside /docs/ aren't part of the site, so they aren't checked.
+	if checked != 7 {
+		t.Errorf("checked = %d, want 7", checked)
+	}
+}
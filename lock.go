@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	"github.com/mitchdennett/hugo-s3-deploy/service/storage"
+)
+
+// The lock is shared by every environment deploying to the bucket, since
+// they can overwrite each other's files.
+const lockKey = stateKeyPrefix + "lock.json"
+
+const defaultLockTTL = 30 * time.Minute
+
+// deployLock is held in the bucket while a command changes it, so two
+// deploys can't interleave their uploads and prunes.
+type deployLock struct {
+	Id      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	Host    string    `json:"host"`
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+	TTL     string    `json:"ttl"`
+	Expires time.Time `json:"expires"`
+
+	ttl time.Duration
+	// etag is the ETag of the lock object as last written by this command,
+	// so it is only renewed or taken over if nobody changed it since.
+	etag string
+}
+
+func (lock *deployLock) String() string {
+	return fmt.Sprintf("%s on %s (%s, started %s, expires %s)", lock.Owner, lock.Host, lock.Command,
+		lock.Started.Local().Format(time.RFC1123), lock.Expires.Local().Format(time.RFC1123))
+}
+
+// identity returns the user running the command and the host it runs on.
+func identity() (string, string) {
+	owner := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		owner = current.Username
+	}
+	host, _ := os.Hostname()
+	return owner, host
+}
+
+func randomId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func newLock(command string, ttl time.Duration) *deployLock {
+	owner, host := identity()
+	started := time.Now().UTC()
+	return &deployLock{
+		Id:      randomId(),
+		Owner:   owner,
+		Host:    host,
+		Command: command,
+		Started: started,
+		TTL:     ttl.String(),
+		Expires: started.Add(ttl),
+		ttl:     ttl,
+	}
+}
+
+func lockTTL(s *site) (time.Duration, error) {
+	ttl := configString(s.Config, "lock.ttl", "")
+	if ttl == "" {
+		return defaultLockTTL, nil
+	}
+	duration, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid lock.ttl %q, %v", ttl, err)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("Invalid lock.ttl %q, it must be positive", ttl)
+	}
+	return duration, nil
+}
+
+func readLock(bucket storage.Storage) (*deployLock, string, error) {
+	lock := &deployLock{}
+	etag, found, err := bucket.GetJSONETag(lockKey, lock)
+	if err != nil || !found {
+		return nil, "", err
+	}
+	return lock, etag, nil
+}
+
+// acquireLock takes the lock for command. A lock left behind by a deploy
+// that died is taken over once it expires, replacing it only if it is still
+// the lock that was read, so two deploys can't both take it over.
+func acquireLock(s *site, command string) (*deployLock, error) {
+	ttl, err := lockTTL(s)
+	if err != nil {
+		return nil, err
+	}
+	lock := newLock(command, ttl)
+
+	for attempt := 0; attempt < 3; attempt++ {
+		created, err := s.bucket.CreateJSON(lockKey, lock)
+		if err != nil {
+			return nil, err
+		}
+		held, etag, err := readLock(s.bucket)
+		if err != nil {
+			return nil, err
+		}
+		if created && held != nil && held.Id == lock.Id {
+			lock.etag = etag
+			return lock, nil
+		}
+		if held == nil {
+			continue
+		}
+		if time.Now().Before(held.Expires) {
+			return nil, errors.New("The bucket is locked by " + held.String() + ". Pass -force-unlock if that deploy is no longer running")
+		}
+		output.Println("Taking over expired lock held by " + held.String())
+		etag, err = s.bucket.ReplaceJSON(lockKey, lock, etag)
+		if err != nil {
+			return nil, err
+		}
+		if etag != "" {
+			lock.etag = etag
+			return lock, nil
+		}
+		// Another deploy changed the lock first.
+	}
+	return nil, errors.New("Unable to take the deploy lock")
+}
+
+var errLockLost = errors.New("the lock was taken over or removed")
+
+// renewLock pushes back the lock's expiry by its TTL, unless it has been
+// taken over or removed.
+func renewLock(s *site, lock *deployLock) error {
+	renewed := *lock
+	renewed.Expires = time.Now().UTC().Add(lock.ttl)
+	etag, err := s.bucket.ReplaceJSON(lockKey, &renewed, lock.etag)
+	if err != nil {
+		return err
+	}
+	if etag == "" {
+		return errLockLost
+	}
+	lock.Expires = renewed.Expires
+	lock.etag = etag
+	return nil
+}
+
+// lockKeeper renews a lock while a command runs, and records when it was
+// lost, after which the command must stop changing the bucket.
+type lockKeeper struct {
+	lock    *deployLock
+	err     error
+	mu      sync.Mutex
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// keepLock renews the lock every third of its TTL until Stop is called, so
+// a deploy running longer than the TTL keeps it. A renewal that fails is
+// tried again at the next tick until the lock expires. The lock is lost
+// once it has expired or someone else has changed it.
+func keepLock(s *site, lock *deployLock) *lockKeeper {
+	keeper := &lockKeeper{lock: lock, done: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(keeper.stopped)
+		ticker := time.NewTicker(lock.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-keeper.done:
+				return
+			case <-ticker.C:
+				err := renewLock(s, lock)
+				if err == nil {
+					continue
+				}
+				if err != errLockLost && time.Now().Before(lock.Expires) {
+					output.Println("Unable to renew the deploy lock, trying again, " + err.Error())
+					continue
+				}
+				keeper.mu.Lock()
+				keeper.err = fmt.Errorf("Lost the deploy lock, %v. Another deploy may be changing the bucket", err)
+				keeper.mu.Unlock()
+				return
+			}
+		}
+	}()
+	return keeper
+}
+
+// Err returns why the lock was lost, or nil while it is held. A nil
+// lockKeeper, for a command run without the lock, never loses it.
+func (keeper *lockKeeper) Err() error {
+	if keeper == nil {
+		return nil
+	}
+	keeper.mu.Lock()
+	defer keeper.mu.Unlock()
+	return keeper.err
+}
+
+// Stop stops renewing the lock and returns Err.
+func (keeper *lockKeeper) Stop() error {
+	close(keeper.done)
+	<-keeper.stopped
+	return keeper.Err()
+}
+
+// withLock runs f while holding the lock. A bucket that doesn't exist yet
+// can't hold a lock, so the deploy creating it runs without one. Commands
+// check s.lock before each change to the bucket, and f fails if the lock
+// was lost while it ran.
+func withLock(s *site, command string, f func() (int, error)) (int, error) {
+	exists, err := s.bucket.Exists()
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return f()
+	}
+
+	lock, err := acquireLock(s, command)
+	if err != nil {
+		return 0, err
+	}
+	s.lock = keepLock(s, lock)
+	n, err := f()
+	lost := s.lock.Stop()
+	s.lock = nil
+	if lost != nil {
+		return n, lost
+	}
+	if err := releaseLock(s, lock); err != nil {
+		output.Println("Unable to release the deploy lock, " + err.Error())
+	}
+	return n, err
+}
+
+// releaseLock removes the lock unless it has since been taken over. The
+// delete is conditional on the ETag the lock was last written with, so a
+// lock someone else now holds is never removed.
+func releaseLock(s *site, lock *deployLock) error {
+	held, etag, err := readLock(s.bucket)
+	if err != nil || held == nil || held.Id != lock.Id {
+		return err
+	}
+	if etag != lock.etag {
+		return errLockLost
+	}
+	deleted, err := s.bucket.DeleteIfMatch(lockKey, lock.etag)
+	if err == nil && !deleted {
+		err = errLockLost
+	}
+	return err
+}
+
+func forceUnlock(s *site) error {
+	held, _, err := readLock(s.bucket)
+	if err != nil || held == nil {
+		return err
+	}
+	output.Println("Removing lock held by " + held.String())
+	return s.bucket.Delete(lockKey)
+}
+
+// status prints who holds the lock.
+func status(s *site) error {
+	held, _, err := readLock(s.bucket)
+	if err != nil {
+		return err
+	}
+	if held == nil {
+		output.Println(s.Name + ": not locked")
+		return s.out.Summary(map[string]interface{}{"locked": false})
+	}
+	expired := time.Now().After(held.Expires)
+	state := "locked"
+	if expired {
+		state = "locked (expired)"
+	}
+	output.Println(s.Name + ": " + state + " by " + held.String())
+	return s.out.Summary(map[string]interface{}{"locked": true, "expired": expired, "lock": held})
+}
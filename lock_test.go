@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mitchdennett/hugo-s3-deploy/service/local"
+	"github.com/pelletier/go-toml"
+)
+
+func lockSite(t *testing.T) *site {
+	config, err := toml.Load("[lock]\nttl = \"1h\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &site{Name: "test", Config: config, bucket: local.NewDirectory(t.TempDir())}
+}
+
+func TestAcquireLock(t *testing.T) {
+	s := lockSite(t)
+	lock, err := acquireLock(s, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireLock(s, "deploy"); err == nil {
+		t.Fatal("took a lock that is held")
+	}
+
+	// Expire the lock, as if its deploy had died.
+	expired := *lock
+	expired.Expires = time.Now().Add(-time.Minute)
+	if err := s.bucket.PutJSON(lockKey, &expired); err != nil {
+		t.Fatal(err)
+	}
+	taken, err := acquireLock(s, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taken.Id == lock.Id {
+		t.Fatal("took over the lock without replacing it")
+	}
+
+	// The first deploy lost the lock, so it can neither renew nor release
+	// it.
+	if err := renewLock(s, lock); err == nil {
+		t.Error("renewed a lock that was taken over")
+	}
+	if err := releaseLock(s, lock); err != nil {
+		t.Fatal(err)
+	}
+	if held, _, _ := readLock(s.bucket); held == nil || held.Id != taken.Id {
+		t.Errorf("lock = %v, want the one taken over", held)
+	}
+
+	before := taken.Expires
+	time.Sleep(10 * time.Millisecond)
+	if err := renewLock(s, taken); err != nil {
+		t.Fatal(err)
+	}
+	if held, _, _ := readLock(s.bucket); held == nil || !held.Expires.After(before) {
+		t.Errorf("renewing didn't push back the expiry")
+	}
+	if err := releaseLock(s, taken); err != nil {
+		t.Fatal(err)
+	}
+	if held, _, _ := readLock(s.bucket); held != nil {
+		t.Errorf("lock = %v after release", held)
+	}
+}
+
+func TestTakeOverRace(t *testing.T) {
+	s := lockSite(t)
+	lock, err := acquireLock(s, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Expires = time.Now().Add(-time.Minute)
+	if err := s.bucket.PutJSON(lockKey, lock); err != nil {
+		t.Fatal(err)
+	}
+	_, etag, err := readLock(s.bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two deploys read the same expired lock. Only the first replaces it.
+	if first, err := s.bucket.ReplaceJSON(lockKey, newLock("deploy", time.Hour), etag); err != nil || first == "" {
+		t.Fatalf("first takeover = %q, %v", first, err)
+	}
+	if second, err := s.bucket.ReplaceJSON(lockKey, newLock("deploy", time.Hour), etag); err != nil || second != "" {
+		t.Fatalf("second takeover = %q, %v, want it refused", second, err)
+	}
+}
+
+func TestLostLock(t *testing.T) {
+	s := lockSite(t)
+	s.Config.Set("lock.ttl", "30ms")
+	other := newLock("deploy", time.Hour)
+	_, err := withLock(s, "deploy", func() (int, error) {
+		// Another deploy takes the lock over, as if this one had stalled
+		// past its expiry.
+		if err := s.bucket.PutJSON(lockKey, other); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for s.lock.Err() == nil && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if s.lock.Err() == nil {
+			t.Error("the lock wasn't lost when it was taken over")
+		}
+		return 0, nil
+	})
+	if err == nil {
+		t.Error("the command succeeded after losing the lock")
+	}
+	if held, _, _ := readLock(s.bucket); held == nil || held.Id != other.Id {
+		t.Errorf("lock = %v, want the one that took over", held)
+	}
+}
+
+func TestReleaseChangedLock(t *testing.T) {
+	s := lockSite(t)
+	lock, err := acquireLock(s, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lock object changed since this command last wrote it.
+	changed := *lock
+	changed.Expires = changed.Expires.Add(time.Minute)
+	if err := s.bucket.PutJSON(lockKey, &changed); err != nil {
+		t.Fatal(err)
+	}
+	if err := releaseLock(s, lock); err == nil {
+		t.Error("released a lock that had changed")
+	}
+	if held, _, _ := readLock(s.bucket); held == nil {
+		t.Error("the changed lock was removed")
+	}
+}
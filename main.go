@@ -1,108 +1,982 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
-	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/mitchdennett/hugo-s3-deploy/budget"
+	"github.com/mitchdennett/hugo-s3-deploy/headers"
+	"github.com/mitchdennett/hugo-s3-deploy/hooks"
+	"github.com/mitchdennett/hugo-s3-deploy/hugo"
+	"github.com/mitchdennett/hugo-s3-deploy/links"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	"github.com/mitchdennett/hugo-s3-deploy/redirects"
 	"github.com/mitchdennett/hugo-s3-deploy/service/acm"
-	"github.com/mitchdennett/hugo-s3-deploy/service/cloudfront"
+	"github.com/mitchdennett/hugo-s3-deploy/service/lambda"
 	"github.com/mitchdennett/hugo-s3-deploy/service/route53"
-	s3Service "github.com/mitchdennett/hugo-s3-deploy/service/s3"
+	"github.com/mitchdennett/hugo-s3-deploy/service/storage"
+	"github.com/mitchdennett/hugo-s3-deploy/verify"
 	"github.com/pelletier/go-toml"
 )
 
 var preserveDirStructureBool bool
-var bucketExists bool
 
-var bucketName string
-var domainName string
-var hostedZoneId string
-var region string
+var targetName = flag.String("target", "", "name of the [[deployment.targets]] entry in the Hugo site config to deploy to")
+var envName = flag.String("env", "", "environment from an [env.<name>] section of deploy.toml to deploy to")
+var branchName = flag.String("branch", "", "branch to deploy a preview for, defaults to the checked out branch")
+var releaseId = flag.String("release", "", "id of the release to upload when [releases] is enabled, defaults to the short commit SHA or the current time")
+var allowDirty = flag.Bool("allow-dirty", false, "deploy even if the git working tree has uncommitted changes")
+var siteName = flag.String("site", "", "name of the [[site]] entry in deploy.toml to deploy")
+var allSites = flag.Bool("all", false, "run the command for every [[site]] in deploy.toml")
+var forceUnlockFlag = flag.Bool("force-unlock", false, "remove the deploy lock, even if another deploy holds it, before running the command")
+var parallelSites = flag.Int("parallel", 4, "number of sites to run at once with -all")
+var verbose = flag.Bool("verbose", false, "print details such as retried AWS requests")
+var maxBandwidth = flag.String("max-bandwidth", "", "limit uploads to a rate such as 5MB/s, shared by every upload running at once")
+var outputFormat = flag.String("output", "text", "output format, text or json for JSON lines on stdout")
 
 func main() {
+	command, args := parseCommand()
+	if err := output.SetFormat(*outputFormat); err != nil {
+		log.Fatal(err)
+	}
+	output.SetVerbose(*verbose)
 	preserveDirStructureBool = true
-	fmt.Println("Loading deploy.toml file...")
+	output.Println("Loading deploy.toml file...")
 	dir, err := os.Getwd()
 	if err != nil {
-		log.Fatal(err)
+		fail(nil, err)
 	}
 
 	config := loadConfigToml(dir)
-	bucketName = config.Get("aws.bucketname").(string)
-	domainName = config.Get("aws.domain").(string)
-	hostedZoneId = config.Get("aws.hostedzoneid").(string)
-	region = config.Get("aws.region").(string)
-
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(config.Get("aws.region").(string)),
-		Credentials: credentials.NewStaticCredentials(config.Get("aws.keyid").(string), config.Get("aws.secretkey").(string), ""),
+	sites, err := loadSites(dir, config)
+	if err != nil {
+		fail(nil, err)
+	}
+
+	if !*allSites {
+		s, err := selectSite(sites)
+		if err != nil {
+			fail(nil, err)
+		}
+		if err := connect([]*site{s}); err != nil {
+			fail(nil, err)
+		}
+		if _, err := run(command, args, s); err != nil {
+			fail(s.out, err)
+		}
+		return
+	}
+
+	if err := connect(sites); err != nil {
+		fail(nil, err)
+	}
+	output.SetConcurrentSites(*parallelSites > 1 && len(sites) > 1)
+	if !printReport(runAll(command, args, sites, *parallelSites)) {
+		os.Exit(1)
+	}
+}
+
+// fail reports err, as a failure of the current step when out is set, and
+// exits.
+func fail(out *output.Printer, err error) {
+	if out == nil {
+		out = output.NewPrinter("")
+	}
+	out.Fail(err)
+	log.Fatal(err)
+}
+
+// parseCommand splits the command line into a command, which defaults to
+// deploy, and its arguments. Flags may come before or after the command.
+func parseCommand() (string, []string) {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		return "deploy", nil
+	}
+	command := flag.Arg(0)
+	flag.CommandLine.Parse(flag.Args()[1:])
+	return command, flag.Args()
+}
+
+// run runs command for a site, returning how many files were uploaded.
+// Commands that change the bucket hold the deploy lock while they run.
+func run(command string, args []string, s *site) (int, error) {
+	if *forceUnlockFlag {
+		if err := forceUnlock(s); err != nil {
+			return 0, err
+		}
+	}
+	switch command {
+	case "status":
+		return 0, status(s)
+	case "history":
+		return 0, history(s, args)
+	case "verify":
+		if s.usesCloudFront() && s.dist.Id == "" {
+			if _, err := s.dist.FindByAlias(); err != nil {
+				return 0, err
+			}
+		}
+		checks, err := verifySite(s, "", nil)
+		if err != nil {
+			return 0, err
+		}
+		return 0, s.out.Summary(map[string]interface{}{"checks": checks})
+	case "pull":
+		return 0, pull(s, args)
+	}
+	return withLock(s, command, func() (int, error) {
+		return runCommand(command, args, s)
 	})
+}
+
+func runCommand(command string, args []string, s *site) (int, error) {
+	switch command {
+	case "deploy":
+		return deploy(s)
+	case "push":
+		return push(s, args)
+	case "rollback":
+		if !s.usesCloudFront() {
+			return 0, errors.New("Rolling back switches the CloudFront origin, so it needs S3 storage")
+		}
+		release := ""
+		if len(args) > 0 {
+			release = args[0]
+		}
+		if s.dist.Id == "" {
+			found, err := s.dist.FindByAlias()
+			if err != nil {
+				return 0, err
+			}
+			if !found {
+				return 0, errors.New("No CloudFront Distribution was found for " + s.DomainName)
+			}
+		}
+		return 0, rollback(s.out, s.bucket, s.dist, release)
+	case "preview":
+		if len(args) > 0 && args[0] == "cleanup" {
+			return 0, cleanupPreviews(s)
+		}
+		return preview(s)
+	default:
+		return 0, fmt.Errorf("Unknown command %q", command)
+	}
+}
 
-	bucket := s3Service.NewBucket(sess)
-	bucket.SetName(bucketName)
-	bucket.SetRegion(region)
+func deploy(s *site) (int, error) {
+	started := time.Now().UTC()
+	dir, config, sess, bucket, dist := s.Dir, s.Config, s.session, s.bucket, s.dist
+	publishDir := s.Builder.PublishDir()
+
+	git := loadGitInfo(dir)
+	if git != nil && git.Dirty && !*allowDirty {
+		return 0, errors.New("The git working tree has uncommitted changes. Commit them or pass -allow-dirty")
+	}
+	if git != nil {
+		bucket.SetMetadata(map[string]string{"git-sha": git.Commit})
+	}
+
+	redirectRules, err := redirects.Load(dir+"/static/_redirects", publishDir+"/_redirects")
+	if err != nil {
+		return 0, fmt.Errorf("Could not read _redirects file %v", err)
+	}
+	// The function checks exact paths before splat and placeholder rules.
+	redirectObjects, exactRedirects, dynamicRedirects := redirects.Split(redirectRules)
+	functionRedirects := append(exactRedirects, dynamicRedirects...)
+
+	headerRules, err := loadHeaders(dir, publishDir, config)
+	if err != nil {
+		return 0, fmt.Errorf("Could not read headers %v", err)
+	}
+	defaultHeaders, pathHeaders := headers.Compile(headerRules)
+
+	bucket.SetRedirects(redirectRules, s.DomainName)
 
 	cert := acm.NewCert(sess)
-	cert.SetDomainName(domainName)
-	cert.SetHostedZoneId(hostedZoneId)
+	cert.SetDomainName(s.DomainName)
+	cert.SetHostedZoneId(s.HostedZoneId)
+
+	versioned := configBool(config, "releases.enabled", false)
+	release := *releaseId
+	if release == "" && git != nil && !git.Dirty {
+		release = git.ShortCommit()
+	}
+	if release == "" {
+		release = time.Now().UTC().Format("20060102T150405Z")
+	}
+	keyPrefix := ""
+	if versioned {
+		keyPrefix = releaseKeyPrefix(release)
+	} else {
+		release = ""
+	}
+	bucket.SetKeyPrefix(keyPrefix)
+
+	changedFiles := ""
+	runHooks := func(stage string) error {
+		s.out.Done()
+		return hooks.Run(s.Hooks, stage, dir, hookEnv(s, release, changedFiles))
+	}
+
+	bucketExists, err := bucket.CreateOrRetrieve()
+	if err != nil {
+		return 0, err
+	}
+
+	// A site joining a shared bucket still needs its own certificate and
+	// distribution.
+	setUp := !bucketExists
+	if bucketExists && s.Prefix != "" && s.usesCloudFront() && dist.Id == "" {
+		found, err := dist.FindByAlias()
+		if err != nil {
+			return 0, err
+		}
+		setUp = !found
+	}
+
+	if setUp {
+		if s.usesCloudFront() {
+			s.out.Step("request-certificate", "Requesting Cert....")
+			if err := cert.Request(sess); err != nil {
+				return 0, err
+			}
+			resourceRecord, err := cert.DescribeCertificate()
+			if err != nil {
+				return 0, err
+			}
+
+			s.out.Step("insert-certificate-dns", "Inserting Cert DNS Verification")
+			if err := route53.InsertNewRecord(sess, cert, resourceRecord); err != nil {
+				return 0, err
+			}
+		}
+
+		s.out.Step("set-bucket-policy", "Setting Bucket Policy....")
+		if err := bucket.MakePublic(); err != nil {
+			return 0, err
+		}
+
+		s.out.Step("enable-web-hosting", "Setting up bucket for hosting....")
+		if err := bucket.EnableWebHosting(); err != nil {
+			return 0, err
+		}
+
+		if s.usesCloudFront() {
+			s.out.Step("create-distribution", "Creating CloudFront Distribution....")
+			if err := dist.CreateDistribution(); err != nil {
+				return 0, err
+			}
+
+			s.out.Step("add-distribution-dns", "Adding CloudFront Domain To DNS....")
+			if err := route53.ChangeHostedZoneRecord(dist.DomainName, sess, s.DomainName, s.HostedZoneId); err != nil {
+				return 0, err
+			}
+		}
+	} else {
+		// Reapply the policy so buckets created by older versions keep
+		// the tool's state off the website.
+		if err := bucket.MakePublic(); err != nil {
+			return 0, err
+		}
+		if dist.Id == "" && s.usesCloudFront() {
+			if _, err := dist.FindByAlias(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if len(functionRedirects) > 0 && dist.Id == "" {
+		return 0, errors.New("_redirects has rules that aren't permanent single-path redirects, which need a CloudFront Function, but no CloudFront Distribution was found for " + s.DomainName)
+	}
+	if len(headerRules) > 0 && dist.Id == "" {
+		return 0, errors.New("Custom headers are configured but no CloudFront Distribution was found for " + s.DomainName)
+	}
+	if versioned && dist.Id == "" {
+		return 0, errors.New("Versioned releases need a CloudFront Distribution, but none was found for " + s.DomainName)
+	}
+
+	if err := runHooks("pre-build"); err != nil {
+		return 0, err
+	}
 
-	dist := cloudfront.NewDistribution(sess)
-	dist.SetAliasName(domainName)
-	dist.SetRegion(region)
-	dist.SetBucket(bucket)
+	s.out.Step("build", "Building Site....")
+	baseURL := ""
+	if *envName != "" {
+		baseURL = configString(config, "hugo.baseurl", "https://"+s.DomainName+"/")
+	}
+	if err := s.Builder.Build(baseURL, *envName); err != nil {
+		return 0, err
+	}
 
-	bucketExists = bucket.CreateOrRetrieve()
+	built := time.Now().UTC()
 
-	if !bucketExists {
-		fmt.Println("Requesting Cert....")
-		fmt.Println("=================================")
-		cert.Request(sess)
-		resourceRecord := cert.DescribeCertificate()
+	if err := runHooks("post-build"); err != nil {
+		return 0, err
+	}
 
-		fmt.Println("Inserting Cert DNS Verification")
-		fmt.Println("=================================")
-		route53.InsertNewRecord(sess, cert, resourceRecord)
+	if configBool(config, "links.enabled", config.Has("links")) {
+		if err := checkLinks(s, publishDir, baseURL, redirectRules); err != nil {
+			return 0, err
+		}
+	}
 
-		fmt.Println("Setting Bucket Policy....")
-		fmt.Println("=================================")
-		bucket.MakePublic()
+	previous, err := lastManifest(s)
+	if err != nil {
+		return 0, err
+	}
+	manifest, err := checkBudget(s, publishDir, previous)
+	if err != nil {
+		return 0, err
+	}
+	// Unchanged files are only checked for changed headers when the
+	// settings that give them their headers have changed.
+	manifest.Headers = s.Hugo.Deployment.HeadersHash()
+	bucket.SetCheckHeaders(previous == nil || previous.Headers != manifest.Headers)
 
-		fmt.Println("Setting up bucket for hosting....")
-		fmt.Println("=================================")
-		bucket.EnableWebHosting()
+	errorPages := loadErrorPages(config, s.Hugo, publishDir)
+	bucket.SetErrorDocument(errorPages)
 
-		fmt.Println("Creating CloudFront Distribution....")
-		fmt.Println("=================================")
-		dist.CreateDistribution()
+	// An origin path, for releases or a prefix, makes the S3 website
+	// redirect directories to URLs containing it, so the function handles
+	// directories too. It's generated before uploading, so a function that
+	// CloudFront won't accept stops the deploy before anything changes.
+	viewerFunction := ""
+	originPath := versioned || s.Prefix != ""
+	if dist.Id != "" && (len(functionRedirects) > 0 || originPath) {
+		viewerFunction, err = redirects.FunctionCode(functionRedirects, originPath, extensionless(manifest, redirectObjects))
+		if err != nil {
+			return 0, err
+		}
+	}
 
-		fmt.Println("Adding CloudFront Domain To DNS....")
-		fmt.Println("=================================")
-		route53.ChangeHostedZoneRecord(dist.DomainName, sess, domainName, hostedZoneId)
+	if err := runHooks("pre-upload"); err != nil {
+		return 0, err
 	}
 
-	fmt.Println("Building Hugo Site....")
-	fmt.Println("=================================")
-	buildHugoSite(dir)
+	// The lock is checked before each change to the bucket, so a deploy
+	// that lost it stops before undoing another deploy's work.
+	if err := s.lock.Err(); err != nil {
+		return 0, err
+	}
+	s.out.Step("upload", "Uploading to S3 - "+s.BucketName+"/"+s.Prefix+keyPrefix)
+	uploaded, err := bucket.UploadDirectory(keyPrefix, publishDir)
+	if err != nil {
+		return len(uploaded), err
+	}
+	redirectKeys, err := bucket.UploadRedirects(keyPrefix)
+	if err != nil {
+		return len(uploaded), err
+	}
+	if versionKey := configString(config, "git.versionfile", "version.json"); git != nil && versionKey != "" {
+		size, err := uploadVersionFile(s, keyPrefix+versionKey, git.version(built))
+		if err != nil {
+			return len(uploaded), err
+		}
+		manifest.Files[versionKey] = size
+		uploaded = append(uploaded, keyPrefix+versionKey)
+	}
+
+	if err := s.lock.Err(); err != nil {
+		return len(uploaded), err
+	}
+	if configBool(config, "upload.prune", false) && !versioned {
+		if err := prune(s, keyPrefix, manifest, redirectKeys); err != nil {
+			return len(uploaded), err
+		}
+	}
+
+	if len(s.Hooks) > 0 {
+		changedFiles, err = writeChangedFiles(uploaded)
+		if err != nil {
+			return len(uploaded), err
+		}
+		defer os.Remove(changedFiles)
+	}
+	if err := runHooks("post-upload"); err != nil {
+		return len(uploaded), err
+	}
+
+	if err := s.lock.Err(); err != nil {
+		return len(uploaded), err
+	}
+	s.out.Step("update-web-hosting", "Updating bucket hosting configuration....")
+	if err := bucket.EnableWebHosting(); err != nil {
+		return len(uploaded), err
+	}
+
+	if dist.Id != "" {
+		if !versioned {
+			// Serve the site's root, for sites that were moved under a
+			// prefix or stopped deploying releases.
+			if err := dist.SetOriginPath(""); err != nil {
+				return len(uploaded), err
+			}
+		}
+		if viewerFunction != "" {
+			s.out.Step("update-redirect-function", "Updating CloudFront redirect function....")
+		}
+		if err := dist.SetViewerRequestFunction("redirects", viewerFunction); err != nil {
+			return len(uploaded), err
+		}
+
+		// Error pages come first, since the cache behaviors for headers
+		// copy the default behavior's functions.
+		if err := setErrorPages(s, config, errorPages); err != nil {
+			return len(uploaded), err
+		}
+
+		if len(headerRules) > 0 {
+			s.out.Step("update-response-headers", "Updating CloudFront response headers....")
+		}
+		if err := dist.SetResponseHeaders(defaultHeaders, pathHeaders); err != nil {
+			return len(uploaded), err
+		}
+	}
 
-	fmt.Println("Uploading to S3 - ", bucketName)
-	fmt.Println("=================================")
-	bucket.UploadDirectory("", dir+"/public")
+	if err := s.lock.Err(); err != nil {
+		return len(uploaded), err
+	}
+	if versioned {
+		s.out.Step("publish-release", "Switching CloudFront to release "+release+" ....")
+		settings := &releaseSettings{ViewerFunction: viewerFunction, Headers: defaultHeaders, PathHeaders: pathHeaders}
+		if err := publishRelease(bucket, dist, release, configInt(config, "releases.retain", 5), settings); err != nil {
+			return len(uploaded), err
+		}
+	}
+
+	record := newDeployRecord(s, git, started)
+	record.Release = release
+	record.DistributionId = dist.Id
+	record.countFiles(manifest, keyPrefix, uploaded)
+
+	if dist.Id != "" && (len(uploaded) > 0 || versioned) {
+		s.out.Step("invalidate", "Invalidating CloudFront Distribution....")
+		record.InvalidationId, err = dist.Invalidate([]string{"/*"})
+		if err != nil {
+			return len(uploaded), err
+		}
+	}
+
+	record.Duration = time.Since(started).Round(time.Millisecond).String()
+	if err := record.save(bucket); err != nil {
+		return len(uploaded), err
+	}
+	if err := bucket.PutJSON(manifestKey(), manifest); err != nil {
+		return len(uploaded), err
+	}
+
+	if configBool(config, "verify.enabled", config.Has("verify")) {
+		if record.InvalidationId != "" {
+			s.out.Step("wait-for-invalidation", "Waiting for the CloudFront invalidation to finish....")
+			if err := dist.WaitForInvalidation(record.InvalidationId); err != nil {
+				return len(uploaded), err
+			}
+		}
+		if _, err := verifySite(s, keyPrefix, uploaded); err != nil {
+			return len(uploaded), err
+		}
+	}
+
+	if err := runHooks("post-deploy"); err != nil {
+		return len(uploaded), err
+	}
+	if uploaded == nil {
+		uploaded = []string{}
+	}
+	return len(uploaded), s.out.Summary(&deploySummary{record, s.BucketName, s.DomainName, uploaded})
+}
+
+// extensionless returns the keys without an extension that are served as
+// they are, rather than as directories: files and redirect objects.
+func extensionless(manifest *budget.Manifest, redirectObjects []*redirects.Rule) []string {
+	keys := []string{}
+	for key := range manifest.Files {
+		keys = append(keys, key)
+	}
+	for _, rule := range redirectObjects {
+		keys = append(keys, rule.Key())
+	}
+	files := []string{}
+	for _, key := range keys {
+		if !strings.Contains(path.Base(key), ".") {
+			files = append(files, key)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// deploySummary is the summary of a deploy written with -output json.
+type deploySummary struct {
+	*deployRecord
+	Bucket       string   `json:"bucket"`
+	Domain       string   `json:"domain,omitempty"`
+	ChangedFiles []string `json:"changedFiles"`
+}
+
+// manifestKey is where the manifest of the last deploy is kept, for the
+// next deploy to compare its budget with.
+func manifestKey() string {
+	return statePrefix() + "manifest.json"
 }
 
-func buildHugoSite(dir string) {
-	cmd := exec.Command("hugo", "-t", "hugo-universal-theme")
-	cmd.Dir = dir
-	out, err := cmd.CombinedOutput()
+// prune deletes the objects under keyPrefix that are no longer part of the
+// site. Ignored keys are kept, so objects managed outside the tool survive,
+// and so are the tool's own state, releases and previews, and other sites
+// stored under a prefix of the same bucket. Those are the sites configured
+// in deploy.toml, and any other prefix holding a site's state.
+func prune(s *site, keyPrefix string, manifest *budget.Manifest, redirectKeys []string) error {
+	s.out.Step("prune", "Removing files deleted from the site....")
+	keys, err := s.bucket.ListKeys(keyPrefix)
 	if err != nil {
-		log.Fatalf("cmd.hugo() failed with %s\n", err)
+		return err
+	}
+	keep := map[string]bool{}
+	for _, key := range redirectKeys {
+		keep[key] = true
+	}
+	otherSites := append(otherSiteRoots(keys), s.nestedSites...)
+
+	stale := []string{}
+	for _, key := range keys {
+		rel := strings.TrimPrefix(key, keyPrefix)
+		if _, built := manifest.Files[rel]; built || keep[key] || s.Ignore.Ignored(rel) {
+			continue
+		}
+		if strings.HasPrefix(key, stateKeyPrefix) || strings.HasPrefix(key, releasesPrefix) || strings.HasPrefix(key, previewsPrefix) || hasAnyPrefix(key, otherSites) {
+			continue
+		}
+		stale = append(stale, key)
+	}
+
+	if max := configInt(s.Config, "upload.maxdeletes", 256); max >= 0 && len(stale) > max {
+		output.Printf("Warning: %d files are no longer part of the site, more than upload.maxdeletes (%d), so none were deleted\n", len(stale), max)
+		return nil
+	}
+	for _, key := range stale {
+		output.Println("delete " + key)
+		s.out.File("delete", "", key)
+	}
+	_, err = s.bucket.DeleteKeys(stale)
+	return err
+}
+
+// otherSiteRoots returns the roots of sites stored under a prefix of the
+// same bucket that aren't in deploy.toml, such as ones deployed from
+// another repository. Another site's state marks its root, so a site that
+// hasn't been deployed yet isn't found.
+func otherSiteRoots(keys []string) []string {
+	roots := []string{}
+	for _, key := range keys {
+		if i := strings.Index(key, "/"+stateKeyPrefix); i >= 0 {
+			roots = append(roots, key[:i+1])
+		}
+	}
+	return roots
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastManifest reads the manifest of the last deploy, or returns nil before
+// the first one.
+func lastManifest(s *site) (*budget.Manifest, error) {
+	last := &budget.Manifest{}
+	found, err := s.bucket.GetJSON(manifestKey(), last)
+	if err != nil || !found {
+		return nil, err
+	}
+	return last, nil
+}
+
+// checkBudget lists the size of every built file, and checks them against
+// the [budget] section and previous, the last deploy's manifest.
+func checkBudget(s *site, publishDir string, previous *budget.Manifest) (*budget.Manifest, error) {
+	manifest, err := budget.Scan(publishDir, s.Symlinks, s.Ignore.Ignored)
+	if err != nil {
+		return nil, err
+	}
+	settings, ok := s.Config.Get("budget").(*toml.Tree)
+	if !ok || !configBool(s.Config, "budget.enabled", true) {
+		return manifest, nil
+	}
+	siteBudget, err := budget.FromConfig(settings.ToMap())
+	if err != nil {
+		return nil, err
+	}
+
+	s.out.Step("check-budget", "Checking the size budget....")
+	if previous != nil {
+		grown, removed := budget.Diff(manifest, previous)
+		output.Printf("%d files (%+d), %s (%s) since the last deploy\n", len(manifest.Files), len(manifest.Files)-len(previous.Files),
+			output.FormatSize(manifest.Total()), signedSize(manifest.Total()-previous.Total()))
+		for i, change := range grown {
+			if i == 5 {
+				output.Printf("  ... and %d more files grew or were added\n", len(grown)-5)
+				break
+			}
+			output.Printf("  %-50s %10s (%s)\n", change.Key, output.FormatSize(change.Size), signedSize(change.Delta))
+		}
+		if len(removed) > 0 {
+			output.Printf("  %d files removed\n", len(removed))
+		}
+	} else {
+		output.Printf("%d files, %s\n", len(manifest.Files), output.FormatSize(manifest.Total()))
+	}
+
+	problems := siteBudget.Check(manifest, previous)
+	if len(problems) == 0 {
+		return manifest, nil
+	}
+	if siteBudget.Warn {
+		for _, problem := range problems {
+			output.Println("Warning: " + problem)
+		}
+		return manifest, nil
+	}
+	return nil, errors.New("The site is over budget:\n  " + strings.Join(problems, "\n  "))
+}
+
+func signedSize(size int64) string {
+	if size >= 0 {
+		return "+" + output.FormatSize(size)
+	}
+	return output.FormatSize(size)
+}
+
+// checkLinks looks for broken links in the built site, and fails when there
+// are more than links.maxbroken of them.
+func checkLinks(s *site, publishDir string, baseURL string, rules []*redirects.Rule) error {
+	s.out.Step("check-links", "Checking links....")
+	checker := links.NewChecker(publishDir)
+	checker.SetIgnore(s.Ignore)
+
+	hosts := []string{}
+	if s.DomainName != "" {
+		hosts = append(hosts, s.DomainName, "www."+s.DomainName)
+	}
+	for _, base := range []string{baseURL, s.Hugo.BaseURL} {
+		if u, err := url.Parse(base); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	checker.SetInternalHosts(hosts)
+	if baseURL == "" {
+		baseURL = s.Hugo.BaseURL
+	}
+	if u, err := url.Parse(baseURL); err == nil {
+		checker.SetBasePath(u.Path)
+	}
+
+	objects, exact, _ := redirects.Split(rules)
+	for _, rule := range append(objects, exact...) {
+		checker.AddPaths([]string{rule.From})
+	}
+
+	if configBool(s.Config, "links.external", false) {
+		ttl, err := time.ParseDuration(configString(s.Config, "links.cachettl", "24h"))
+		if err != nil {
+			return fmt.Errorf("Invalid links.cachettl, %v", err)
+		}
+		cacheFile := ""
+		if dir, err := os.UserCacheDir(); err == nil && ttl > 0 {
+			cacheFile = filepath.Join(dir, "hugo-s3-deploy", "links.json")
+		}
+		checker.SetExternal(configInt(s.Config, "links.concurrency", 8), cacheFile, ttl)
+	}
+
+	broken, checked, err := checker.Check()
+	if err != nil {
+		return err
+	}
+	for _, link := range broken {
+		output.Println("broken " + link.Page + ": " + link.URL + " (" + link.Problem + ")")
+	}
+	output.Printf("%d links checked, %d broken\n", checked, len(broken))
+
+	if max := configInt(s.Config, "links.maxbroken", 0); len(broken) > max {
+		return fmt.Errorf("Found %d broken links, more than the %d allowed by links.maxbroken", len(broken), max)
+	}
+	return nil
+}
+
+// verifySite checks that the live site serves the build. The [verify] urls
+// and a sample of the changed keys are fetched through the CloudFront and
+// custom domains, or the hosts set in verify.hosts.
+func verifySite(s *site, keyPrefix string, changed []string) ([]*verify.Check, error) {
+	hosts := configStrings(s.Config, "verify.hosts", nil)
+	if len(hosts) == 0 {
+		if !s.usesCloudFront() || s.dist.Id == "" {
+			return nil, errors.New("verify.hosts must be set to verify a site that isn't served by CloudFront")
+		}
+		domain, err := s.dist.Domain()
+		if err != nil {
+			return nil, err
+		}
+		hosts = []string{"https://" + domain, "https://" + s.DomainName}
+	}
+
+	paths := configStrings(s.Config, "verify.urls", []string{"/"})
+	keys := []string{}
+	for _, key := range changed {
+		keys = append(keys, strings.TrimPrefix(key, keyPrefix))
+	}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		seen[path] = true
+	}
+	for _, key := range verify.Sample(keys, configInt(s.Config, "verify.sample", 5)) {
+		if path := verify.PagePath(key); !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	s.out.Step("verify", "Verifying the live site....")
+	verifier := verify.NewVerifier(s.Builder.PublishDir(), hosts)
+	verifier.SetDeployment(&s.Hugo.Deployment)
+	checks := verifier.Verify(paths)
+	return checks, verify.Report(checks)
+}
+
+// hookEnv describes the deploy to hook commands.
+func hookEnv(s *site, release string, changedFiles string) []string {
+	return []string{
+		"DEPLOY_SITE=" + s.Name,
+		"DEPLOY_ENV=" + *envName,
+		"DEPLOY_BUCKET=" + s.BucketName,
+		"DEPLOY_DOMAIN=" + s.DomainName,
+		"DEPLOY_DISTRIBUTION_ID=" + s.dist.Id,
+		"DEPLOY_RELEASE=" + release,
+		"DEPLOY_PUBLISH_DIR=" + s.Builder.PublishDir(),
+		"DEPLOY_CHANGED_FILES=" + changedFiles,
+	}
+}
+
+// writeChangedFiles writes the keys uploaded by a deploy to a temporary
+// file, one per line, for hooks to read.
+func writeChangedFiles(keys []string) (string, error) {
+	file, err := ioutil.TempFile("", "hugo-s3-deploy-changed-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	for _, key := range keys {
+		if _, err := fmt.Fprintln(file, key); err != nil {
+			return "", err
+		}
+	}
+	return file.Name(), nil
+}
+
+// applyDeploymentTarget points the site at a [[deployment.targets]] entry
+// from its Hugo site config. A target is used when one is named with -target
+// or when deploy.toml leaves aws.bucketname unset.
+func (s *site) applyDeploymentTarget() error {
+	if *targetName == "" && s.BucketName != "" {
+		return nil
+	}
+
+	target := s.Hugo.Deployment.Target(*targetName)
+	if target == nil {
+		if *targetName != "" {
+			return fmt.Errorf("No deployment target named %q in the Hugo site config", *targetName)
+		}
+		return errors.New("aws.bucketname is not set in deploy.toml and the Hugo site config has no deployment targets")
+	}
+
+	name, targetRegion, err := target.Bucket()
+	if err != nil {
+		return err
+	}
+	s.BucketName = name
+	if targetRegion != "" {
+		s.Region = targetRegion
+	}
+	s.DistributionId = target.CloudFrontDistributionID
+	return nil
+}
+
+// applyEnvironment overlays the [env.<name>] section picked with -env onto
+// the rest of deploy.toml. It is applied before [[site]] entries, so a
+// site's own settings win over the environment's.
+func applyEnvironment(config *toml.Tree) error {
+	if *envName == "" {
+		return nil
+	}
+	env, ok := config.Get("env." + *envName).(*toml.Tree)
+	if !ok {
+		return fmt.Errorf("No [env.%s] section in deploy.toml", *envName)
+	}
+	overlay(config, nil, env.ToMap())
+	return nil
+}
+
+func overlay(config *toml.Tree, path []string, values map[string]interface{}) {
+	for key, value := range values {
+		keyPath := append(append([]string{}, path...), key)
+		if table, ok := value.(map[string]interface{}); ok {
+			overlay(config, keyPath, table)
+			continue
+		}
+		config.SetPath(keyPath, value)
+	}
+}
+
+// loadErrorPages configures the error document from the [errors] section of
+// deploy.toml. Nothing is configured unless the page exists in the built site.
+// Languages published in their own subdirectory use their own page when the
+// site has one.
+func loadErrorPages(config *toml.Tree, site *hugo.SiteConfig, publicDir string) *storage.ErrorDocument {
+	document := configString(config, "errors.document", "404.html")
+	if _, err := os.Stat(publicDir + "/" + document); err != nil {
+		return nil
+	}
+
+	languageDocument := configString(config, "errors.languagedocument", "{lang}/"+document)
+	errorPages := &storage.ErrorDocument{
+		Key:   document,
+		Codes: configInts(config, "errors.codes", []int{403, 404}),
+		LanguageKey: func(lang string) string {
+			return strings.Replace(languageDocument, "{lang}", lang, -1)
+		},
+	}
+	for _, lang := range configStrings(config, "errors.languages", site.Languages) {
+		if _, err := os.Stat(publicDir + "/" + errorPages.LanguageKey(lang)); err == nil {
+			errorPages.Languages = append(errorPages.Languages, lang)
+		}
+	}
+	return errorPages
+}
+
+// setErrorPages has CloudFront serve the error pages. A single page is a
+// custom error response. Language pages need the request's path, so a
+// Lambda@Edge function answers origin errors with the right page instead.
+func setErrorPages(s *site, config *toml.Tree, errorPages *storage.ErrorDocument) error {
+	name := s.dist.ResourceName("errors")
+	if errorPages == nil {
+		return s.dist.SetOriginResponseFunction(name, "")
+	}
+	s.out.Step("update-error-pages", "Updating CloudFront error pages....")
+	responseCode := configInt(config, "errors.responsecode", 404)
+	cachingTTL := int64(configInt(config, "errors.cachingttl", 10))
+	if len(errorPages.Languages) == 0 {
+		if err := s.dist.SetOriginResponseFunction(name, ""); err != nil {
+			return err
+		}
+		return s.dist.SetErrorResponses("/"+errorPages.Key, responseCode, cachingTTL, errorPages.Codes)
+	}
+
+	code, err := lambda.ErrorPagesCode(errorPages, responseCode, cachingTTL)
+	if err != nil {
+		return err
+	}
+	function := lambda.NewEdgeFunction(s.session)
+	function.SetName(name)
+	arn, err := function.Publish(code)
+	if err != nil {
+		return err
+	}
+	if err := s.dist.SetOriginResponseFunction(name, arn); err != nil {
+		return err
+	}
+	// A custom error response would replace the page the function chose.
+	return s.dist.RemoveErrorResponses(errorPages.Codes)
+}
+
+// loadHeaders reads custom response headers from a _headers file and from
+// the [headers] section of deploy.toml.
+func loadHeaders(dir string, publishDir string, config *toml.Tree) ([]*headers.Rule, error) {
+	rules, err := headers.Load(dir+"/static/_headers", publishDir+"/_headers")
+	if err != nil {
+		return nil, err
+	}
+	if tree, ok := config.Get("headers").(*toml.Tree); ok {
+		configRules, err := headers.FromConfig(tree.ToMap())
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, configRules...)
+	}
+	return rules, nil
+}
+
+func configString(config *toml.Tree, key string, def string) string {
+	if value, ok := config.Get(key).(string); ok {
+		return value
+	}
+	return def
+}
+
+func configBool(config *toml.Tree, key string, def bool) bool {
+	if value, ok := config.Get(key).(bool); ok {
+		return value
+	}
+	return def
+}
+
+func configInt(config *toml.Tree, key string, def int) int {
+	if value, ok := config.Get(key).(int64); ok {
+		return int(value)
+	}
+	return def
+}
+
+// configInts reads an array of integers. Arrays copied into a [[site]]
+// entry's config are typed, others hold interface values.
+func configInts(config *toml.Tree, key string, def []int) []int {
+	if values, ok := config.Get(key).([]int64); ok {
+		ints := []int{}
+		for _, i := range values {
+			ints = append(ints, int(i))
+		}
+		return ints
+	}
+	values, ok := config.Get(key).([]interface{})
+	if !ok {
+		return def
+	}
+	ints := []int{}
+	for _, value := range values {
+		if i, ok := value.(int64); ok {
+			ints = append(ints, int(i))
+		}
+	}
+	return ints
+}
+
+func configStrings(config *toml.Tree, key string, def []string) []string {
+	if values, ok := config.Get(key).([]string); ok {
+		return values
+	}
+	values, ok := config.Get(key).([]interface{})
+	if !ok {
+		return def
+	}
+	strs := []string{}
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			strs = append(strs, s)
+		}
 	}
-	fmt.Printf("combined out:\n%s\n", string(out))
+	return strs
 }
 
 func loadConfigToml(dir string) *toml.Tree {
@@ -0,0 +1,202 @@
+// Package output reports what a command is doing, either as text for people
+// or as JSON lines that CI can parse.
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// events is where JSON lines are written. It is nil in text mode.
+var events io.Writer
+
+// text is where messages for people are written.
+var text io.Writer = os.Stdout
+var mu sync.Mutex
+
+// SetFormat picks text or json output. In json mode only events are written
+// to stdout; messages, including the output of Hugo and hooks, go to
+// stderr.
+func SetFormat(format string) error {
+	switch format {
+	case "text":
+		SetWriters(nil, os.Stdout)
+	case "json":
+		SetWriters(os.Stdout, os.Stderr)
+	default:
+		return fmt.Errorf("Unknown output format %q, expected text or json", format)
+	}
+	return nil
+}
+
+// SetWriters sets where events and messages are written. Events aren't
+// written when eventWriter is nil.
+func SetWriters(eventWriter io.Writer, textWriter io.Writer) {
+	events = eventWriter
+	text = textWriter
+}
+
+// Text is where messages for people are written, for commands whose output
+// is passed through.
+func Text() io.Writer {
+	return text
+}
+
+// Println prints a message for people.
+func Println(args ...interface{}) {
+	fmt.Fprintln(text, args...)
+}
+
+// Printf prints a formatted message for people.
+func Printf(format string, args ...interface{}) {
+	fmt.Fprintf(text, format, args...)
+}
+
+var verbose bool
+
+// SetVerbose turns on the messages printed with Verbosef.
+func SetVerbose(on bool) {
+	verbose = on
+}
+
+// Verbosef prints details, such as retried requests, that are only wanted
+// when debugging.
+func Verbosef(format string, args ...interface{}) {
+	if verbose {
+		Printf(format, args...)
+	}
+}
+
+// JSON reports whether events are being written.
+func JSON() bool {
+	return events != nil
+}
+
+// Event is one JSON line.
+type Event struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Site     string    `json:"site,omitempty"`
+	Step     string    `json:"step,omitempty"`
+	Status   string    `json:"status,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	Action   string    `json:"action,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Key      string    `json:"key,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Printer reports the steps of a command run for one site. A nil Printer
+// reports nothing.
+type Printer struct {
+	Site    string
+	step    string
+	started time.Time
+}
+
+func NewPrinter(site string) *Printer {
+	return &Printer{Site: site}
+}
+
+// Step starts a step, finishing the one before it.
+func (out *Printer) Step(name string, title string) {
+	Println(title)
+	Println("=================================")
+	if out == nil {
+		return
+	}
+	out.Done()
+	out.step = name
+	out.started = time.Now()
+	out.emit(&Event{Event: "step", Step: name, Status: "started"})
+}
+
+// Done finishes the current step.
+func (out *Printer) Done() {
+	if out == nil || out.step == "" {
+		return
+	}
+	out.emit(&Event{Event: "step", Step: out.step, Status: "finished", Duration: out.elapsed()})
+	out.step = ""
+}
+
+// Fail reports that the command failed during the current step.
+func (out *Printer) Fail(err error) {
+	if out == nil {
+		return
+	}
+	event := &Event{Event: "step", Step: out.step, Status: "failed", Error: err.Error()}
+	if out.step == "" {
+		event = &Event{Event: "failed", Error: err.Error()}
+	} else {
+		event.Duration = out.elapsed()
+	}
+	out.emit(event)
+	out.step = ""
+}
+
+// File reports what happened to one file: upload, skip, copy or redirect.
+func (out *Printer) File(action string, path string, key string) {
+	if out == nil {
+		return
+	}
+	out.emit(&Event{Event: "file", Action: action, Path: path, Key: key})
+}
+
+// Skip reports a file that was left out before uploading began, with the
+// reason why.
+func (out *Printer) Skip(path string, key string, reason string) {
+	Println("skip " + path + " (" + reason + ")")
+	out.File("skip", path, key)
+}
+
+// Summary finishes the command with a summary object. The fields of summary
+// are written alongside the event and site.
+func (out *Printer) Summary(summary interface{}) error {
+	if out == nil || events == nil {
+		return nil
+	}
+	out.Done()
+	dat, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(dat, &fields); err != nil {
+		return err
+	}
+	fields["event"] = "summary"
+	fields["time"] = time.Now().UTC()
+	if out.Site != "" {
+		fields["site"] = out.Site
+	}
+	return write(fields)
+}
+
+func (out *Printer) elapsed() string {
+	return time.Since(out.started).Round(time.Millisecond).String()
+}
+
+func (out *Printer) emit(event *Event) {
+	if events == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	event.Site = out.Site
+	write(event)
+}
+
+func write(v interface{}) error {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	_, err = events.Write(append(dat, '\n'))
+	return err
+}
@@ -0,0 +1,60 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestJSONWriters(t *testing.T) {
+	var events, text bytes.Buffer
+	SetWriters(&events, &text)
+	defer SetWriters(nil, os.Stdout)
+
+	out := NewPrinter("docs")
+	out.Step("upload", "Uploading....")
+	Println("upload index.html")
+	out.File("upload", "public/index.html", "index.html")
+	if err := out.Summary(map[string]int{"files": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "Uploading....\n=================================\nupload index.html\n"; text.String() != want {
+		t.Errorf("text = %q, want %q", text.String(), want)
+	}
+	kinds := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(events.String()), "\n") {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("event %q isn't JSON, %v", line, err)
+		}
+		if event["site"] != "docs" {
+			t.Errorf("event %q has no site", line)
+		}
+		kinds = append(kinds, event["event"].(string))
+	}
+	if got := strings.Join(kinds, " "); got != "step file step summary" {
+		t.Errorf("events = %s, want step file step summary", got)
+	}
+}
+
+func TestTextWriters(t *testing.T) {
+	var text bytes.Buffer
+	SetWriters(nil, &text)
+	defer SetWriters(nil, os.Stdout)
+
+	out := NewPrinter("docs")
+	out.Step("upload", "Uploading....")
+	out.Skip("public/a", "a", "broken symbolic link")
+	if err := out.Summary(map[string]int{"files": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if JSON() {
+		t.Error("JSON() is true without an event writer")
+	}
+	if want := "Uploading....\n=================================\nskip public/a (broken symbolic link)\n"; text.String() != want {
+		t.Errorf("text = %q, want %q", text.String(), want)
+	}
+}
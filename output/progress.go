@@ -0,0 +1,244 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var concurrentSites bool
+
+// SetConcurrentSites reports that several sites run at once. Their progress
+// lines are then labelled with the site, and never redrawn in place since
+// they would overwrite each other.
+func SetConcurrentSites(on bool) {
+	concurrentSites = on
+}
+
+// Progress reports how far through an upload a site is. On a terminal one
+// status line is redrawn in place, and each file is only listed with
+// -verbose. Elsewhere every file is listed and a plain status line is
+// printed every interval.
+type Progress struct {
+	site        string
+	files       int
+	bytes       int64
+	doneFiles   int
+	doneBytes   int64
+	failed      int
+	lastFailure string
+	started     time.Time
+	live        bool
+	drawn       bool
+	mu          sync.Mutex
+	stop        chan struct{}
+	stopped     chan struct{}
+}
+
+// StartProgress starts reporting the progress of uploading files that add
+// up to bytes. Stop must be called when the upload is over.
+func (out *Printer) StartProgress(files int, bytes int64) *Progress {
+	progress := &Progress{
+		files:   files,
+		bytes:   bytes,
+		started: time.Now(),
+		live:    !concurrentSites && isTerminal(text),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if out != nil {
+		progress.site = out.Site
+	}
+	interval := 10 * time.Second
+	if progress.live {
+		interval = 200 * time.Millisecond
+	}
+	go progress.tick(interval)
+	return progress
+}
+
+func (progress *Progress) tick(interval time.Duration) {
+	defer close(progress.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-progress.stop:
+			return
+		case <-ticker.C:
+			progress.mu.Lock()
+			progress.print()
+			progress.mu.Unlock()
+		}
+	}
+}
+
+// Log prints a line about one file, such as "upload x to S3". On a
+// terminal it is only printed with -verbose. A nil Progress always prints
+// it.
+func (progress *Progress) Log(line string) {
+	if progress == nil {
+		Println(line)
+		return
+	}
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	if progress.live && !verbose {
+		return
+	}
+	progress.clear()
+	Println(line)
+	progress.redraw()
+}
+
+// Add counts a file that was uploaded.
+func (progress *Progress) Add(size int64) {
+	if progress == nil {
+		return
+	}
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	progress.doneFiles++
+	progress.doneBytes += size
+}
+
+// Skip counts a file that didn't need uploading. Its bytes are taken off
+// the total rather than counted as done, so they don't inflate the rate.
+func (progress *Progress) Skip(size int64) {
+	if progress == nil {
+		return
+	}
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	progress.doneFiles++
+	progress.bytes -= size
+}
+
+// Fail counts a file that couldn't be uploaded, taking its bytes off the
+// total like a skipped file. Failures are always printed.
+func (progress *Progress) Fail(path string, size int64, err error) {
+	if progress == nil {
+		Println("FAIL  " + path + " - " + err.Error())
+		return
+	}
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	progress.doneFiles++
+	progress.bytes -= size
+	progress.failed++
+	progress.lastFailure = path + ": " + err.Error()
+	progress.clear()
+	Println("FAIL  " + path + " - " + err.Error())
+	progress.redraw()
+}
+
+// Stop ends the report with a final status line.
+func (progress *Progress) Stop() {
+	if progress == nil {
+		return
+	}
+	close(progress.stop)
+	<-progress.stopped
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	progress.clear()
+	elapsed := time.Since(progress.started)
+	line := fmt.Sprintf("Finished %d files, %s in %s (%s/s)", progress.doneFiles, FormatSize(progress.doneBytes),
+		elapsed.Round(time.Millisecond), FormatSize(progress.rate(elapsed)))
+	if progress.failed > 0 {
+		line += fmt.Sprintf(", %d failed", progress.failed)
+	}
+	Println(progress.prefix() + line)
+}
+
+// print writes the status line: in place on a terminal, or as a new line.
+func (progress *Progress) print() {
+	if progress.live {
+		progress.clear()
+		progress.redraw()
+		return
+	}
+	Println(progress.prefix() + progress.status())
+}
+
+// redraw draws the status line on a terminal, leaving the cursor on it.
+func (progress *Progress) redraw() {
+	if !progress.live {
+		return
+	}
+	fmt.Fprint(text, progress.prefix()+progress.status())
+	progress.drawn = true
+}
+
+// clear erases the status line so other output can take its place.
+func (progress *Progress) clear() {
+	if progress.drawn {
+		fmt.Fprint(text, "\r\033[K")
+		progress.drawn = false
+	}
+}
+
+func (progress *Progress) prefix() string {
+	if !concurrentSites || progress.site == "" {
+		return ""
+	}
+	return progress.site + ": "
+}
+
+func (progress *Progress) status() string {
+	elapsed := time.Since(progress.started)
+	rate := progress.rate(elapsed)
+	parts := []string{
+		fmt.Sprintf("%d/%d files", progress.doneFiles, progress.files),
+		FormatSize(progress.doneBytes) + "/" + FormatSize(progress.bytes),
+		FormatSize(rate) + "/s",
+	}
+	if remaining := progress.bytes - progress.doneBytes; rate > 0 && remaining > 0 {
+		parts = append(parts, "ETA "+(time.Duration(remaining/rate)*time.Second).String())
+	}
+	if progress.failed > 0 {
+		failure := progress.lastFailure
+		if progress.live && len(failure) > 60 {
+			failure = failure[:57] + "..."
+		}
+		parts = append(parts, fmt.Sprintf("%d failed (last %s)", progress.failed, failure))
+	}
+	return strings.Join(parts, "  ")
+}
+
+// rate is the bytes done per second.
+func (progress *Progress) rate(elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(progress.doneBytes) / elapsed.Seconds())
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// FormatSize writes a size in the largest unit that keeps it above 1.
+func FormatSize(size int64) string {
+	sign := ""
+	if size < 0 {
+		sign, size = "-", -size
+	}
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%s%.1f GB", sign, float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%s%.1f MB", sign, float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%s%.1f KB", sign, float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%s%d B", sign, size)
+}
@@ -0,0 +1,51 @@
+package output
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProgressCounts(t *testing.T) {
+	var text bytes.Buffer
+	SetWriters(nil, &text)
+	defer SetWriters(nil, os.Stdout)
+
+	progress := NewPrinter("").StartProgress(4, 4000)
+	progress.Add(1000)
+	progress.Skip(1000)
+	progress.Skip(1000)
+	progress.Fail("a.html", 1000, errors.New("denied"))
+
+	progress.mu.Lock()
+	files, done, total := progress.doneFiles, progress.doneBytes, progress.bytes
+	progress.mu.Unlock()
+	if files != 4 || done != 1000 || total != 1000 {
+		t.Errorf("counted %d files, %d of %d bytes, want 4 files, 1000 of 1000 bytes", files, done, total)
+	}
+
+	progress.Stop()
+	if !strings.Contains(text.String(), "Finished 4 files, 1000 B in ") || !strings.Contains(text.String(), ", 1 failed") {
+		t.Errorf("output = %q", text.String())
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[int64]string{
+		0:             "0 B",
+		1023:          "1023 B",
+		1024:          "1.0 KB",
+		1536:          "1.5 KB",
+		5 << 20:       "5.0 MB",
+		3 << 30:       "3.0 GB",
+		-2048:         "-2.0 KB",
+		(1 << 20) - 1: "1024.0 KB",
+	}
+	for size, want := range tests {
+		if got := FormatSize(size); got != want {
+			t.Errorf("FormatSize(%d) = %q, want %q", size, got, want)
+		}
+	}
+}
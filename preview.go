@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	"github.com/mitchdennett/hugo-s3-deploy/service/acm"
+	"github.com/mitchdennett/hugo-s3-deploy/service/cloudfront"
+	"github.com/mitchdennett/hugo-s3-deploy/service/route53"
+)
+
+// Previews are uploaded to the site's bucket under this prefix, one
+// directory per branch.
+const previewsPrefix = "previews/"
+
+// previewFunction rewrites <branch>.<preview domain> requests to the branch's
+// directory. It also adds index.html itself, because the S3 website endpoint
+// would otherwise redirect to a URL containing the previews/ prefix.
+const previewFunction = `function handler(event) {
+  var request = event.request;
+  var branch = request.headers.host.value.split('.')[0];
+  var uri = request.uri;
+  if (uri.endsWith('/')) {
+    uri += 'index.html';
+  } else if (uri.split('/').pop().indexOf('.') === -1) {
+    uri += '/index.html';
+  }
+  request.uri = '/previews/' + branch + uri;
+  return request;
+}
+`
+
+var nonSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+// branchSlug turns a branch name into a DNS label.
+func branchSlug(branch string) string {
+	slug := strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(branch), "-"), "-")
+	if len(slug) > 63 {
+		slug = strings.TrimRight(slug[:63], "-")
+	}
+	return slug
+}
+
+func previewDomain(s *site) string {
+	return configString(s.Config, "preview.domain", "preview."+s.DomainName)
+}
+
+// preview builds the checked out branch with a branch-specific baseURL and
+// serves it at <branch>.<preview domain>.
+func preview(s *site) (int, error) {
+	if !s.usesCloudFront() {
+		return 0, errors.New("Previews are served by CloudFront, so they need S3 storage")
+	}
+	branch := *branchName
+	if branch == "" {
+		out, err := gitOutput(s.Dir, "rev-parse", "--abbrev-ref", "HEAD")
+		if err != nil {
+			return 0, fmt.Errorf("Could not find the current git branch, pass -branch %v", err)
+		}
+		branch = out
+	}
+	slug := branchSlug(branch)
+	if slug == "" {
+		return 0, fmt.Errorf("Branch %q can't be used as a preview host name", branch)
+	}
+
+	exists, err := s.bucket.Exists()
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, errors.New("Bucket " + s.BucketName + " doesn't exist yet. Deploy the site once before creating previews")
+	}
+
+	domain := previewDomain(s)
+	dist := cloudfront.NewDistribution(s.session)
+	dist.SetAliasName("*." + domain)
+	dist.SetAliases([]string{"*." + domain})
+	dist.SetRegion(s.Region)
+	dist.SetRoot(s.Prefix)
+	dist.SetBucket(s.dist.Bucket)
+
+	found, err := dist.FindByAlias()
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		if err := createPreviewDistribution(s, dist, domain); err != nil {
+			return 0, err
+		}
+	} else if err := dist.SetOriginPath(""); err != nil {
+		return 0, err
+	}
+
+	host := slug + "." + domain
+	s.out.Step("build", "Building Site for "+host+" ....")
+	if err := s.Builder.Build("https://"+host+"/", *envName); err != nil {
+		return 0, err
+	}
+
+	keyPrefix := previewsPrefix + slug + "/"
+	s.out.Step("upload", "Uploading to S3 - "+s.BucketName+"/"+s.Prefix+keyPrefix)
+	uploaded, err := s.bucket.UploadDirectory(keyPrefix, s.Builder.PublishDir())
+	if err != nil {
+		return len(uploaded), err
+	}
+
+	if err := dist.SetViewerRequestFunction("preview", previewFunction); err != nil {
+		return len(uploaded), err
+	}
+	invalidationId := ""
+	if len(uploaded) > 0 {
+		if invalidationId, err = dist.Invalidate([]string{"/" + keyPrefix + "*"}); err != nil {
+			return len(uploaded), err
+		}
+	}
+
+	output.Println("Preview is live at https://" + host + "/")
+	if uploaded == nil {
+		uploaded = []string{}
+	}
+	return len(uploaded), s.out.Summary(map[string]interface{}{
+		"branch":         branch,
+		"url":            "https://" + host + "/",
+		"distributionId": dist.Id,
+		"invalidationId": invalidationId,
+		"filesUploaded":  len(uploaded),
+		"changedFiles":   uploaded,
+	})
+}
+
+// createPreviewDistribution sets up the distribution serving every preview
+// host, with its own *.<preview domain> certificate since a wildcard only
+// covers a single label and *.<domain> doesn't match <branch>.preview.<domain>.
+func createPreviewDistribution(s *site, dist *cloudfront.Distribution, domain string) error {
+	cert := acm.NewCert(s.session)
+	cert.SetDomainName(domain)
+	cert.SetHostedZoneId(s.HostedZoneId)
+
+	s.out.Step("request-certificate", "Requesting Preview Cert....")
+	if err := cert.Request(s.session); err != nil {
+		return err
+	}
+	resourceRecord, err := cert.DescribeCertificate()
+	if err != nil {
+		return err
+	}
+
+	s.out.Step("insert-certificate-dns", "Inserting Cert DNS Verification")
+	if err := route53.InsertNewRecord(s.session, cert, resourceRecord); err != nil {
+		return err
+	}
+
+	s.out.Step("validate-certificate", "Waiting for the certificate to be validated, this can take a while....")
+	if err := cert.WaitUntilValidated(); err != nil {
+		return err
+	}
+	dist.SetCertificateArn(*cert.Id)
+
+	s.out.Step("create-distribution", "Creating Preview CloudFront Distribution....")
+	if err := dist.CreateDistribution(); err != nil {
+		return err
+	}
+
+	s.out.Step("add-distribution-dns", "Adding Preview Domain To DNS....")
+	return route53.UpsertCNAME(s.session, "*."+domain, dist.DomainName, s.HostedZoneId)
+}
+
+// cleanupPreviews removes the previews of branches that no longer exist
+// locally or on any remote.
+func cleanupPreviews(s *site) error {
+	out, err := gitOutput(s.Dir, "for-each-ref", "--format=%(refname)", "refs/heads", "refs/remotes")
+	if err != nil {
+		return fmt.Errorf("Could not list git branches %v", err)
+	}
+
+	branches := map[string]bool{}
+	for _, ref := range strings.Split(out, "\n") {
+		ref = strings.TrimPrefix(ref, "refs/heads/")
+		if strings.HasPrefix(ref, "refs/remotes/") {
+			// Drop the remote name, so origin/feature matches feature.
+			parts := strings.SplitN(strings.TrimPrefix(ref, "refs/remotes/"), "/", 2)
+			if len(parts) < 2 {
+				continue
+			}
+			ref = parts[1]
+		}
+		branches[branchSlug(ref)] = true
+	}
+
+	slugs, err := s.bucket.ListPrefixes(previewsPrefix)
+	if err != nil {
+		return err
+	}
+	removed := []string{}
+	for _, slug := range slugs {
+		if branches[slug] {
+			continue
+		}
+		deleted, err := s.bucket.DeletePrefix(previewsPrefix + slug + "/")
+		if err != nil {
+			return err
+		}
+		output.Println("Removed preview", slug, "-", deleted, "objects")
+		removed = append(removed, slug)
+	}
+	return s.out.Summary(map[string]interface{}{"removed": removed})
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/mitchdennett/hugo-s3-deploy/budget"
+	"github.com/mitchdennett/hugo-s3-deploy/service/local"
+	"github.com/pelletier/go-toml"
+)
+
+func TestPruneKeepsOtherSites(t *testing.T) {
+	bucketDir := t.TempDir()
+	config, err := toml.Load(`
+[build]
+type = "none"
+[storage]
+type = "local"
+path = "` + filepath.ToSlash(bucketDir) + `"
+[upload]
+prune = true
+exclude = ["downloads/"]
+
+[[site]]
+name = "www"
+
+[[site]]
+name = "blog"
+prefix = true
+
+[[site]]
+name = "docs"
+prefix = "sites/documentation"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sites, err := loadSites(t.TempDir(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	www := sites[0]
+	if want := []string{"sites/blog/", "sites/documentation/"}; !reflect.DeepEqual(www.nestedSites, want) {
+		t.Fatalf("nestedSites = %v, want %v", www.nestedSites, want)
+	}
+	if len(sites[1].nestedSites) != 0 {
+		t.Fatalf("blog has nested sites %v", sites[1].nestedSites)
+	}
+
+	// Neither docs nor blog has been deployed, so they have no state to
+	// mark them.
+	for _, key := range []string{"index.html", "old.html", "downloads/app.zip", "sites/blog/index.html", "sites/documentation/index.html", "sites/other/old.html"} {
+		path := filepath.Join(bucketDir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	www.bucket = local.NewDirectory(bucketDir)
+	manifest := &budget.Manifest{Files: map[string]int64{"index.html": 0}}
+	if err := prune(www, "", manifest, nil); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := www.bucket.ListKeys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	want := []string{"downloads/app.zip", "index.html", "sites/blog/index.html", "sites/documentation/index.html"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("kept %v, want %v", keys, want)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	s3Service "github.com/mitchdennett/hugo-s3-deploy/service/s3"
+)
+
+// pullManifestName is the sidecar pull writes into the directory. It holds
+// what a file can't: each object's headers and redirect, and the bucket's
+// routing rules, so the copy can be uploaded again as it was.
+const pullManifestName = ".hugo-s3-deploy-pull.json"
+
+type pullManifest struct {
+	Site    string    `json:"site"`
+	Bucket  string    `json:"bucket"`
+	Prefix  string    `json:"prefix,omitempty"`
+	Release string    `json:"release,omitempty"`
+	Pulled  time.Time `json:"pulled"`
+	// Objects are keyed relative to Prefix, which is also their path in
+	// the directory.
+	Objects      []*s3Service.Object `json:"objects"`
+	RoutingRules []*s3.RoutingRule   `json:"routingRules,omitempty"`
+}
+
+// pull copies the live site, or a single release, into a directory. With
+// [releases] the live site is the release CloudFront serves. Files that
+// already match their object's ETag aren't downloaded again.
+// Files in the directory that aren't in the bucket are left alone.
+func pull(s *site, args []string) error {
+	bucket, ok := s.bucket.(*s3Service.S3Bucket)
+	if !ok {
+		return errors.New("Pulling reads object metadata from S3, so it needs S3 storage")
+	}
+	if len(args) == 0 {
+		return errors.New("pull needs a directory: hugo-s3-deploy pull <dir> [release]")
+	}
+	dir := args[0]
+	if *allSites {
+		dir = filepath.Join(dir, s.Name)
+	}
+	keyPrefix, release := "", ""
+	if len(args) > 1 {
+		release = args[1]
+	} else if configBool(s.Config, "releases.enabled", false) && s.usesCloudFront() {
+		// The live site is the release CloudFront serves.
+		if s.dist.Id == "" {
+			if _, err := s.dist.FindByAlias(); err != nil {
+				return err
+			}
+		}
+		var err error
+		if release, err = currentRelease(s.dist); err != nil {
+			return err
+		}
+	}
+	if release != "" {
+		keyPrefix = releaseKeyPrefix(release)
+	}
+
+	s.out.Step("pull", "Pulling "+s.BucketName+"/"+s.Prefix+keyPrefix+" to "+dir+"....")
+	objects, err := bucket.ListObjects(keyPrefix)
+	if err != nil {
+		return err
+	}
+	if release != "" && len(objects) == 0 {
+		return fmt.Errorf("No release %q was found in the bucket", release)
+	}
+	keys := []string{}
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	otherSites := append(otherSiteRoots(keys), s.nestedSites...)
+
+	previous := map[string]*s3Service.Object{}
+	var last pullManifest
+	if body, err := ioutil.ReadFile(filepath.Join(dir, pullManifestName)); err == nil {
+		if err := json.Unmarshal(body, &last); err != nil {
+			return fmt.Errorf("Unable to read %s, %v", filepath.Join(dir, pullManifestName), err)
+		}
+		if last.Bucket == s.BucketName && last.Prefix == s.Prefix+keyPrefix {
+			for _, object := range last.Objects {
+				previous[object.Key] = object
+			}
+		}
+	}
+
+	pulling := []*s3Service.Object{}
+	total := int64(0)
+	for _, object := range objects {
+		key := strings.TrimPrefix(object.Key, keyPrefix)
+		// Folder markers made by the S3 console hold nothing.
+		if key == "" || strings.HasSuffix(key, "/") || hasAnyPrefix(object.Key, otherSites) {
+			continue
+		}
+		// The tool's state, releases and previews aren't part of the live
+		// site, and uploading a copy of the state would overwrite the
+		// deploy lock and history.
+		if release == "" && (strings.HasPrefix(key, stateKeyPrefix) || strings.HasPrefix(key, releasesPrefix) || strings.HasPrefix(key, previewsPrefix)) {
+			continue
+		}
+		if clean := path.Clean(key); clean != key || clean == ".." || strings.HasPrefix(clean, "../") || path.IsAbs(key) {
+			output.Println("skip " + object.Key + " (not a safe file path)")
+			continue
+		}
+		pulling = append(pulling, object)
+		total += object.Size
+	}
+
+	progress := s.out.StartProgress(len(pulling), total)
+	pulled := []*s3Service.Object{}
+	downloaded, failed := 0, 0
+	var firstErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan *s3Service.Object)
+	for i := 0; i < s.Concurrency && i < len(pulling); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for object := range jobs {
+				key := strings.TrimPrefix(object.Key, keyPrefix)
+				file := filepath.Join(dir, filepath.FromSlash(key))
+				skipped, err := pullObject(bucket, object, file, previous[key])
+				mu.Lock()
+				if err != nil {
+					progress.Fail(file, object.Size, err)
+					if failed++; firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					if skipped {
+						progress.Log("skip " + file + " (unchanged)")
+						s.out.File("skip", file, object.Key)
+						progress.Skip(object.Size)
+					} else {
+						progress.Log("download " + object.Key + " to " + file)
+						s.out.File("download", file, object.Key)
+						progress.Add(object.Size)
+						downloaded++
+					}
+					pulled = append(pulled, object)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, object := range pulling {
+		jobs <- object
+	}
+	close(jobs)
+	wg.Wait()
+	progress.Stop()
+
+	// The manifest is written even when some files failed, so the next pull
+	// only has to fetch those.
+	for _, object := range pulled {
+		object.Key = strings.TrimPrefix(object.Key, keyPrefix)
+	}
+	sort.Slice(pulled, func(i, j int) bool { return pulled[i].Key < pulled[j].Key })
+	manifest := &pullManifest{
+		Site:    s.Name,
+		Bucket:  s.BucketName,
+		Prefix:  s.Prefix + keyPrefix,
+		Release: release,
+		Pulled:  time.Now().UTC(),
+		Objects: pulled,
+	}
+	if release == "" {
+		if manifest.RoutingRules, err = bucket.WebsiteRoutingRules(); err != nil {
+			return err
+		}
+	}
+	if err := writePullManifest(dir, manifest); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed to download, %v", failed, len(pulling), firstErr)
+	}
+	return s.out.Summary(map[string]interface{}{
+		"directory":  dir,
+		"files":      len(pulled),
+		"downloaded": downloaded,
+		"skipped":    len(pulled) - downloaded,
+	})
+}
+
+// push uploads a directory made by pull back to the bucket, with the headers
+// and redirects recorded in its manifest, and restores the routing rules
+// pulled with the live site. Objects that haven't been written since the
+// pull and still match their file are skipped. Files that aren't in the
+// manifest aren't uploaded.
+func push(s *site, args []string) (int, error) {
+	bucket, ok := s.bucket.(*s3Service.S3Bucket)
+	if !ok {
+		return 0, errors.New("Pushing restores object metadata to S3, so it needs S3 storage")
+	}
+	if len(args) == 0 {
+		return 0, errors.New("push needs a directory made by pull: hugo-s3-deploy push <dir>")
+	}
+	dir := args[0]
+	if *allSites {
+		dir = filepath.Join(dir, s.Name)
+	}
+	var manifest pullManifest
+	body, err := ioutil.ReadFile(filepath.Join(dir, pullManifestName))
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("%s has no %s, so it wasn't made by pull", dir, pullManifestName)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return 0, fmt.Errorf("Unable to read %s, %v", filepath.Join(dir, pullManifestName), err)
+	}
+	keyPrefix := ""
+	if manifest.Release != "" {
+		keyPrefix = releaseKeyPrefix(manifest.Release)
+	}
+
+	s.out.Step("push", "Pushing "+dir+" to "+s.BucketName+"/"+s.Prefix+keyPrefix+"....")
+	live, err := bucket.ListObjects(keyPrefix)
+	if err != nil {
+		return 0, err
+	}
+	current := map[string]*s3Service.Object{}
+	for _, object := range live {
+		current[strings.TrimPrefix(object.Key, keyPrefix)] = object
+	}
+
+	total := int64(0)
+	for _, object := range manifest.Objects {
+		total += object.Size
+	}
+	progress := s.out.StartProgress(len(manifest.Objects), total)
+	uploaded := []string{}
+	failed := 0
+	var firstErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan *s3Service.Object)
+	for i := 0; i < s.Concurrency && i < len(manifest.Objects); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for object := range jobs {
+				file := filepath.Join(dir, filepath.FromSlash(object.Key))
+				stored := *object
+				stored.Key = keyPrefix + object.Key
+				var err error
+				skipped := false
+				if same := current[object.Key]; same != nil && same.ETag == object.ETag && same.LastModified.Equal(object.LastModified) && unchangedFile(file, object, object) {
+					skipped = true
+				} else {
+					err = bucket.UploadObject(&stored, file)
+				}
+				mu.Lock()
+				if err != nil {
+					progress.Fail(file, object.Size, err)
+					if failed++; firstErr == nil {
+						firstErr = err
+					}
+				} else if skipped {
+					progress.Log("skip " + file + " (unchanged)")
+					s.out.File("skip", file, stored.Key)
+					progress.Skip(object.Size)
+				} else {
+					progress.Log("upload " + file + " to S3")
+					s.out.File("upload", file, stored.Key)
+					progress.Add(object.Size)
+					uploaded = append(uploaded, stored.Key)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, object := range manifest.Objects {
+		jobs <- object
+	}
+	close(jobs)
+	wg.Wait()
+	progress.Stop()
+	if failed > 0 {
+		return len(uploaded), fmt.Errorf("%d of %d files failed to upload, %v", failed, len(manifest.Objects), firstErr)
+	}
+
+	if err := s.lock.Err(); err != nil {
+		return len(uploaded), err
+	}
+	if manifest.Release == "" && manifest.RoutingRules != nil {
+		if err := bucket.RestoreRoutingRules(manifest.RoutingRules, manifest.Prefix); err != nil {
+			return len(uploaded), err
+		}
+	}
+	if s.usesCloudFront() && len(uploaded) > 0 {
+		if s.dist.Id == "" {
+			if _, err := s.dist.FindByAlias(); err != nil {
+				return len(uploaded), err
+			}
+		}
+		if s.dist.Id != "" {
+			s.out.Step("invalidate", "Invalidating CloudFront Distribution....")
+			if _, err := s.dist.Invalidate([]string{"/*"}); err != nil {
+				return len(uploaded), err
+			}
+		}
+	}
+	return len(uploaded), s.out.Summary(map[string]interface{}{
+		"directory": dir,
+		"files":     len(manifest.Objects),
+		"uploaded":  len(uploaded),
+		"skipped":   len(manifest.Objects) - len(uploaded),
+	})
+}
+
+// pullObject downloads object to file unless file already holds it, and
+// reports whether it was skipped. A skipped file's metadata is taken from
+// the last pull when the object hasn't been written since, and read from
+// the bucket otherwise.
+func pullObject(bucket *s3Service.S3Bucket, object *s3Service.Object, file string, previous *s3Service.Object) (bool, error) {
+	if !unchangedFile(file, object, previous) {
+		return false, bucket.DownloadObject(object, file)
+	}
+	if previous != nil && previous.ETag == object.ETag && previous.LastModified.Equal(object.LastModified) {
+		object.ContentType = previous.ContentType
+		object.CacheControl = previous.CacheControl
+		object.ContentEncoding = previous.ContentEncoding
+		object.Redirect = previous.Redirect
+		object.Metadata = previous.Metadata
+		return true, nil
+	}
+	return true, bucket.ReadMetadata(object)
+}
+
+// unchangedFile reports whether file already holds object. Files uploaded
+// in one request have the MD5 of their content as ETag. Multipart ETags
+// can't be recomputed, so those files are trusted when the last pull saw
+// the same ETag.
+func unchangedFile(file string, object *s3Service.Object, previous *s3Service.Object) bool {
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != object.Size {
+		return false
+	}
+	if strings.Contains(object.ETag, "-") {
+		return previous != nil && previous.ETag == object.ETag
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return false
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == object.ETag
+}
+
+func writePullManifest(dir string, manifest *pullManifest) error {
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, pullManifestName), body, 0644); err != nil {
+		return fmt.Errorf("Unable to write %s, %v", filepath.Join(dir, pullManifestName), err)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	s3Service "github.com/mitchdennett/hugo-s3-deploy/service/s3"
+	"github.com/pelletier/go-toml"
+)
+
+// fakeObject is an object in fakeS3, with the headers it is served with.
+type fakeObject struct {
+	body     []byte
+	header   http.Header
+	modified time.Time
+}
+
+// fakeS3 serves the requests pull and push make to a single bucket.
+type fakeS3 struct {
+	objects map[string]*fakeObject
+	website string
+	puts    int
+	mu      sync.Mutex
+}
+
+// storedHeaders are the request headers an object keeps.
+func storedHeaders(header http.Header) http.Header {
+	stored := http.Header{}
+	for name, values := range header {
+		switch name = http.CanonicalHeaderKey(name); {
+		case name == "Content-Type", name == "Cache-Control", name == "Content-Encoding", name == "X-Amz-Website-Redirect-Location",
+			strings.HasPrefix(name, "X-Amz-Meta-"):
+			stored[name] = values
+		}
+	}
+	return stored
+}
+
+func (fake *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/b"), "/")
+	_, website := r.URL.Query()["website"]
+	switch {
+	case key == "" && website && r.Method == "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		fake.website = string(body)
+	case key == "" && website:
+		fmt.Fprint(w, fake.website)
+	case key == "":
+		keys := []string{}
+		for key := range fake.objects {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated>`)
+		for _, key := range keys {
+			object := fake.objects[key]
+			fmt.Fprintf(w, `<Contents><Key>%s</Key><ETag>"%s"</ETag><Size>%d</Size><LastModified>%s</LastModified></Contents>`,
+				key, etag(object.body), len(object.body), object.modified.Format("2006-01-02T15:04:05.000Z"))
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	case r.Method == "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		fake.objects[key] = &fakeObject{body: body, header: storedHeaders(r.Header), modified: time.Now().UTC().Truncate(time.Second)}
+		fake.puts++
+	default:
+		object, ok := fake.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		for name, values := range object.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("ETag", `"`+etag(object.body)+`"`)
+		w.Header().Set("Last-Modified", object.modified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.body)))
+		if r.Method == "GET" {
+			w.Write(object.body)
+		}
+	}
+}
+
+func etag(body []byte) string {
+	sum := md5.Sum(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// fakeSite returns a site that deploys to fake.
+func fakeSite(t *testing.T, fake *fakeS3) (*site, *s3Service.S3Bucket) {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	bucket := s3Service.NewBucket(sess)
+	bucket.SetName("b")
+	config, _ := toml.Load("")
+	return &site{Name: "test", Config: config, Storage: "minio", BucketName: "b", Concurrency: 2, bucket: bucket}, bucket
+}
+
+const fakeWebsite = `<WebsiteConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><IndexDocument><Suffix>index.html</Suffix></IndexDocument>` +
+	`<RoutingRules><RoutingRule><Condition><KeyPrefixEquals>docs/</KeyPrefixEquals></Condition><Redirect><ReplaceKeyPrefixWith>documentation/</ReplaceKeyPrefixWith></Redirect></RoutingRule></RoutingRules></WebsiteConfiguration>`
+
+func TestPullPush(t *testing.T) {
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write([]byte("body { color: red }"))
+	writer.Close()
+	modified := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	seed := map[string]*fakeObject{
+		"index.html": {body: []byte("<html></html>"), header: http.Header{
+			"Content-Type": {"text/html"}, "Cache-Control": {"max-age=60"}, "X-Amz-Meta-Git-Sha": {"3fa2c1e"},
+		}},
+		"css/a.css": {body: gzipped.Bytes(), header: http.Header{
+			"Content-Type": {"text/css"}, "Content-Encoding": {"gzip"}, "Cache-Control": {"max-age=31536000"},
+		}},
+		"old/index.html": {body: []byte{}, header: http.Header{
+			"Content-Type": {"binary/octet-stream"}, "X-Amz-Website-Redirect-Location": {"/new/"},
+		}},
+	}
+	fake := &fakeS3{objects: map[string]*fakeObject{}, website: fakeWebsite}
+	for key, object := range seed {
+		fake.objects[key] = &fakeObject{body: object.body, header: object.header, modified: modified}
+	}
+	fake.objects[".hugo-s3-deploy/lock.json"] = &fakeObject{body: []byte("{}"), header: http.Header{}, modified: modified}
+	s, bucket := fakeSite(t, fake)
+	rules, err := bucket.WebsiteRoutingRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := pull(s, []string{dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing has been written since the pull, so nothing is uploaded.
+	uploaded, err := push(s, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded != 0 || fake.puts != 0 {
+		t.Errorf("pushing an unchanged pull uploaded %d files", fake.puts)
+	}
+
+	// Restore the pull into an empty bucket.
+	fake.objects = map[string]*fakeObject{}
+	fake.website = `<WebsiteConfiguration><IndexDocument><Suffix>index.html</Suffix></IndexDocument></WebsiteConfiguration>`
+	if uploaded, err = push(s, []string{dir}); err != nil {
+		t.Fatal(err)
+	}
+	if uploaded != len(seed) || len(fake.objects) != len(seed) {
+		t.Fatalf("pushed %d files, want %d", len(fake.objects), len(seed))
+	}
+	for key, want := range seed {
+		got := fake.objects[key]
+		if got == nil {
+			t.Errorf("%s wasn't pushed", key)
+			continue
+		}
+		if !bytes.Equal(got.body, want.body) {
+			t.Errorf("%s was pushed with body %q, want %q", key, got.body, want.body)
+		}
+		if !reflect.DeepEqual(got.header, want.header) {
+			t.Errorf("%s was pushed with headers %v, want %v", key, got.header, want.header)
+		}
+	}
+	restored, err := bucket.WebsiteRoutingRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored, rules) {
+		t.Errorf("routing rules are %v, want %v", restored, rules)
+	}
+}
@@ -0,0 +1,303 @@
+package redirects
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Rule struct {
+	Line   int
+	From   string
+	To     string
+	Status int
+}
+
+var placeholder = regexp.MustCompile(`:[A-Za-z_][A-Za-z0-9_]*`)
+
+// Load parses the first _redirects file found at the given paths. It returns
+// no rules when none of them exist.
+func Load(paths ...string) ([]*Rule, error) {
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		rules, err := Parse(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return rules, nil
+	}
+	return nil, nil
+}
+
+// Parse reads rules in Netlify's _redirects syntax. Only redirects can be
+// deployed to S3 and CloudFront, so rewrites, custom status pages, query
+// parameter matches and conditions are rejected rather than ignored.
+func Parse(r io.Reader) ([]*Rule, error) {
+	rules := []*Rule{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected a source path and a destination", line)
+		}
+		if len(fields) > 3 || isQueryMatch(fields[1]) {
+			return nil, fmt.Errorf("line %d: query parameter and condition matching is not supported", line)
+		}
+
+		rule := &Rule{Line: line, From: fields[0], To: fields[1], Status: 301}
+		if len(fields) == 3 {
+			status, err := strconv.Atoi(strings.TrimSuffix(fields[2], "!"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid status %q", line, fields[2])
+			}
+			rule.Status = status
+		}
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// isQueryMatch reports whether field is a query parameter match such as
+// id=:id, which sits between the source and the destination.
+func isQueryMatch(field string) bool {
+	return strings.Contains(field, "=") && !strings.HasPrefix(field, "/") && !strings.Contains(field, "://")
+}
+
+func (rule *Rule) validate() error {
+	switch rule.Status {
+	case 301, 302, 303, 307, 308:
+	default:
+		return fmt.Errorf("status %d is not supported, only 301, 302, 303, 307 and 308 redirects can be deployed", rule.Status)
+	}
+	if !strings.HasPrefix(rule.From, "/") {
+		return fmt.Errorf("source %q must be a path starting with /", rule.From)
+	}
+	if strings.Contains(strings.TrimSuffix(rule.From, "*"), "*") {
+		return fmt.Errorf("source %q may only use * at the end", rule.From)
+	}
+	if !strings.HasPrefix(rule.To, "/") && !strings.HasPrefix(rule.To, "http://") && !strings.HasPrefix(rule.To, "https://") {
+		return fmt.Errorf("destination %q must be a path or an http(s) URL", rule.To)
+	}
+
+	names := rule.names()
+	for _, name := range placeholder.FindAllString(rule.To, -1) {
+		if _, ok := names[name[1:]]; !ok {
+			return fmt.Errorf("destination uses %s which is not captured by %q", name, rule.From)
+		}
+	}
+	return nil
+}
+
+// IsDynamic reports whether the rule needs splat or placeholder matching,
+// which only a CloudFront Function can do.
+func (rule *Rule) IsDynamic() bool {
+	return len(rule.names()) > 0
+}
+
+// Key is the S3 object key a simple rule's source path resolves to.
+func (rule *Rule) Key() string {
+	key := strings.TrimPrefix(rule.From, "/")
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += "index.html"
+	}
+	return key
+}
+
+// names maps each placeholder captured by the source to its regexp group.
+func (rule *Rule) names() map[string]int {
+	names := map[string]int{}
+	for _, segment := range strings.Split(rule.From, "/") {
+		if isPlaceholder(segment) {
+			names[segment[1:]] = len(names) + 1
+		}
+	}
+	if strings.HasSuffix(rule.From, "*") {
+		names["splat"] = len(names) + 1
+	}
+	return names
+}
+
+func isPlaceholder(segment string) bool {
+	return segment != "" && placeholder.FindString(segment) == segment
+}
+
+func (rule *Rule) pattern() string {
+	from := strings.TrimSuffix(rule.From, "*")
+	segments := strings.Split(from, "/")
+	for i, segment := range segments {
+		if isPlaceholder(segment) {
+			segments[i] = "([^/]+)"
+		} else {
+			segments[i] = regexp.QuoteMeta(segment)
+		}
+	}
+	pattern := "^" + strings.Join(segments, "/")
+	if strings.HasSuffix(rule.From, "*") {
+		return pattern + "(.*)$"
+	}
+	// Like Netlify, a path matches with or without its trailing slash.
+	return strings.TrimSuffix(pattern, "/") + "/?$"
+}
+
+// Split sorts rules by how they can be deployed: permanent redirects for a
+// single path become redirect objects, and the rest are answered by a
+// CloudFront Function. Those are split into single-path redirects, which
+// the function matches exactly, and splat or placeholder rules. S3 routing
+// rules can't be used for them since they match key prefixes, so a rule for
+// /blog would also catch /blogroll.
+func Split(rules []*Rule) (objects []*Rule, exact []*Rule, dynamic []*Rule) {
+	for _, rule := range rules {
+		switch {
+		case rule.IsDynamic():
+			dynamic = append(dynamic, rule)
+		case rule.Status == 301:
+			objects = append(objects, rule)
+		default:
+			exact = append(exact, rule)
+		}
+	}
+	return objects, exact, dynamic
+}
+
+// MaxFunctionSize is the largest CloudFront Function code, in bytes.
+const MaxFunctionSize = 10 * 1024
+
+type functionRule struct {
+	Pattern string          `json:"pattern"`
+	To      string          `json:"to"`
+	Status  int             `json:"status"`
+	Params  [][]interface{} `json:"params"`
+}
+
+// FunctionCode generates a CloudFront Function that answers rules with
+// redirects on viewer request, checking them in order.
+//
+// With indexes, the function also does what the S3 website does for
+// directories, for distributions whose origin has a path: it adds
+// index.html to paths ending in a slash and redirects other paths without
+// an extension to their directory. Left to S3, that redirect would go to a
+// URL containing the origin path. Files are the keys without an extension
+// that are served as they are.
+//
+// It fails when the code is larger than CloudFront Functions allow.
+func FunctionCode(rules []*Rule, indexes bool, files []string) (string, error) {
+	compiled := []functionRule{}
+	for _, rule := range rules {
+		names := rule.names()
+		params := [][]interface{}{}
+		for name, group := range names {
+			params = append(params, []interface{}{":" + name, group})
+		}
+		// Substitute longer names first so :id can't clobber :identity.
+		sort.Slice(params, func(i, j int) bool {
+			a, b := params[i][0].(string), params[j][0].(string)
+			if len(a) != len(b) {
+				return len(a) > len(b)
+			}
+			return a < b
+		})
+		compiled = append(compiled, functionRule{
+			Pattern: rule.pattern(),
+			To:      rule.To,
+			Status:  rule.Status,
+			Params:  params,
+		})
+	}
+	dat, err := json.Marshal(compiled)
+	if err != nil {
+		return "", err
+	}
+
+	paths := map[string]bool{}
+	for _, file := range files {
+		paths["/"+file] = true
+	}
+	filesDat, err := json.Marshal(paths)
+	if err != nil {
+		return "", err
+	}
+
+	var code bytes.Buffer
+	code.WriteString("// Generated by hugo-s3-deploy from _redirects. Do not edit.\n")
+	code.WriteString("var rules = " + string(dat) + ";\n")
+	code.WriteString("var indexes = " + strconv.FormatBool(indexes) + ";\n")
+	code.WriteString("var files = " + string(filesDat) + ";\n")
+	code.WriteString(functionBody)
+	if code.Len() > MaxFunctionSize {
+		return "", fmt.Errorf("The CloudFront redirect function for %d _redirects rules and %d files without an extension is %d bytes, over CloudFront's limit of %d. Make some rules permanent (301) single-path redirects, which are stored as objects instead, or combine them with splats", len(rules), len(files), code.Len(), MaxFunctionSize)
+	}
+	return code.String(), nil
+}
+
+const functionBody = `
+function handler(event) {
+  var request = event.request;
+  var uri = request.uri;
+  for (var i = 0; i < rules.length; i++) {
+    var match = uri.match(new RegExp(rules[i].pattern));
+    if (!match) {
+      continue;
+    }
+    var location = rules[i].to;
+    for (var j = 0; j < rules[i].params.length; j++) {
+      var param = rules[i].params[j];
+      location = location.split(param[0]).join(match[param[1]]);
+    }
+    return redirect(rules[i].status, location);
+  }
+
+  if (indexes && !files[uri]) {
+    if (uri.endsWith('/')) {
+      request.uri = uri + 'index.html';
+    } else if (uri.split('/').pop().indexOf('.') === -1) {
+      return redirect(302, uri + '/' + query(request.querystring));
+    }
+  }
+  return request;
+}
+
+function redirect(status, location) {
+  return {
+    statusCode: status,
+    statusDescription: 'Redirect',
+    headers: { location: { value: location } }
+  };
+}
+
+function query(querystring) {
+  var parts = [];
+  for (var name in querystring) {
+    var param = querystring[name];
+    var values = param.multiValue || [param];
+    for (var i = 0; i < values.length; i++) {
+      parts.push(values[i].value === '' ? name : name + '=' + values[i].value);
+    }
+  }
+  return parts.length > 0 ? '?' + parts.join('&') : '';
+}
+`
@@ -0,0 +1,269 @@
+package redirects
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []Rule
+		err   string
+	}{
+		{input: "/old /new", want: []Rule{{Line: 1, From: "/old", To: "/new", Status: 301}}},
+		{input: "# comment\n\n/a /b 302", want: []Rule{{Line: 3, From: "/a", To: "/b", Status: 302}}},
+		{input: "/a https://example.com/b 308!", want: []Rule{{Line: 1, From: "/a", To: "https://example.com/b", Status: 308}}},
+		{input: "/blog/:year/:slug /posts/:slug", want: []Rule{{Line: 1, From: "/blog/:year/:slug", To: "/posts/:slug", Status: 301}}},
+		{input: "/a", err: "line 1: expected a source path and a destination"},
+		{input: "/a /b 200", err: "status 200 is not supported"},
+		{input: "/a /b 404", err: "status 404 is not supported"},
+		{input: "/a /b abc", err: `invalid status "abc"`},
+		{input: "/a id=:id /b", err: "query parameter"},
+		{input: "/a /b 301 Country=us", err: "condition"},
+		{input: "a /b", err: "must be a path starting with /"},
+		{input: "/a/*/b /c", err: "may only use * at the end"},
+		{input: "/a ftp://b", err: "must be a path or an http(s) URL"},
+		{input: "/a/:x /b/:y", err: "destination uses :y"},
+	}
+	for _, test := range tests {
+		rules, err := Parse(strings.NewReader(test.input))
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Parse(%q) error = %v, want %q", test.input, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", test.input, err)
+			continue
+		}
+		if len(rules) != len(test.want) {
+			t.Errorf("Parse(%q) = %d rules, want %d", test.input, len(rules), len(test.want))
+			continue
+		}
+		for i, rule := range rules {
+			if *rule != test.want[i] {
+				t.Errorf("Parse(%q)[%d] = %+v, want %+v", test.input, i, *rule, test.want[i])
+			}
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := map[string]string{
+		"/":          "index.html",
+		"/old-post/": "old-post/index.html",
+		"/old-post":  "old-post",
+		"/a/b.html":  "a/b.html",
+	}
+	for from, want := range tests {
+		if got := (&Rule{From: from}).Key(); got != want {
+			t.Errorf("Key(%q) = %q, want %q", from, got, want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	rules, err := Parse(strings.NewReader(`/permanent /a
+/temporary /b 302
+/splat/* /c/:splat
+/permanent-too /d 301
+/:lang/old /:lang/new 302
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, exact, dynamic := Split(rules)
+	if got := froms(objects); got != "/permanent /permanent-too" {
+		t.Errorf("objects = %s", got)
+	}
+	if got := froms(exact); got != "/temporary" {
+		t.Errorf("exact = %s", got)
+	}
+	if got := froms(dynamic); got != "/splat/* /:lang/old" {
+		t.Errorf("dynamic = %s", got)
+	}
+}
+
+func froms(rules []*Rule) string {
+	list := []string{}
+	for _, rule := range rules {
+		list = append(list, rule.From)
+	}
+	return strings.Join(list, " ")
+}
+
+func TestPattern(t *testing.T) {
+	tests := []struct {
+		from     string
+		matches  []string
+		misses   []string
+		captures map[string]string
+	}{
+		{
+			from:    "/blog",
+			matches: []string{"/blog", "/blog/"},
+			misses:  []string{"/blogroll", "/blog/post/", "/blog/index.html", "/a/blog"},
+		},
+		{
+			from:    "/old-post/",
+			matches: []string{"/old-post/", "/old-post"},
+			misses:  []string{"/old-post/x", "/old-posts"},
+		},
+		{
+			from:    "/a.b",
+			matches: []string{"/a.b"},
+			misses:  []string{"/axb"},
+		},
+		{
+			from:    "/",
+			matches: []string{"/"},
+			misses:  []string{"/a"},
+		},
+		{
+			from:     "/docs/*",
+			matches:  []string{"/docs/", "/docs/a/b"},
+			misses:   []string{"/docs", "/documents/"},
+			captures: map[string]string{"/docs/a/b": "a/b"},
+		},
+		{
+			from:     "/blog/:year/:slug",
+			matches:  []string{"/blog/2024/hello", "/blog/2024/hello/"},
+			misses:   []string{"/blog/2024", "/blog/2024/hello/more"},
+			captures: map[string]string{"/blog/2024/hello": "2024"},
+		},
+	}
+	for _, test := range tests {
+		re := regexp.MustCompile((&Rule{From: test.from}).pattern())
+		for _, uri := range test.matches {
+			if !re.MatchString(uri) {
+				t.Errorf("%s doesn't match %s", test.from, uri)
+			}
+		}
+		for _, uri := range test.misses {
+			if re.MatchString(uri) {
+				t.Errorf("%s matches %s", test.from, uri)
+			}
+		}
+		for uri, want := range test.captures {
+			if got := re.FindStringSubmatch(uri); len(got) < 2 || got[1] != want {
+				t.Errorf("%s captures %q from %s, want %q", test.from, got, uri, want)
+			}
+		}
+	}
+}
+
+func TestFunctionCode(t *testing.T) {
+	rules, err := Parse(strings.NewReader("/temporary /b 302\n/:id/:identity /x/:identity/:id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := FunctionCode(rules, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"pattern":"^/temporary/?$"`,
+		`"status":302`,
+		// Longer names are substituted first.
+		`"params":[[":identity",2],[":id",1]]`,
+		"function handler(event)",
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("FunctionCode is missing %s:\n%s", want, code)
+		}
+	}
+}
+
+func TestFunctionCodeTooLarge(t *testing.T) {
+	var file strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&file, "/posts/%d /articles/%d 302\n", i, i)
+	}
+	rules, err := Parse(strings.NewReader(file.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, err := FunctionCode(rules[:10], false, nil); err != nil || len(code) > MaxFunctionSize {
+		t.Fatalf("10 rules: %d bytes, %v", len(code), err)
+	}
+	_, err = FunctionCode(rules, false, nil)
+	if err == nil || !strings.Contains(err.Error(), "over CloudFront's limit of 10240") {
+		t.Errorf("200 rules: err = %v, want the size limit", err)
+	}
+}
+
+// TestFunctionHandler runs the generated function with node, which runs
+// the same JavaScript as CloudFront Functions.
+func TestFunctionHandler(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node isn't installed")
+	}
+	rules, err := Parse(strings.NewReader("/temporary /b 302\n/docs/old /docs/new/ 302"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := FunctionCode(rules, true, []string{"old-post", "CNAME"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		uri      string
+		query    string
+		want     string
+		location string
+	}{
+		{uri: "/temporary", location: "/b"},
+		{uri: "/docs/old/", location: "/docs/new/"},
+		{uri: "/", want: "/index.html"},
+		{uri: "/docs/", want: "/docs/index.html"},
+		{uri: "/docs", location: "/docs/"},
+		{uri: "/docs", query: `{"a":{"value":"1"},"b":{"value":"","multiValue":[{"value":""},{"value":"2"}]}}`, location: "/docs/?a=1&b&b=2"},
+		{uri: "/css/site.css", want: "/css/site.css"},
+		{uri: "/old-post", want: "/old-post"},
+		{uri: "/CNAME", want: "/CNAME"},
+	}
+	for _, test := range tests {
+		query := test.query
+		if query == "" {
+			query = "{}"
+		}
+		script := code + "\nconsole.log(JSON.stringify(handler({request: {uri: '" + test.uri + "', querystring: " + query + "}})));"
+		out, err := exec.Command(node, "-e", script).Output()
+		if err != nil {
+			t.Fatalf("%s: %v", test.uri, err)
+		}
+		var result struct {
+			Uri     string
+			Headers struct {
+				Location struct{ Value string }
+			}
+		}
+		if err := json.Unmarshal(out, &result); err != nil {
+			t.Fatalf("%s: %v in %s", test.uri, err, out)
+		}
+		if result.Uri != test.want || result.Headers.Location.Value != test.location {
+			t.Errorf("%s?%s = uri %q location %q, want uri %q location %q", test.uri, test.query, result.Uri, result.Headers.Location.Value, test.want, test.location)
+		}
+	}
+
+	// Without indexes, requests pass through untouched.
+	code, err = FunctionCode(nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(node, "-e", code+"\nconsole.log(handler({request: {uri: '/docs', querystring: {}}}).uri);").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "/docs" {
+		t.Errorf("without indexes /docs = %q", got)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mitchdennett/hugo-s3-deploy/headers"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	"github.com/mitchdennett/hugo-s3-deploy/service/cloudfront"
+	"github.com/mitchdennett/hugo-s3-deploy/service/storage"
+)
+
+// Versioned deploys upload each release under its own prefix and make it
+// live by pointing the CloudFront origin at it.
+const releasesPrefix = "releases/"
+
+// Objects the tool keeps for its own bookkeeping live under this prefix.
+const stateKeyPrefix = ".hugo-s3-deploy/"
+
+// statePrefix is where the state of the environment being deployed is kept,
+// so environments sharing a bucket don't share releases.
+func statePrefix() string {
+	if *envName == "" {
+		return stateKeyPrefix
+	}
+	return stateKeyPrefix + "env/" + *envName + "/"
+}
+
+type release struct {
+	Id       string           `json:"id"`
+	Created  time.Time        `json:"created"`
+	Settings *releaseSettings `json:"settings,omitempty"`
+}
+
+// releaseSettings is the distribution configuration a release was
+// published with, which rolling back to it restores. Releases published by
+// older versions have none.
+type releaseSettings struct {
+	ViewerFunction string           `json:"viewerFunction"`
+	Headers        []headers.Header `json:"headers"`
+	PathHeaders    []*headers.Rule  `json:"pathHeaders"`
+}
+
+// releaseHistory lists the releases still in the bucket, oldest first. Ids
+// can be commit hashes, so the order can't be recovered from the ids alone.
+type releaseHistory struct {
+	Releases []release `json:"releases"`
+}
+
+func releaseKeyPrefix(id string) string {
+	return releasesPrefix + id + "/"
+}
+
+func releaseOriginPath(id string) string {
+	return "/" + releasesPrefix + id
+}
+
+func loadReleases(bucket storage.Storage) (*releaseHistory, error) {
+	history := &releaseHistory{}
+	_, err := bucket.GetJSON(statePrefix()+"releases.json", history)
+	return history, err
+}
+
+func (history *releaseHistory) save(bucket storage.Storage) error {
+	return bucket.PutJSON(statePrefix()+"releases.json", history)
+}
+
+func (history *releaseHistory) index(id string) int {
+	for i, release := range history.Releases {
+		if release.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (history *releaseHistory) ids() string {
+	ids := []string{}
+	for _, release := range history.Releases {
+		ids = append(ids, release.Id)
+	}
+	return strings.Join(ids, ", ")
+}
+
+// currentRelease returns the id of the release CloudFront is serving, or an
+// empty string when the site isn't deployed as releases.
+func currentRelease(dist *cloudfront.Distribution) (string, error) {
+	path, err := dist.OriginPath()
+	if err != nil || !strings.HasPrefix(path, "/"+releasesPrefix) {
+		return "", err
+	}
+	return strings.TrimPrefix(path, "/"+releasesPrefix), nil
+}
+
+// publishRelease makes an uploaded release live, recording the settings it
+// was published with, and prunes releases beyond the newest retain, never
+// pruning the live one.
+func publishRelease(bucket storage.Storage, dist *cloudfront.Distribution, id string, retain int, settings *releaseSettings) error {
+	history, err := loadReleases(bucket)
+	if err != nil {
+		return err
+	}
+	if i := history.index(id); i == -1 {
+		history.Releases = append(history.Releases, release{Id: id, Created: time.Now().UTC(), Settings: settings})
+	} else {
+		history.Releases[i].Settings = settings
+	}
+
+	if err := dist.SetOriginPath(releaseOriginPath(id)); err != nil {
+		return err
+	}
+	if err := history.save(bucket); err != nil {
+		return err
+	}
+
+	if retain <= 0 || len(history.Releases) <= retain {
+		return nil
+	}
+
+	kept := []release{}
+	cutoff := len(history.Releases) - retain
+	for i, old := range history.Releases {
+		if i >= cutoff || old.Id == id {
+			kept = append(kept, old)
+			continue
+		}
+		deleted, err := bucket.DeletePrefix(releaseKeyPrefix(old.Id))
+		if err != nil {
+			return err
+		}
+		output.Println("Pruned release", old.Id, "-", deleted, "objects")
+	}
+	history.Releases = kept
+	return history.save(bucket)
+}
+
+// rollback points CloudFront at an earlier release, by default the one
+// published before the live release.
+func rollback(out *output.Printer, bucket storage.Storage, dist *cloudfront.Distribution, id string) error {
+	history, err := loadReleases(bucket)
+	if err != nil {
+		return err
+	}
+	current, err := currentRelease(dist)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		return errors.New("CloudFront is not serving a release, so there is nothing to roll back")
+	}
+
+	if id == "" {
+		i := history.index(current)
+		if i <= 0 {
+			return errors.New("There is no release before " + current + " to roll back to")
+		}
+		id = history.Releases[i-1].Id
+	} else if history.index(id) == -1 {
+		return fmt.Errorf("Release %q was not found. Available releases: %s", id, history.ids())
+	}
+	settings := history.Releases[history.index(id)].Settings
+
+	summary := map[string]interface{}{"release": id, "previousRelease": current, "distributionId": dist.Id}
+	if id == current {
+		output.Println("Release", id, "is already live")
+		return out.Summary(summary)
+	}
+
+	out.Step("rollback", "Rolling back from release "+current+" to "+id+" ....")
+	if err := bucket.RepointWebsite(releaseKeyPrefix(current), releaseKeyPrefix(id)); err != nil {
+		return err
+	}
+	if settings != nil {
+		if err := dist.SetViewerRequestFunction("redirects", settings.ViewerFunction); err != nil {
+			return err
+		}
+		if err := dist.SetResponseHeaders(settings.Headers, settings.PathHeaders); err != nil {
+			return err
+		}
+	} else {
+		output.Println("Release " + id + " has no recorded redirects or headers, so the current ones are kept")
+	}
+	if err := dist.SetOriginPath(releaseOriginPath(id)); err != nil {
+		return err
+	}
+	summary["invalidationId"], err = dist.Invalidate([]string{"/*"})
+	if err != nil {
+		return err
+	}
+	return out.Summary(summary)
+}
@@ -1,14 +1,16 @@
 package acm
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/acm"
+
+	"github.com/mitchdennett/hugo-s3-deploy/output"
 )
 
 type Certificate struct {
@@ -36,7 +38,7 @@ func (cert *Certificate) setId(id *string) {
 	cert.Id = id
 }
 
-func (cert *Certificate) Request(sess *session.Session) {
+func (cert *Certificate) Request(sess *session.Session) error {
 	svc := acm.New(sess, aws.NewConfig().WithRegion("us-east-1"))
 	result, err := svc.RequestCertificate(&acm.RequestCertificateInput{
 		DomainName:              aws.String("*." + cert.DomainName),
@@ -48,43 +50,53 @@ func (cert *Certificate) Request(sess *session.Session) {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case acm.ErrCodeLimitExceededException:
-				fmt.Println(acm.ErrCodeLimitExceededException, aerr.Error())
+				output.Println(acm.ErrCodeLimitExceededException, aerr.Error())
 			case acm.ErrCodeInvalidDomainValidationOptionsException:
-				fmt.Println(acm.ErrCodeInvalidDomainValidationOptionsException, aerr.Error())
+				output.Println(acm.ErrCodeInvalidDomainValidationOptionsException, aerr.Error())
 			case acm.ErrCodeInvalidArnException:
-				fmt.Println(acm.ErrCodeInvalidArnException, aerr.Error())
+				output.Println(acm.ErrCodeInvalidArnException, aerr.Error())
 			default:
-				log.Fatal(aerr.Error())
+				return aerr
 			}
 		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Fatal(err.Error())
+			return err
 		}
-		log.Fatal("Error Requesting Cert...")
-	} else {
-		//Call new method here
-		time.Sleep(8 * time.Second)
-
-		cert.setId(result.CertificateArn)
+		return errors.New("Error Requesting Cert...")
 	}
+
+	time.Sleep(8 * time.Second)
+	cert.setId(result.CertificateArn)
+	return nil
 }
 
-func (cert *Certificate) DescribeCertificate() *acm.ResourceRecord {
+func (cert *Certificate) DescribeCertificate() (*acm.ResourceRecord, error) {
 	svc := acm.New(cert.session, aws.NewConfig().WithRegion("us-east-1"))
 	result, err := svc.DescribeCertificate(&acm.DescribeCertificateInput{
 		CertificateArn: cert.Id,
 	})
 
 	if err != nil {
-		log.Fatal("Failed Describing Cert")
+		return nil, fmt.Errorf("Failed Describing Cert, %v", err)
 	}
 
 	resourceRecord1 := result.Certificate.DomainValidationOptions[0].ResourceRecord
 
 	if resourceRecord1 == nil {
-		log.Fatal("Resource Record Doesn't exists.")
+		return nil, errors.New("Resource Record Doesn't exists.")
 	}
 
-	return resourceRecord1
+	return resourceRecord1, nil
+}
+
+// WaitUntilValidated blocks until ACM has validated the certificate, which
+// can take half an hour or more after the DNS record is inserted.
+func (cert *Certificate) WaitUntilValidated() error {
+	svc := acm.New(cert.session, aws.NewConfig().WithRegion("us-east-1"))
+	err := svc.WaitUntilCertificateValidated(&acm.DescribeCertificateInput{
+		CertificateArn: cert.Id,
+	})
+	if err != nil {
+		return fmt.Errorf("Certificate was not validated: %v", err)
+	}
+	return nil
 }
@@ -0,0 +1,89 @@
+// Package bandwidth limits how fast request bodies are sent, so a deploy
+// doesn't saturate a shared connection.
+package bandwidth
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/mitchdennett/hugo-s3-deploy/budget"
+)
+
+// chunk is the most a single read takes from the bucket, so a large read
+// can't send a burst well over the limit.
+const chunk = 32 << 10
+
+// Limiter is a token bucket shared by every request it is attached to.
+// Tokens are bytes, added at Rate per second up to one chunk.
+type Limiter struct {
+	Rate   int64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{Rate: rate, tokens: chunk, last: time.Now()}
+}
+
+// ParseRate reads a rate such as "5MB/s" or "500KB". Units are powers of
+// 1024.
+func ParseRate(rate string) (int64, error) {
+	size, err := budget.ParseSize(strings.TrimSuffix(strings.TrimSpace(rate), "/s"))
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("Invalid bandwidth %q, expected a rate such as \"5MB/s\"", rate)
+	}
+	return size, nil
+}
+
+// wait takes n tokens, sleeping until the bucket has refilled enough to
+// cover them. Callers are served in the order they arrive.
+func (limiter *Limiter) wait(n int) {
+	limiter.mu.Lock()
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * float64(limiter.Rate)
+	if limiter.tokens > chunk {
+		limiter.tokens = chunk
+	}
+	limiter.last = now
+	limiter.tokens -= float64(n)
+	deficit := -limiter.tokens
+	limiter.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / float64(limiter.Rate) * float64(time.Second)))
+	}
+}
+
+// Attach limits the bodies of the requests sent with handlers, such as a
+// session's. Responses aren't limited.
+func (limiter *Limiter) Attach(handlers *request.Handlers) {
+	// The SDK rebuilds the body before every attempt, so retries are
+	// limited too.
+	handlers.Send.PushFront(func(r *request.Request) {
+		if r.HTTPRequest.Body != nil && r.HTTPRequest.Body != http.NoBody {
+			r.HTTPRequest.Body = &body{ReadCloser: r.HTTPRequest.Body, limiter: limiter}
+		}
+	})
+}
+
+type body struct {
+	io.ReadCloser
+	limiter *Limiter
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.limiter.wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,84 @@
+package bandwidth
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate string
+		want int64
+	}{
+		{"5MB/s", 5 << 20},
+		{"500KB", 500 << 10},
+		{" 1.5 MB/s ", 3 << 19},
+		{"2048", 2048},
+	}
+	for _, test := range tests {
+		if got, err := ParseRate(test.rate); err != nil || got != test.want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", test.rate, got, err, test.want)
+		}
+	}
+	for _, rate := range []string{"", "0", "0MB/s", "fast", "5MB/min"} {
+		if _, err := ParseRate(rate); err == nil {
+			t.Errorf("ParseRate(%q) didn't fail", rate)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	// The first chunk is sent at once, and the rest at 256KB/s.
+	limiter := NewLimiter(256 << 10)
+	reader := &body{ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, chunk+128<<10))), limiter: limiter}
+	started := time.Now()
+	n, err := io.Copy(ioutil.Discard, reader)
+	if err != nil || n != chunk+128<<10 {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("128KB over the first chunk took %s at 256KB/s, want about 500ms", elapsed)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received += len(body)
+	}))
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	NewLimiter(256 << 10).Attach(&sess.Handlers)
+	started := time.Now()
+	_, err := s3.New(sess).PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("index.html"),
+		Body:   bytes.NewReader(make([]byte, chunk+128<<10)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != chunk+128<<10 {
+		t.Errorf("received %d bytes, want %d", received, chunk+128<<10)
+	}
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond {
+		t.Errorf("the upload took %s, so it wasn't limited", elapsed)
+	}
+}
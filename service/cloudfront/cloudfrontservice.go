@@ -1,24 +1,30 @@
 package cloudfront
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
 	"github.com/mitchdennett/hugo-s3-deploy/service/s3"
 )
 
 type Distribution struct {
-	session    *session.Session
-	Bucket     *s3.S3Bucket
-	Region     string
-	AliasName  string
-	DomainName *string
+	session        *session.Session
+	Id             string
+	Bucket         *s3.S3Bucket
+	Region         string
+	AliasName      string
+	Aliases        []string
+	CertificateArn string
+	Root           string
+	DomainName     *string
 }
 
 func NewDistribution(sess *session.Session) *Distribution {
@@ -27,19 +33,47 @@ func NewDistribution(sess *session.Session) *Distribution {
 	return dist
 }
 
+func (dist *Distribution) SetId(id string) {
+	dist.Id = id
+}
+
 func (dist *Distribution) SetAliasName(name string) {
 	dist.AliasName = name
 }
 
+// SetAliases replaces the aliases a new distribution is created with, which
+// default to AliasName and its www subdomain.
+func (dist *Distribution) SetAliases(aliases []string) {
+	dist.Aliases = aliases
+}
+
+func (dist *Distribution) SetCertificateArn(arn string) {
+	dist.CertificateArn = arn
+}
+
 func (dist *Distribution) SetRegion(region string) {
 	dist.Region = region
 }
 
+// SetRoot sets the key prefix the site is stored under in the bucket. Origin
+// paths are relative to it.
+func (dist *Distribution) SetRoot(prefix string) {
+	dist.Root = prefix
+}
+
+// originPath is the origin path serving path under the site's root.
+func (dist *Distribution) originPath(path string) string {
+	if dist.Root == "" {
+		return path
+	}
+	return "/" + strings.TrimSuffix(dist.Root, "/") + path
+}
+
 func (dist *Distribution) SetBucket(bucket *s3.S3Bucket) {
 	dist.Bucket = bucket
 }
 
-func (dist *Distribution) CreateDistribution() {
+func (dist *Distribution) CreateDistribution() error {
 	svc := cloudfront.New(dist.session)
 
 	origin := &cloudfront.Origin{
@@ -50,14 +84,20 @@ func (dist *Distribution) CreateDistribution() {
 			HTTPSPort:            aws.Int64(443),
 			OriginProtocolPolicy: aws.String("http-only"),
 		},
+		OriginPath: aws.String(dist.originPath("")),
 	}
 	origins := []*cloudfront.Origin{origin}
 
+	aliases := dist.Aliases
+	if len(aliases) == 0 {
+		aliases = []string{dist.AliasName, "www." + dist.AliasName}
+	}
+
 	input := &cloudfront.CreateDistributionInput{
 		DistributionConfig: &cloudfront.DistributionConfig{
 			Aliases: &cloudfront.Aliases{
-				Items:    aws.StringSlice([]string{dist.AliasName, "www." + dist.AliasName}),
-				Quantity: aws.Int64(2),
+				Items:    aws.StringSlice(aliases),
+				Quantity: aws.Int64(int64(len(aliases))),
 			},
 			CallerReference: aws.String(strconv.FormatInt(time.Now().UnixNano(), 10)),
 			Comment:         aws.String("Cloudfront for " + dist.AliasName),
@@ -84,102 +124,524 @@ func (dist *Distribution) CreateDistribution() {
 		},
 	}
 
+	if dist.CertificateArn != "" {
+		input.DistributionConfig.ViewerCertificate = &cloudfront.ViewerCertificate{
+			ACMCertificateArn:      aws.String(dist.CertificateArn),
+			SSLSupportMethod:       aws.String(cloudfront.SSLSupportMethodSniOnly),
+			MinimumProtocolVersion: aws.String(cloudfront.MinimumProtocolVersionTlsv122021),
+		}
+	}
+
 	result, err := svc.CreateDistribution(input)
 
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case cloudfront.ErrCodeCNAMEAlreadyExists:
-				fmt.Println(cloudfront.ErrCodeCNAMEAlreadyExists, aerr.Error())
+				output.Println(cloudfront.ErrCodeCNAMEAlreadyExists, aerr.Error())
 			case cloudfront.ErrCodeDistributionAlreadyExists:
-				fmt.Println(cloudfront.ErrCodeDistributionAlreadyExists, aerr.Error())
+				output.Println(cloudfront.ErrCodeDistributionAlreadyExists, aerr.Error())
 			case cloudfront.ErrCodeInvalidOrigin:
-				fmt.Println(cloudfront.ErrCodeInvalidOrigin, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidOrigin, aerr.Error())
 			case cloudfront.ErrCodeInvalidOriginAccessIdentity:
-				fmt.Println(cloudfront.ErrCodeInvalidOriginAccessIdentity, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidOriginAccessIdentity, aerr.Error())
 			case cloudfront.ErrCodeAccessDenied:
-				fmt.Println(cloudfront.ErrCodeAccessDenied, aerr.Error())
+				output.Println(cloudfront.ErrCodeAccessDenied, aerr.Error())
 			case cloudfront.ErrCodeTooManyTrustedSigners:
-				fmt.Println(cloudfront.ErrCodeTooManyTrustedSigners, aerr.Error())
+				output.Println(cloudfront.ErrCodeTooManyTrustedSigners, aerr.Error())
 			case cloudfront.ErrCodeTrustedSignerDoesNotExist:
-				fmt.Println(cloudfront.ErrCodeTrustedSignerDoesNotExist, aerr.Error())
+				output.Println(cloudfront.ErrCodeTrustedSignerDoesNotExist, aerr.Error())
 			case cloudfront.ErrCodeInvalidViewerCertificate:
-				fmt.Println(cloudfront.ErrCodeInvalidViewerCertificate, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidViewerCertificate, aerr.Error())
 			case cloudfront.ErrCodeInvalidMinimumProtocolVersion:
-				fmt.Println(cloudfront.ErrCodeInvalidMinimumProtocolVersion, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidMinimumProtocolVersion, aerr.Error())
 			case cloudfront.ErrCodeMissingBody:
-				fmt.Println(cloudfront.ErrCodeMissingBody, aerr.Error())
+				output.Println(cloudfront.ErrCodeMissingBody, aerr.Error())
 			case cloudfront.ErrCodeTooManyDistributionCNAMEs:
-				fmt.Println(cloudfront.ErrCodeTooManyDistributionCNAMEs, aerr.Error())
+				output.Println(cloudfront.ErrCodeTooManyDistributionCNAMEs, aerr.Error())
 			case cloudfront.ErrCodeTooManyDistributions:
-				fmt.Println(cloudfront.ErrCodeTooManyDistributions, aerr.Error())
+				output.Println(cloudfront.ErrCodeTooManyDistributions, aerr.Error())
 			case cloudfront.ErrCodeInvalidDefaultRootObject:
-				fmt.Println(cloudfront.ErrCodeInvalidDefaultRootObject, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidDefaultRootObject, aerr.Error())
 			case cloudfront.ErrCodeInvalidRelativePath:
-				fmt.Println(cloudfront.ErrCodeInvalidRelativePath, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidRelativePath, aerr.Error())
 			case cloudfront.ErrCodeInvalidErrorCode:
-				fmt.Println(cloudfront.ErrCodeInvalidErrorCode, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidErrorCode, aerr.Error())
 			case cloudfront.ErrCodeInvalidResponseCode:
-				fmt.Println(cloudfront.ErrCodeInvalidResponseCode, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidResponseCode, aerr.Error())
 			case cloudfront.ErrCodeInvalidArgument:
-				fmt.Println(cloudfront.ErrCodeInvalidArgument, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidArgument, aerr.Error())
 			case cloudfront.ErrCodeInvalidRequiredProtocol:
-				fmt.Println(cloudfront.ErrCodeInvalidRequiredProtocol, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidRequiredProtocol, aerr.Error())
 			case cloudfront.ErrCodeNoSuchOrigin:
-				fmt.Println(cloudfront.ErrCodeNoSuchOrigin, aerr.Error())
+				output.Println(cloudfront.ErrCodeNoSuchOrigin, aerr.Error())
 			case cloudfront.ErrCodeTooManyOrigins:
-				fmt.Println(cloudfront.ErrCodeTooManyOrigins, aerr.Error())
+				output.Println(cloudfront.ErrCodeTooManyOrigins, aerr.Error())
 			case cloudfront.ErrCodeTooManyCacheBehaviors:
-				fmt.Println(cloudfront.ErrCodeTooManyCacheBehaviors, aerr.Error())
+				output.Println(cloudfront.ErrCodeTooManyCacheBehaviors, aerr.Error())
 			case cloudfront.ErrCodeTooManyCookieNamesInWhiteList:
-				fmt.Println(cloudfront.ErrCodeTooManyCookieNamesInWhiteList, aerr.Error())
+				output.Println(cloudfront.ErrCodeTooManyCookieNamesInWhiteList, aerr.Error())
 			case cloudfront.ErrCodeInvalidForwardCookies:
-				fmt.Println(cloudfront.ErrCodeInvalidForwardCookies, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidForwardCookies, aerr.Error())
 			case cloudfront.ErrCodeTooManyHeadersInForwardedValues:
-				fmt.Println(cloudfront.ErrCodeTooManyHeadersInForwardedValues, aerr.Error())
+				output.Println(cloudfront.ErrCodeTooManyHeadersInForwardedValues, aerr.Error())
 			case cloudfront.ErrCodeInvalidHeadersForS3Origin:
-				fmt.Println(cloudfront.ErrCodeInvalidHeadersForS3Origin, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidHeadersForS3Origin, aerr.Error())
 			case cloudfront.ErrCodeInconsistentQuantities:
-				fmt.Println(cloudfront.ErrCodeInconsistentQuantities, aerr.Error())
+				output.Println(cloudfront.ErrCodeInconsistentQuantities, aerr.Error())
 			case cloudfront.ErrCodeTooManyCertificates:
-				fmt.Println(cloudfront.ErrCodeTooManyCertificates, aerr.Error())
+				output.Println(cloudfront.ErrCodeTooManyCertificates, aerr.Error())
 			case cloudfront.ErrCodeInvalidLocationCode:
-				fmt.Println(cloudfront.ErrCodeInvalidLocationCode, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidLocationCode, aerr.Error())
 			case cloudfront.ErrCodeInvalidGeoRestrictionParameter:
-				fmt.Println(cloudfront.ErrCodeInvalidGeoRestrictionParameter, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidGeoRestrictionParameter, aerr.Error())
 			case cloudfront.ErrCodeInvalidProtocolSettings:
-				fmt.Println(cloudfront.ErrCodeInvalidProtocolSettings, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidProtocolSettings, aerr.Error())
 			case cloudfront.ErrCodeInvalidTTLOrder:
-				fmt.Println(cloudfront.ErrCodeInvalidTTLOrder, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidTTLOrder, aerr.Error())
 			case cloudfront.ErrCodeInvalidWebACLId:
-				fmt.Println(cloudfront.ErrCodeInvalidWebACLId, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidWebACLId, aerr.Error())
 			case cloudfront.ErrCodeTooManyOriginCustomHeaders:
-				fmt.Println(cloudfront.ErrCodeTooManyOriginCustomHeaders, aerr.Error())
+				output.Println(cloudfront.ErrCodeTooManyOriginCustomHeaders, aerr.Error())
 			case cloudfront.ErrCodeTooManyQueryStringParameters:
-				fmt.Println(cloudfront.ErrCodeTooManyQueryStringParameters, aerr.Error())
+				output.Println(cloudfront.ErrCodeTooManyQueryStringParameters, aerr.Error())
 			case cloudfront.ErrCodeInvalidQueryStringParameters:
-				fmt.Println(cloudfront.ErrCodeInvalidQueryStringParameters, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidQueryStringParameters, aerr.Error())
 			case cloudfront.ErrCodeTooManyDistributionsWithLambdaAssociations:
-				fmt.Println(cloudfront.ErrCodeTooManyDistributionsWithLambdaAssociations, aerr.Error())
+				output.Println(cloudfront.ErrCodeTooManyDistributionsWithLambdaAssociations, aerr.Error())
 			case cloudfront.ErrCodeTooManyLambdaFunctionAssociations:
-				fmt.Println(cloudfront.ErrCodeTooManyLambdaFunctionAssociations, aerr.Error())
+				output.Println(cloudfront.ErrCodeTooManyLambdaFunctionAssociations, aerr.Error())
 			case cloudfront.ErrCodeInvalidLambdaFunctionAssociation:
-				fmt.Println(cloudfront.ErrCodeInvalidLambdaFunctionAssociation, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidLambdaFunctionAssociation, aerr.Error())
 			case cloudfront.ErrCodeInvalidOriginReadTimeout:
-				fmt.Println(cloudfront.ErrCodeInvalidOriginReadTimeout, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidOriginReadTimeout, aerr.Error())
 			case cloudfront.ErrCodeInvalidOriginKeepaliveTimeout:
-				fmt.Println(cloudfront.ErrCodeInvalidOriginKeepaliveTimeout, aerr.Error())
+				output.Println(cloudfront.ErrCodeInvalidOriginKeepaliveTimeout, aerr.Error())
 			default:
-				fmt.Println(aerr.Error())
+				output.Println(aerr.Error())
 			}
 
 		} else {
 			// Print the error, cast err to awserr.Error to get the Code and
 			// Message from an error.
-			fmt.Println(err.Error())
+			output.Println(err.Error())
 		}
-		log.Fatal("Unable to create CloudFront Distribution")
+		return errors.New("Unable to create CloudFront Distribution")
 	}
 
+	dist.Id = aws.StringValue(result.Distribution.Id)
+	dist.DomainName = result.Distribution.DomainName
+	return nil
+}
+
+// Invalidate clears paths from the CloudFront cache so visitors see the
+// newly uploaded files, and returns the invalidation's id.
+func (dist *Distribution) Invalidate(paths []string) (string, error) {
+	svc := cloudfront.New(dist.session)
+	result, err := svc.CreateInvalidation(&cloudfront.CreateInvalidationInput{
+		DistributionId: aws.String(dist.Id),
+		InvalidationBatch: &cloudfront.InvalidationBatch{
+			CallerReference: aws.String(strconv.FormatInt(time.Now().UnixNano(), 10)),
+			Paths: &cloudfront.Paths{
+				Items:    aws.StringSlice(paths),
+				Quantity: aws.Int64(int64(len(paths))),
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to invalidate CloudFront Distribution %q, %v", dist.Id, err)
+	}
+	return aws.StringValue(result.Invalidation.Id), nil
+}
+
+// WaitForInvalidation waits until an invalidation has reached every edge
+// location, so the new files are what visitors get.
+func (dist *Distribution) WaitForInvalidation(id string) error {
+	svc := cloudfront.New(dist.session)
+	err := svc.WaitUntilInvalidationCompleted(&cloudfront.GetInvalidationInput{
+		DistributionId: aws.String(dist.Id),
+		Id:             aws.String(id),
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to wait for invalidation %q of CloudFront Distribution %q, %v", id, dist.Id, err)
+	}
+	return nil
+}
+
+// Domain returns the distribution's cloudfront.net domain name.
+func (dist *Distribution) Domain() (string, error) {
+	if dist.DomainName != nil {
+		return *dist.DomainName, nil
+	}
+	svc := cloudfront.New(dist.session)
+	result, err := svc.GetDistribution(&cloudfront.GetDistributionInput{
+		Id: aws.String(dist.Id),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to read CloudFront Distribution %q, %v", dist.Id, err)
+	}
 	dist.DomainName = result.Distribution.DomainName
+	return aws.StringValue(dist.DomainName), nil
+}
+
+// FindByAlias looks up the distribution serving AliasName, for sites whose
+// distribution was created by an earlier run.
+func (dist *Distribution) FindByAlias() (bool, error) {
+	svc := cloudfront.New(dist.session)
+	err := svc.ListDistributionsPages(&cloudfront.ListDistributionsInput{}, func(page *cloudfront.ListDistributionsOutput, lastPage bool) bool {
+		for _, summary := range page.DistributionList.Items {
+			if summary.Aliases == nil {
+				continue
+			}
+			for _, alias := range summary.Aliases.Items {
+				if aws.StringValue(alias) == dist.AliasName {
+					dist.Id = aws.StringValue(summary.Id)
+					dist.DomainName = summary.DomainName
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return false, fmt.Errorf("Unable to list CloudFront Distributions, %v", err)
+	}
+	return dist.Id != "", nil
+}
+
+// updateConfig applies change to the distribution's current config and saves
+// it. Nothing is saved when change reports that the config is already right.
+func (dist *Distribution) updateConfig(change func(config *cloudfront.DistributionConfig) bool) error {
+	svc := cloudfront.New(dist.session)
+	current, err := svc.GetDistributionConfig(&cloudfront.GetDistributionConfigInput{
+		Id: aws.String(dist.Id),
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to read CloudFront Distribution %q, %v", dist.Id, err)
+	}
+
+	if !change(current.DistributionConfig) {
+		return nil
+	}
+
+	_, err = svc.UpdateDistribution(&cloudfront.UpdateDistributionInput{
+		Id:                 aws.String(dist.Id),
+		IfMatch:            current.ETag,
+		DistributionConfig: current.DistributionConfig,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to update CloudFront Distribution %q, %v", dist.Id, err)
+	}
+	return nil
+}
+
+// ResourceName derives the name of a function or policy created for this
+// distribution. Names may only contain letters, digits, hyphens and
+// underscores.
+func (dist *Distribution) ResourceName(purpose string) string {
+	name := []rune("hugo-s3-deploy-" + purpose + "-" + dist.AliasName)
+	for i, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			name[i] = '-'
+		}
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return string(name)
+}
+
+// publishFunction creates or updates the named CloudFront Function with code
+// and publishes it, returning its ARN.
+func (dist *Distribution) publishFunction(name string, comment string, code string) (*string, error) {
+	svc := cloudfront.New(dist.session)
+	functionConfig := &cloudfront.FunctionConfig{
+		Comment: aws.String(comment),
+		Runtime: aws.String(cloudfront.FunctionRuntimeCloudfrontJs20),
+	}
+
+	var etag *string
+	described, err := svc.DescribeFunction(&cloudfront.DescribeFunctionInput{
+		Name:  aws.String(name),
+		Stage: aws.String(cloudfront.FunctionStageDevelopment),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudfront.ErrCodeNoSuchFunctionExists {
+		created, err := svc.CreateFunction(&cloudfront.CreateFunctionInput{
+			Name:           aws.String(name),
+			FunctionCode:   []byte(code),
+			FunctionConfig: functionConfig,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create CloudFront Function %q, %v", name, err)
+		}
+		etag = created.ETag
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to read CloudFront Function %q, %v", name, err)
+	} else {
+		updated, err := svc.UpdateFunction(&cloudfront.UpdateFunctionInput{
+			Name:           aws.String(name),
+			IfMatch:        described.ETag,
+			FunctionCode:   []byte(code),
+			FunctionConfig: functionConfig,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to update CloudFront Function %q, %v", name, err)
+		}
+		etag = updated.ETag
+	}
+
+	published, err := svc.PublishFunction(&cloudfront.PublishFunctionInput{
+		Name:    aws.String(name),
+		IfMatch: etag,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to publish CloudFront Function %q, %v", name, err)
+	}
+	return published.FunctionSummary.FunctionMetadata.FunctionARN, nil
+}
+
+// SetViewerRequestFunction publishes code as the viewer request function of
+// the default cache behavior. Passing empty code detaches a function that an
+// earlier run attached for the same purpose. A behavior runs only one
+// function on viewer request, so one attached by anything else is an error
+// rather than being replaced.
+func (dist *Distribution) SetViewerRequestFunction(purpose string, code string) error {
+	name := dist.ResourceName(purpose)
+
+	var arn *string
+	if code != "" {
+		var err error
+		arn, err = dist.publishFunction(name, "Generated by hugo-s3-deploy for "+dist.AliasName, code)
+		if err != nil {
+			return err
+		}
+	}
+
+	var foreign error
+	err := dist.updateConfig(func(config *cloudfront.DistributionConfig) bool {
+		behavior := config.DefaultCacheBehavior
+		if arn != nil && behavior.LambdaFunctionAssociations != nil {
+			for _, association := range behavior.LambdaFunctionAssociations.Items {
+				if aws.StringValue(association.EventType) == cloudfront.EventTypeViewerRequest {
+					foreign = fmt.Errorf("CloudFront Distribution %q already runs Lambda@Edge function %s on viewer request, so %s can't be attached", dist.Id, aws.StringValue(association.LambdaFunctionARN), name)
+					return false
+				}
+			}
+		}
+		associations := []*cloudfront.FunctionAssociation{}
+		changed := false
+		if behavior.FunctionAssociations != nil {
+			for _, association := range behavior.FunctionAssociations.Items {
+				current := aws.StringValue(association.FunctionARN)
+				if aws.StringValue(association.EventType) != cloudfront.EventTypeViewerRequest {
+					associations = append(associations, association)
+					continue
+				}
+				if !strings.HasSuffix(current, ":function/"+name) {
+					if arn != nil {
+						foreign = fmt.Errorf("CloudFront Distribution %q already runs CloudFront Function %s on viewer request, so %s can't be attached", dist.Id, current, name)
+						return false
+					}
+					associations = append(associations, association)
+					continue
+				}
+				if arn != nil && current == aws.StringValue(arn) {
+					return false
+				}
+				changed = true
+			}
+		}
+		if arn != nil {
+			associations = append(associations, &cloudfront.FunctionAssociation{
+				EventType:   aws.String(cloudfront.EventTypeViewerRequest),
+				FunctionARN: arn,
+			})
+			changed = true
+		}
+		if !changed {
+			return false
+		}
+
+		behavior.FunctionAssociations = &cloudfront.FunctionAssociations{
+			Items:    associations,
+			Quantity: aws.Int64(int64(len(associations))),
+		}
+		return true
+	})
+	if foreign != nil {
+		return foreign
+	}
+	return err
+}
+
+// SetOriginResponseFunction runs the Lambda@Edge function version arn on
+// origin responses of the default cache behavior. An empty arn detaches the
+// version of the named function an earlier run attached. A function attached
+// by anything else is an error rather than being replaced.
+func (dist *Distribution) SetOriginResponseFunction(name string, arn string) error {
+	var foreign error
+	err := dist.updateConfig(func(config *cloudfront.DistributionConfig) bool {
+		behavior := config.DefaultCacheBehavior
+		associations := []*cloudfront.LambdaFunctionAssociation{}
+		changed := false
+		if behavior.LambdaFunctionAssociations != nil {
+			for _, association := range behavior.LambdaFunctionAssociations.Items {
+				current := aws.StringValue(association.LambdaFunctionARN)
+				if aws.StringValue(association.EventType) != cloudfront.EventTypeOriginResponse {
+					associations = append(associations, association)
+					continue
+				}
+				if !strings.Contains(current, ":function:"+name+":") {
+					if arn != "" {
+						foreign = fmt.Errorf("CloudFront Distribution %q already runs Lambda@Edge function %s on origin response, so %s can't be attached", dist.Id, current, name)
+						return false
+					}
+					associations = append(associations, association)
+					continue
+				}
+				if current == arn {
+					return false
+				}
+				changed = true
+			}
+		}
+		if arn != "" {
+			associations = append(associations, &cloudfront.LambdaFunctionAssociation{
+				EventType:         aws.String(cloudfront.EventTypeOriginResponse),
+				LambdaFunctionARN: aws.String(arn),
+				IncludeBody:       aws.Bool(false),
+			})
+			changed = true
+		}
+		if !changed {
+			return false
+		}
+
+		behavior.LambdaFunctionAssociations = &cloudfront.LambdaFunctionAssociations{
+			Items:    associations,
+			Quantity: aws.Int64(int64(len(associations))),
+		}
+		return true
+	})
+	if foreign != nil {
+		return foreign
+	}
+	return err
+}
+
+// RemoveErrorResponses removes the error responses for errorCodes, for
+// error pages that are served another way.
+func (dist *Distribution) RemoveErrorResponses(errorCodes []int) error {
+	return dist.updateConfig(func(config *cloudfront.DistributionConfig) bool {
+		if config.CustomErrorResponses == nil {
+			return false
+		}
+		removed := map[int64]bool{}
+		for _, code := range errorCodes {
+			removed[int64(code)] = true
+		}
+		items := []*cloudfront.CustomErrorResponse{}
+		for _, item := range config.CustomErrorResponses.Items {
+			if !removed[aws.Int64Value(item.ErrorCode)] {
+				items = append(items, item)
+			}
+		}
+		if len(items) == len(config.CustomErrorResponses.Items) {
+			return false
+		}
+		config.CustomErrorResponses = &cloudfront.CustomErrorResponses{
+			Items:    items,
+			Quantity: aws.Int64(int64(len(items))),
+		}
+		return true
+	})
+}
+
+// SetErrorResponses serves pagePath with responseCode whenever the origin
+// fails with one of errorCodes, caching the error for cachingTTL seconds.
+// Error responses for other codes are left alone.
+func (dist *Distribution) SetErrorResponses(pagePath string, responseCode int, cachingTTL int64, errorCodes []int) error {
+	return dist.updateConfig(func(config *cloudfront.DistributionConfig) bool {
+		before := config.String()
+
+		configured := map[int64]bool{}
+		for _, code := range errorCodes {
+			configured[int64(code)] = true
+		}
+
+		items := []*cloudfront.CustomErrorResponse{}
+		if config.CustomErrorResponses != nil {
+			for _, item := range config.CustomErrorResponses.Items {
+				if !configured[aws.Int64Value(item.ErrorCode)] {
+					items = append(items, item)
+				}
+			}
+		}
+		for _, code := range errorCodes {
+			items = append(items, &cloudfront.CustomErrorResponse{
+				ErrorCode:          aws.Int64(int64(code)),
+				ResponsePagePath:   aws.String(pagePath),
+				ResponseCode:       aws.String(strconv.Itoa(responseCode)),
+				ErrorCachingMinTTL: aws.Int64(cachingTTL),
+			})
+		}
+		config.CustomErrorResponses = &cloudfront.CustomErrorResponses{
+			Items:    items,
+			Quantity: aws.Int64(int64(len(items))),
+		}
+
+		return config.String() != before
+	})
+}
+
+// OriginPath returns the path the distribution's S3 origin serves from,
+// relative to the site's root.
+func (dist *Distribution) OriginPath() (string, error) {
+	svc := cloudfront.New(dist.session)
+	current, err := svc.GetDistributionConfig(&cloudfront.GetDistributionConfigInput{
+		Id: aws.String(dist.Id),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to read CloudFront Distribution %q, %v", dist.Id, err)
+	}
+	origin := defaultOrigin(current.DistributionConfig)
+	if origin == nil {
+		return "", nil
+	}
+	return strings.TrimPrefix(aws.StringValue(origin.OriginPath), dist.originPath("")), nil
+}
+
+// SetOriginPath points the distribution's S3 origin at path under the site's
+// root, so switching the live site to another upload is a single
+// distribution update.
+func (dist *Distribution) SetOriginPath(path string) error {
+	path = dist.originPath(path)
+	var missing error
+	err := dist.updateConfig(func(config *cloudfront.DistributionConfig) bool {
+		origin := defaultOrigin(config)
+		if origin == nil {
+			missing = fmt.Errorf("CloudFront Distribution %q has no origin for its default cache behavior", dist.Id)
+			return false
+		}
+		if aws.StringValue(origin.OriginPath) == path {
+			return false
+		}
+		origin.OriginPath = aws.String(path)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return missing
+}
+
+// defaultOrigin returns the origin the default cache behavior serves from.
+func defaultOrigin(config *cloudfront.DistributionConfig) *cloudfront.Origin {
+	target := aws.StringValue(config.DefaultCacheBehavior.TargetOriginId)
+	for _, origin := range config.Origins.Items {
+		if aws.StringValue(origin.Id) == target {
+			return origin
+		}
+	}
+	return nil
 }
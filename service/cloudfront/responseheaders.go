@@ -0,0 +1,322 @@
+package cloudfront
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/mitchdennett/hugo-s3-deploy/headers"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+)
+
+// SetResponseHeaders compiles the headers into Response Headers Policies and
+// attaches them to the default cache behavior and to a cache behavior per
+// path. Policies are named after the path they serve, so an edited _headers
+// file updates the existing policy in place.
+func (dist *Distribution) SetResponseHeaders(defaults []headers.Header, paths []*headers.Rule) error {
+	prefix := dist.ResourceName("headers")
+	existing, err := dist.listHeadersPolicies(prefix)
+	if err != nil {
+		return err
+	}
+
+	managed := map[string]bool{}
+	for _, id := range existing {
+		managed[id] = true
+	}
+
+	var defaultId *string
+	if len(defaults) > 0 {
+		defaultId, err = dist.putHeadersPolicy(dist.headersPolicyName("/*"), defaults, existing)
+		if err != nil {
+			return err
+		}
+		managed[*defaultId] = true
+	}
+
+	behaviors := []*cloudfront.CacheBehavior{}
+	used := map[string]bool{aws.StringValue(defaultId): true}
+	for _, rule := range paths {
+		id, err := dist.putHeadersPolicy(dist.headersPolicyName(rule.Path), rule.Headers, existing)
+		if err != nil {
+			return err
+		}
+		managed[*id] = true
+		used[*id] = true
+		behaviors = append(behaviors, &cloudfront.CacheBehavior{PathPattern: aws.String(rule.PathPattern()), ResponseHeadersPolicyId: id})
+	}
+
+	err = dist.updateConfig(func(config *cloudfront.DistributionConfig) bool {
+		before := config.String()
+
+		defaultBehavior := config.DefaultCacheBehavior
+		if defaultId != nil || managed[aws.StringValue(defaultBehavior.ResponseHeadersPolicyId)] {
+			defaultBehavior.ResponseHeadersPolicyId = defaultId
+		}
+
+		// Keep behaviors created by hand or by other tools, and rebuild the
+		// ones this tool manages from the current rules.
+		items := []*cloudfront.CacheBehavior{}
+		if config.CacheBehaviors != nil {
+			for _, behavior := range config.CacheBehaviors.Items {
+				if !managed[aws.StringValue(behavior.ResponseHeadersPolicyId)] {
+					items = append(items, behavior)
+				}
+			}
+		}
+		for _, behavior := range behaviors {
+			behavior.TargetOriginId = defaultBehavior.TargetOriginId
+			behavior.ViewerProtocolPolicy = defaultBehavior.ViewerProtocolPolicy
+			behavior.ForwardedValues = defaultBehavior.ForwardedValues
+			behavior.CachePolicyId = defaultBehavior.CachePolicyId
+			behavior.MinTTL = defaultBehavior.MinTTL
+			behavior.TrustedSigners = defaultBehavior.TrustedSigners
+			behavior.AllowedMethods = defaultBehavior.AllowedMethods
+			behavior.Compress = defaultBehavior.Compress
+			behavior.FunctionAssociations = defaultBehavior.FunctionAssociations
+			behavior.LambdaFunctionAssociations = defaultBehavior.LambdaFunctionAssociations
+			items = append(items, behavior)
+		}
+		config.CacheBehaviors = &cloudfront.CacheBehaviors{
+			Items:    items,
+			Quantity: aws.Int64(int64(len(items))),
+		}
+
+		return config.String() != before
+	})
+	if err != nil {
+		return err
+	}
+
+	// Remove policies for paths that are no longer in the rules. CloudFront
+	// refuses while the distribution update is still rolling out, in which
+	// case the next deploy cleans them up.
+	svc := cloudfront.New(dist.session)
+	for name, id := range existing {
+		if used[id] {
+			continue
+		}
+		current, err := svc.GetResponseHeadersPolicy(&cloudfront.GetResponseHeadersPolicyInput{Id: aws.String(id)})
+		if err == nil {
+			_, err = svc.DeleteResponseHeadersPolicy(&cloudfront.DeleteResponseHeadersPolicyInput{
+				Id:      aws.String(id),
+				IfMatch: current.ETag,
+			})
+		}
+		if err != nil {
+			output.Println("Unable to remove unused Response Headers Policy", name, err)
+		}
+	}
+	return nil
+}
+
+// headersPolicyName names a policy after the path it serves. Paths are hashed
+// because they may contain characters a policy name can't.
+func (dist *Distribution) headersPolicyName(path string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(path))
+	return dist.ResourceName("headers") + "-" + fmt.Sprintf("%08x", hash.Sum32())
+}
+
+// listHeadersPolicies returns the ids of custom Response Headers Policies
+// whose names start with prefix, keyed by name.
+func (dist *Distribution) listHeadersPolicies(prefix string) (map[string]string, error) {
+	svc := cloudfront.New(dist.session)
+	policies := map[string]string{}
+	input := &cloudfront.ListResponseHeadersPoliciesInput{
+		Type: aws.String(cloudfront.ResponseHeadersPolicyTypeCustom),
+	}
+	for {
+		result, err := svc.ListResponseHeadersPolicies(input)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list Response Headers Policies, %v", err)
+		}
+		for _, summary := range result.ResponseHeadersPolicyList.Items {
+			name := aws.StringValue(summary.ResponseHeadersPolicy.ResponseHeadersPolicyConfig.Name)
+			if strings.HasPrefix(name, prefix+"-") && len(name) == len(prefix)+9 {
+				policies[name] = aws.StringValue(summary.ResponseHeadersPolicy.Id)
+			}
+		}
+		if result.ResponseHeadersPolicyList.NextMarker == nil {
+			return policies, nil
+		}
+		input.Marker = result.ResponseHeadersPolicyList.NextMarker
+	}
+}
+
+// putHeadersPolicy creates the named policy, or updates it when it already
+// exists and its headers have changed, and returns its id.
+func (dist *Distribution) putHeadersPolicy(name string, values []headers.Header, existing map[string]string) (*string, error) {
+	svc := cloudfront.New(dist.session)
+	config, err := headersPolicyConfig(name, values)
+	if err != nil {
+		return nil, err
+	}
+	config.Comment = aws.String("Generated by hugo-s3-deploy for " + dist.AliasName)
+
+	id, ok := existing[name]
+	if !ok {
+		result, err := svc.CreateResponseHeadersPolicy(&cloudfront.CreateResponseHeadersPolicyInput{
+			ResponseHeadersPolicyConfig: config,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create Response Headers Policy %q, %v", name, err)
+		}
+		return result.ResponseHeadersPolicy.Id, nil
+	}
+
+	current, err := svc.GetResponseHeadersPolicyConfig(&cloudfront.GetResponseHeadersPolicyConfigInput{
+		Id: aws.String(id),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read Response Headers Policy %q, %v", name, err)
+	}
+	if current.ResponseHeadersPolicyConfig.String() == config.String() {
+		return aws.String(id), nil
+	}
+
+	_, err = svc.UpdateResponseHeadersPolicy(&cloudfront.UpdateResponseHeadersPolicyInput{
+		Id:                          aws.String(id),
+		IfMatch:                     current.ETag,
+		ResponseHeadersPolicyConfig: config,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to update Response Headers Policy %q, %v", name, err)
+	}
+	return aws.String(id), nil
+}
+
+// headersPolicyConfig maps headers onto a policy. The security headers
+// CloudFront knows about must be set through SecurityHeadersConfig; anything
+// else is sent as a custom header.
+func headersPolicyConfig(name string, values []headers.Header) (*cloudfront.ResponseHeadersPolicyConfig, error) {
+	security := &cloudfront.ResponseHeadersPolicySecurityHeadersConfig{}
+	custom := []*cloudfront.ResponseHeadersPolicyCustomHeader{}
+
+	for _, header := range values {
+		value := header.Value
+		switch strings.ToLower(header.Name) {
+		case "content-security-policy":
+			security.ContentSecurityPolicy = &cloudfront.ResponseHeadersPolicyContentSecurityPolicy{
+				ContentSecurityPolicy: aws.String(value),
+				Override:              aws.Bool(true),
+			}
+		case "strict-transport-security":
+			hsts, err := strictTransportSecurity(value)
+			if err != nil {
+				return nil, err
+			}
+			security.StrictTransportSecurity = hsts
+		case "x-frame-options":
+			option := strings.ToUpper(value)
+			if option != cloudfront.FrameOptionsListDeny && option != cloudfront.FrameOptionsListSameorigin {
+				return nil, fmt.Errorf("X-Frame-Options must be DENY or SAMEORIGIN, got %q", value)
+			}
+			security.FrameOptions = &cloudfront.ResponseHeadersPolicyFrameOptions{
+				FrameOption: aws.String(option),
+				Override:    aws.Bool(true),
+			}
+		case "referrer-policy":
+			policy := strings.ToLower(value)
+			valid := false
+			for _, allowed := range cloudfront.ReferrerPolicyList_Values() {
+				valid = valid || policy == allowed
+			}
+			if !valid {
+				return nil, fmt.Errorf("Referrer-Policy %q is not supported by CloudFront", value)
+			}
+			security.ReferrerPolicy = &cloudfront.ResponseHeadersPolicyReferrerPolicy{
+				ReferrerPolicy: aws.String(policy),
+				Override:       aws.Bool(true),
+			}
+		case "x-content-type-options":
+			if !strings.EqualFold(value, "nosniff") {
+				return nil, fmt.Errorf("X-Content-Type-Options must be nosniff, got %q", value)
+			}
+			security.ContentTypeOptions = &cloudfront.ResponseHeadersPolicyContentTypeOptions{
+				Override: aws.Bool(true),
+			}
+		case "x-xss-protection":
+			protection, err := xssProtection(value)
+			if err != nil {
+				return nil, err
+			}
+			security.XSSProtection = protection
+		default:
+			custom = append(custom, &cloudfront.ResponseHeadersPolicyCustomHeader{
+				Header:   aws.String(header.Name),
+				Value:    aws.String(value),
+				Override: aws.Bool(true),
+			})
+		}
+	}
+
+	config := &cloudfront.ResponseHeadersPolicyConfig{
+		Name: aws.String(name),
+	}
+	if security.String() != (&cloudfront.ResponseHeadersPolicySecurityHeadersConfig{}).String() {
+		config.SecurityHeadersConfig = security
+	}
+	if len(custom) > 0 {
+		config.CustomHeadersConfig = &cloudfront.ResponseHeadersPolicyCustomHeadersConfig{
+			Items:    custom,
+			Quantity: aws.Int64(int64(len(custom))),
+		}
+	}
+	return config, nil
+}
+
+// strictTransportSecurity parses a value like
+// "max-age=63072000; includeSubDomains; preload".
+func strictTransportSecurity(value string) (*cloudfront.ResponseHeadersPolicyStrictTransportSecurity, error) {
+	hsts := &cloudfront.ResponseHeadersPolicyStrictTransportSecurity{Override: aws.Bool(true)}
+	for _, directive := range strings.Split(value, ";") {
+		directive = strings.TrimSpace(directive)
+		switch lower := strings.ToLower(directive); {
+		case strings.HasPrefix(lower, "max-age="):
+			maxAge, err := strconv.ParseInt(strings.TrimPrefix(lower, "max-age="), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Strict-Transport-Security max-age in %q", value)
+			}
+			hsts.AccessControlMaxAgeSec = aws.Int64(maxAge)
+		case lower == "includesubdomains":
+			hsts.IncludeSubdomains = aws.Bool(true)
+		case lower == "preload":
+			hsts.Preload = aws.Bool(true)
+		case lower == "":
+		default:
+			return nil, fmt.Errorf("unknown Strict-Transport-Security directive %q", directive)
+		}
+	}
+	if hsts.AccessControlMaxAgeSec == nil {
+		return nil, fmt.Errorf("Strict-Transport-Security %q has no max-age", value)
+	}
+	return hsts, nil
+}
+
+// xssProtection parses a value like "1; mode=block" or "0".
+func xssProtection(value string) (*cloudfront.ResponseHeadersPolicyXSSProtection, error) {
+	parts := strings.Split(value, ";")
+	protection := &cloudfront.ResponseHeadersPolicyXSSProtection{
+		Override:   aws.Bool(true),
+		Protection: aws.Bool(strings.TrimSpace(parts[0]) == "1"),
+	}
+	if first := strings.TrimSpace(parts[0]); first != "0" && first != "1" {
+		return nil, fmt.Errorf("X-XSS-Protection must start with 0 or 1, got %q", value)
+	}
+	for _, directive := range parts[1:] {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case strings.EqualFold(directive, "mode=block"):
+			protection.ModeBlock = aws.Bool(true)
+		case strings.HasPrefix(strings.ToLower(directive), "report="):
+			protection.ReportUri = aws.String(directive[len("report="):])
+		default:
+			return nil, fmt.Errorf("unknown X-XSS-Protection directive %q", directive)
+		}
+	}
+	return protection, nil
+}
@@ -0,0 +1,88 @@
+package cloudfront
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/mitchdennett/hugo-s3-deploy/headers"
+)
+
+func TestHeadersPolicyConfig(t *testing.T) {
+	config, err := headersPolicyConfig("policy", []headers.Header{
+		{Name: "Content-Security-Policy", Value: "default-src 'self'"},
+		{Name: "Strict-Transport-Security", Value: "max-age=63072000; includeSubDomains; preload"},
+		{Name: "X-Frame-Options", Value: "sameorigin"},
+		{Name: "Referrer-Policy", Value: "Strict-Origin-When-Cross-Origin"},
+		{Name: "X-Content-Type-Options", Value: "nosniff"},
+		{Name: "X-XSS-Protection", Value: "1; mode=block"},
+		{Name: "Permissions-Policy", Value: "camera=()"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	security := config.SecurityHeadersConfig
+	if got := aws.StringValue(security.ContentSecurityPolicy.ContentSecurityPolicy); got != "default-src 'self'" {
+		t.Errorf("Content-Security-Policy = %q", got)
+	}
+	hsts := security.StrictTransportSecurity
+	if aws.Int64Value(hsts.AccessControlMaxAgeSec) != 63072000 || !aws.BoolValue(hsts.IncludeSubdomains) || !aws.BoolValue(hsts.Preload) {
+		t.Errorf("Strict-Transport-Security = %s", hsts)
+	}
+	if got := aws.StringValue(security.FrameOptions.FrameOption); got != "SAMEORIGIN" {
+		t.Errorf("X-Frame-Options = %q", got)
+	}
+	if got := aws.StringValue(security.ReferrerPolicy.ReferrerPolicy); got != "strict-origin-when-cross-origin" {
+		t.Errorf("Referrer-Policy = %q", got)
+	}
+	if security.ContentTypeOptions == nil {
+		t.Error("X-Content-Type-Options wasn't set")
+	}
+	if !aws.BoolValue(security.XSSProtection.Protection) || !aws.BoolValue(security.XSSProtection.ModeBlock) {
+		t.Errorf("X-XSS-Protection = %s", security.XSSProtection)
+	}
+	custom := config.CustomHeadersConfig
+	if aws.Int64Value(custom.Quantity) != 1 || aws.StringValue(custom.Items[0].Header) != "Permissions-Policy" || aws.StringValue(custom.Items[0].Value) != "camera=()" {
+		t.Errorf("custom headers = %s", custom)
+	}
+
+	config, err = headersPolicyConfig("custom", []headers.Header{{Name: "X-A", Value: "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SecurityHeadersConfig != nil {
+		t.Errorf("a policy without security headers has SecurityHeadersConfig %s", config.SecurityHeadersConfig)
+	}
+}
+
+func TestHeadersPolicyConfigErrors(t *testing.T) {
+	tests := []struct {
+		header headers.Header
+		err    string
+	}{
+		{headers.Header{Name: "X-Frame-Options", Value: "ALLOW-FROM x"}, "must be DENY or SAMEORIGIN"},
+		{headers.Header{Name: "Referrer-Policy", Value: "sometimes"}, "not supported"},
+		{headers.Header{Name: "X-Content-Type-Options", Value: "sniff"}, "must be nosniff"},
+		{headers.Header{Name: "Strict-Transport-Security", Value: "includeSubDomains"}, "has no max-age"},
+		{headers.Header{Name: "Strict-Transport-Security", Value: "max-age=x"}, "invalid Strict-Transport-Security max-age"},
+		{headers.Header{Name: "Strict-Transport-Security", Value: "max-age=1; forever"}, "unknown Strict-Transport-Security directive"},
+		{headers.Header{Name: "X-XSS-Protection", Value: "2"}, "must start with 0 or 1"},
+		{headers.Header{Name: "X-XSS-Protection", Value: "1; mode=allow"}, "unknown X-XSS-Protection directive"},
+	}
+	for _, test := range tests {
+		_, err := headersPolicyConfig("policy", []headers.Header{test.header})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: %s error = %v, want %q", test.header.Name, test.header.Value, err, test.err)
+		}
+	}
+}
+
+func TestXSSProtectionReport(t *testing.T) {
+	protection, err := xssProtection("1; report=https://example.com/r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := aws.StringValue(protection.ReportUri); got != "https://example.com/r" {
+		t.Errorf("ReportUri = %q", got)
+	}
+}
@@ -0,0 +1,133 @@
+package lambda
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/mitchdennett/hugo-s3-deploy/service/storage"
+)
+
+type errorPagesConfig struct {
+	Codes       []int       `json:"codes"`
+	Status      int         `json:"status"`
+	Description string      `json:"description"`
+	TTL         int64       `json:"ttl"`
+	Page        string      `json:"page"`
+	Languages   [][2]string `json:"languages"`
+}
+
+// ErrorPagesCode generates an origin-response function that answers the
+// origin's errors with the error document, or with a language's own page
+// for keys under the language's directory. The page is fetched from the
+// same origin and served with status, rather than redirecting to it, so
+// visitors and crawlers still see an error. Errors are cached for ttl
+// seconds.
+func ErrorPagesCode(document *storage.ErrorDocument, status int, ttl int64) (string, error) {
+	config := errorPagesConfig{
+		Codes:       document.Codes,
+		Status:      status,
+		Description: http.StatusText(status),
+		TTL:         ttl,
+		Page:        document.Key,
+		Languages:   [][2]string{},
+	}
+	for _, lang := range document.Languages {
+		config.Languages = append(config.Languages, [2]string{lang + "/", document.LanguageKey(lang)})
+	}
+	// Longer prefixes first, so pt-br/ wins over pt/.
+	sort.SliceStable(config.Languages, func(i, j int) bool {
+		return len(config.Languages[i][0]) > len(config.Languages[j][0])
+	})
+
+	dat, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	var code bytes.Buffer
+	code.WriteString("// Generated by hugo-s3-deploy from [errors]. Do not edit.\n")
+	code.WriteString("'use strict';\n")
+	code.WriteString("const config = " + string(dat) + ";\n")
+	code.WriteString(errorPagesBody)
+	return code.String(), nil
+}
+
+const errorPagesBody = `
+const http = require('http');
+const https = require('https');
+const zlib = require('zlib');
+
+exports.handler = async (event) => {
+  const cf = event.Records[0].cf;
+  const response = cf.response;
+  const origin = cf.request.origin && cf.request.origin.custom;
+  if (!origin || config.codes.indexOf(Number(response.status)) === -1) {
+    return response;
+  }
+
+  const uri = cf.request.uri.replace(/^\/+/, '');
+  let page = config.page;
+  for (const [prefix, key] of config.languages) {
+    if (uri.startsWith(prefix)) {
+      page = key;
+      break;
+    }
+  }
+
+  let fetched;
+  try {
+    fetched = await fetchPage(origin, page);
+  } catch (err) {
+    console.log('Unable to fetch ' + page + ': ' + err.message);
+    return response;
+  }
+  response.status = String(config.status);
+  response.statusDescription = config.description;
+  response.body = fetched.body;
+  response.bodyEncoding = 'text';
+  for (const name of ['content-encoding', 'content-length', 'etag', 'last-modified']) {
+    delete response.headers[name];
+  }
+  response.headers['content-type'] = [{ key: 'Content-Type', value: fetched.type || 'text/html; charset=utf-8' }];
+  response.headers['cache-control'] = [{ key: 'Cache-Control', value: 'max-age=' + config.ttl }];
+  return response;
+};
+
+function fetchPage(origin, key) {
+  const client = origin.protocol === 'https' ? https : http;
+  return new Promise((resolve, reject) => {
+    const request = client.get({
+      host: origin.domainName,
+      port: origin.port,
+      path: (origin.path || '') + '/' + key.split('/').map(encodeURIComponent).join('/'),
+      timeout: 3000,
+    }, (res) => {
+      if (res.statusCode !== 200) {
+        res.resume();
+        reject(new Error('status ' + res.statusCode));
+        return;
+      }
+      const chunks = [];
+      res.on('data', (chunk) => chunks.push(chunk));
+      res.on('error', reject);
+      res.on('end', () => {
+        try {
+          let body = Buffer.concat(chunks);
+          const encoding = res.headers['content-encoding'];
+          if (encoding === 'gzip') {
+            body = zlib.gunzipSync(body);
+          } else if (encoding === 'br') {
+            body = zlib.brotliDecompressSync(body);
+          }
+          resolve({ body: body.toString('utf8'), type: res.headers['content-type'] });
+        } catch (err) {
+          reject(err);
+        }
+      });
+    });
+    request.on('timeout', () => request.destroy(new Error('timed out')));
+    request.on('error', reject);
+  });
+}
+`
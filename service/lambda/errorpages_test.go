@@ -0,0 +1,134 @@
+package lambda
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mitchdennett/hugo-s3-deploy/service/storage"
+)
+
+var document = &storage.ErrorDocument{
+	Key:       "404.html",
+	Codes:     []int{403, 404},
+	Languages: []string{"pt", "pt-br"},
+	LanguageKey: func(lang string) string {
+		return lang + "/404.html"
+	},
+}
+
+func TestErrorPagesCode(t *testing.T) {
+	code, err := ErrorPagesCode(document, 404, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"codes":[403,404]`,
+		`"status":404`,
+		`"description":"Not Found"`,
+		`"page":"404.html"`,
+		// Longer prefixes first, so pt-br/ wins over pt/.
+		`"languages":[["pt-br/","pt-br/404.html"],["pt/","pt/404.html"]]`,
+		"exports.handler",
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("ErrorPagesCode is missing %s:\n%s", want, code)
+		}
+	}
+}
+
+// TestErrorPagesHandler runs the generated function with node against an
+// origin serving the error pages.
+func TestErrorPagesHandler(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node isn't installed")
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/site/404.html", "/site/pt-br/404.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("page " + r.URL.Path))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+	host, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := ErrorPagesCode(document, 404, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.js"), []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		uri    string
+		status string
+		body   string
+	}{
+		{uri: "/missing", status: "404", body: "page /site/404.html"},
+		{uri: "/pt-br/missing", status: "404", body: "page /site/pt-br/404.html"},
+		// The pt page is missing, so the origin's response is kept.
+		{uri: "/pt/missing", status: "403"},
+		{uri: "/ok", status: "200"},
+	}
+	for _, test := range tests {
+		status := "403"
+		if test.uri == "/ok" {
+			status = "200"
+		}
+		event, _ := json.Marshal(map[string]interface{}{
+			"Records": []interface{}{map[string]interface{}{"cf": map[string]interface{}{
+				"request": map[string]interface{}{
+					"uri": test.uri,
+					"origin": map[string]interface{}{"custom": map[string]interface{}{
+						"domainName": host.Hostname(),
+						"port":       host.Port(),
+						"protocol":   "http",
+						"path":       "/site",
+					}},
+				},
+				"response": map[string]interface{}{
+					"status":  status,
+					"headers": map[string]interface{}{"etag": []interface{}{map[string]string{"key": "ETag", "value": "x"}}},
+				},
+			}}},
+		})
+		script := "require('./index.js').handler(" + string(event) + ").then((r) => console.log(JSON.stringify(r)))"
+		cmd := exec.Command(node, "-e", script)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %v", test.uri, err)
+		}
+		var response struct {
+			Status  string
+			Body    string
+			Headers map[string]interface{}
+		}
+		// The function logs failed fetches before the response is printed.
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &response); err != nil {
+			t.Fatalf("%s: %v in %s", test.uri, err, out)
+		}
+		if response.Status != test.status || response.Body != test.body {
+			t.Errorf("%s = %s %q, want %s %q", test.uri, response.Status, response.Body, test.status, test.body)
+		}
+		if test.body != "" && response.Headers["etag"] != nil {
+			t.Errorf("%s kept the origin's ETag", test.uri)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Package lambda publishes Lambda@Edge functions, for the work CloudFront
+// Functions can't do because it needs the origin's response.
+package lambda
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// assumeRolePolicy lets Lambda and its replicas at the edge run a function.
+const assumeRolePolicy = `{
+  "Version": "2012-10-17",
+  "Statement": [{
+    "Effect": "Allow",
+    "Principal": {"Service": ["lambda.amazonaws.com", "edgelambda.amazonaws.com"]},
+    "Action": "sts:AssumeRole"
+  }]
+}`
+
+const executionPolicyArn = "arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"
+
+// EdgeFunction is a Lambda@Edge function. Its role is named after it.
+type EdgeFunction struct {
+	Name    string
+	session *session.Session
+}
+
+func NewEdgeFunction(sess *session.Session) *EdgeFunction {
+	function := new(EdgeFunction)
+	function.session = sess
+	return function
+}
+
+func (function *EdgeFunction) SetName(name string) {
+	function.Name = name
+}
+
+// Publish creates or updates the function with code as its index.js, and
+// returns the ARN of the published version, which is what CloudFront runs.
+// Lambda@Edge functions have to live in us-east-1.
+func (function *EdgeFunction) Publish(code string) (string, error) {
+	archive, err := zipCode(code)
+	if err != nil {
+		return "", err
+	}
+	svc := lambda.New(function.session, aws.NewConfig().WithRegion("us-east-1"))
+	name := aws.String(function.Name)
+
+	current, err := svc.GetFunction(&lambda.GetFunctionInput{FunctionName: name})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == lambda.ErrCodeResourceNotFoundException {
+		role, err := function.role()
+		if err != nil {
+			return "", err
+		}
+		if err := function.create(svc, role, archive); err != nil {
+			return "", err
+		}
+		if err := svc.WaitUntilFunctionActiveV2(&lambda.GetFunctionInput{FunctionName: name}); err != nil {
+			return "", fmt.Errorf("Lambda function %q didn't become active, %v", function.Name, err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("Unable to read Lambda function %q, %v", function.Name, err)
+	} else if aws.StringValue(current.Configuration.CodeSha256) != codeSha256(archive) {
+		_, err := svc.UpdateFunctionCode(&lambda.UpdateFunctionCodeInput{
+			FunctionName: name,
+			ZipFile:      archive,
+		})
+		if err != nil {
+			return "", fmt.Errorf("Unable to update Lambda function %q, %v", function.Name, err)
+		}
+		if err := svc.WaitUntilFunctionUpdatedV2(&lambda.GetFunctionInput{FunctionName: name}); err != nil {
+			return "", fmt.Errorf("Lambda function %q didn't finish updating, %v", function.Name, err)
+		}
+	}
+
+	// Publishing unchanged code returns the latest version rather than
+	// adding one.
+	version, err := svc.PublishVersion(&lambda.PublishVersionInput{FunctionName: name})
+	if err != nil {
+		return "", fmt.Errorf("Unable to publish Lambda function %q, %v", function.Name, err)
+	}
+	return aws.StringValue(version.FunctionArn), nil
+}
+
+// create creates the function, waiting for a role that was just created to
+// become usable.
+func (function *EdgeFunction) create(svc *lambda.Lambda, role string, archive []byte) error {
+	for attempt := 0; ; attempt++ {
+		_, err := svc.CreateFunction(&lambda.CreateFunctionInput{
+			FunctionName: aws.String(function.Name),
+			Description:  aws.String("Generated by hugo-s3-deploy"),
+			Runtime:      aws.String(lambda.RuntimeNodejs20X),
+			Handler:      aws.String("index.handler"),
+			Role:         aws.String(role),
+			Timeout:      aws.Int64(5),
+			MemorySize:   aws.Int64(128),
+			Code:         &lambda.FunctionCode{ZipFile: archive},
+		})
+		aerr, ok := err.(awserr.Error)
+		if ok && aerr.Code() == lambda.ErrCodeInvalidParameterValueException && strings.Contains(aerr.Message(), "cannot be assumed") && attempt < 10 {
+			time.Sleep(3 * time.Second)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to create Lambda function %q, %v", function.Name, err)
+		}
+		return nil
+	}
+}
+
+// role returns the ARN of the function's execution role, creating it if
+// needed.
+func (function *EdgeFunction) role() (string, error) {
+	svc := iam.New(function.session)
+	current, err := svc.GetRole(&iam.GetRoleInput{RoleName: aws.String(function.Name)})
+	if err == nil {
+		return aws.StringValue(current.Role.Arn), nil
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != iam.ErrCodeNoSuchEntityException {
+		return "", fmt.Errorf("Unable to read IAM role %q, %v", function.Name, err)
+	}
+
+	created, err := svc.CreateRole(&iam.CreateRoleInput{
+		RoleName:                 aws.String(function.Name),
+		AssumeRolePolicyDocument: aws.String(assumeRolePolicy),
+		Description:              aws.String("Runs the Lambda@Edge function generated by hugo-s3-deploy"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to create IAM role %q, %v", function.Name, err)
+	}
+	_, err = svc.AttachRolePolicy(&iam.AttachRolePolicyInput{
+		RoleName:  aws.String(function.Name),
+		PolicyArn: aws.String(executionPolicyArn),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to attach a policy to IAM role %q, %v", function.Name, err)
+	}
+	return aws.StringValue(created.Role.Arn), nil
+}
+
+// zipCode packs code as index.js. The timestamp is fixed so unchanged code
+// zips to the same bytes, and its hash matches the deployed function's.
+func zipCode(code string) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	file, err := writer.CreateHeader(&zip.FileHeader{
+		Name:     "index.js",
+		Method:   zip.Deflate,
+		Modified: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write([]byte(code)); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func codeSha256(archive []byte) string {
+	sum := sha256.Sum256(archive)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
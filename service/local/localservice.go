@@ -0,0 +1,401 @@
+package local
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitchdennett/hugo-s3-deploy/hugo"
+	"github.com/mitchdennett/hugo-s3-deploy/ignore"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	"github.com/mitchdennett/hugo-s3-deploy/redirects"
+	"github.com/mitchdennett/hugo-s3-deploy/service/storage"
+)
+
+// Directory deploys a site to a directory on disk, so deploys can be tried
+// out without AWS and served by any static file server.
+type Directory struct {
+	Path       string
+	Deployment *hugo.Deployment
+	Redirects  []*redirects.Rule
+	Host       string
+	Errors     *storage.ErrorDocument
+	KeyPrefix  string
+	Root       string
+	Output     *output.Printer
+	Ignore     *ignore.Matcher
+	Symlinks   storage.Symlinks
+}
+
+func NewDirectory(path string) *Directory {
+	dir := new(Directory)
+	dir.Path = path
+	return dir
+}
+
+// SetDeployment is accepted for parity with S3. Files on disk have no
+// metadata, so the matchers' headers don't apply.
+func (dir *Directory) SetDeployment(deployment *hugo.Deployment) {
+	dir.Deployment = deployment
+}
+
+func (dir *Directory) SetRedirects(rules []*redirects.Rule, host string) {
+	dir.Redirects = rules
+	dir.Host = host
+}
+
+func (dir *Directory) SetKeyPrefix(prefix string) {
+	dir.KeyPrefix = prefix
+}
+
+// SetRoot sets the subdirectory every key is stored under.
+func (dir *Directory) SetRoot(prefix string) {
+	dir.Root = prefix
+}
+
+func (dir *Directory) SetErrorDocument(errors *storage.ErrorDocument) {
+	dir.Errors = errors
+}
+
+func (dir *Directory) SetOutput(out *output.Printer) {
+	dir.Output = out
+}
+
+func (dir *Directory) SetIgnore(matcher *ignore.Matcher) {
+	dir.Ignore = matcher
+}
+
+func (dir *Directory) SetSymlinks(symlinks storage.Symlinks) {
+	dir.Symlinks = symlinks
+}
+
+func (dir *Directory) CreateOrRetrieve() (bool, error) {
+	exists, err := dir.Exists()
+	if err != nil || exists {
+		return exists, err
+	}
+	if err := os.MkdirAll(dir.Path, 0755); err != nil {
+		return false, fmt.Errorf("Unable to create %s, %v", dir.Path, err)
+	}
+	return false, nil
+}
+
+func (dir *Directory) Exists() (bool, error) {
+	info, err := os.Stat(dir.Path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return false, fmt.Errorf("%s is not a directory", dir.Path)
+	}
+	return true, nil
+}
+
+// SetPrivatePrefix has nothing to protect, since the directory has no
+// access control of its own.
+func (dir *Directory) SetPrivatePrefix(prefix string) {
+}
+
+// SetMetadata is accepted for parity with S3. Files on disk have no
+// metadata.
+func (dir *Directory) SetMetadata(metadata map[string]string) {
+}
+
+// SetCheckHeaders is accepted for parity with S3. Files on disk have no
+// headers.
+func (dir *Directory) SetCheckHeaders(check bool) {
+}
+
+func (dir *Directory) MakePublic() error {
+	return nil
+}
+
+func (dir *Directory) EnableWebHosting() error {
+	return nil
+}
+
+func (dir *Directory) RepointWebsite(from string, to string) error {
+	return nil
+}
+
+func (dir *Directory) file(key string) string {
+	return filepath.Join(dir.Path, filepath.FromSlash(dir.Root+key))
+}
+
+// UploadDirectory copies every file under dirPath and returns the keys that
+// were copied, leaving out files whose contents haven't changed. Files that
+// fail are reported as the copy goes on, and then returned as an error.
+func (dir *Directory) UploadDirectory(prefix string, dirPath string) ([]string, error) {
+	files, err := storage.Files(dirPath, dir.Symlinks, dir.Ignore, dir.Output)
+	if err != nil {
+		return nil, err
+	}
+	total := int64(0)
+	for _, file := range files {
+		total += file.Size
+	}
+	progress := dir.Output.StartProgress(len(files), total)
+	defer progress.Stop()
+
+	uploaded := []string{}
+	failed := 0
+	var firstErr error
+	for _, file := range files {
+		copied, err := dir.copyFile(prefix+file.Key, file.Path, progress)
+		if err != nil {
+			progress.Fail(file.Path, file.Size, err)
+			if failed++; firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if copied {
+			progress.Add(file.Size)
+			uploaded = append(uploaded, prefix+file.Key)
+		} else {
+			progress.Skip(file.Size)
+		}
+	}
+	if failed > 0 {
+		return uploaded, fmt.Errorf("%d of %d files failed to copy, %v", failed, len(files), firstErr)
+	}
+	return uploaded, nil
+}
+
+// copyFile copies path to key unless key already holds the same contents,
+// and reports whether it was copied.
+func (dir *Directory) copyFile(key string, path string, progress *output.Progress) (bool, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("Failed to open file %s, %v", path, err)
+	}
+	if current, err := ioutil.ReadFile(dir.file(key)); err == nil && bytes.Equal(current, body) {
+		progress.Log("skip " + path + " (unchanged)")
+		dir.Output.File("skip", path, key)
+		return false, nil
+	}
+
+	progress.Log("copy " + path + " to " + dir.file(key))
+	if err := dir.write(key, body); err != nil {
+		return false, err
+	}
+	dir.Output.File("copy", path, key)
+	return true, nil
+}
+
+func (dir *Directory) write(key string, body []byte) error {
+	path := dir.file(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Unable to write %s, %v", path, err)
+	}
+	if err := ioutil.WriteFile(path, body, 0644); err != nil {
+		return fmt.Errorf("Unable to write %s, %v", path, err)
+	}
+	return nil
+}
+
+// UploadRedirects writes a page that redirects to the destination for each
+// single-path redirect, since a directory has no website configuration, and
+// returns their keys.
+func (dir *Directory) UploadRedirects(prefix string) ([]string, error) {
+	objects, exact, _ := redirects.Split(dir.Redirects)
+	keys := []string{}
+	for _, rule := range append(objects, exact...) {
+		output.Println("redirect " + rule.From + " to " + rule.To)
+		to := html.EscapeString(rule.To)
+		page := `<!DOCTYPE html><html><head><meta http-equiv="refresh" content="0; url=` + to +
+			`"><link rel="canonical" href="` + to + `"></head></html>`
+		key := rule.Key()
+		if path.Ext(key) == "" {
+			// Static file servers serve directories rather than bare files.
+			key += "/index.html"
+		}
+		if err := dir.write(prefix+key, []byte(page)); err != nil {
+			return keys, err
+		}
+		dir.Output.File("redirect", rule.From, prefix+key)
+		keys = append(keys, prefix+key)
+	}
+	return keys, nil
+}
+
+func (dir *Directory) GetJSON(key string, v interface{}) (bool, error) {
+	_, found, err := dir.GetJSONETag(key, v)
+	return found, err
+}
+
+// GetJSONETag uses the MD5 of the file as its ETag, as S3 does.
+func (dir *Directory) GetJSONETag(key string, v interface{}) (string, bool, error) {
+	body, err := ioutil.ReadFile(dir.file(key))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return "", false, fmt.Errorf("Unable to decode %s, %v", dir.file(key), err)
+	}
+	return fileETag(body), true, nil
+}
+
+// ReplaceJSON checks the file's ETag before writing it. Unlike S3 it isn't
+// atomic, which is only a risk with several deploys on one machine.
+func (dir *Directory) ReplaceJSON(key string, v interface{}, etag string) (string, error) {
+	current, err := ioutil.ReadFile(dir.file(key))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if fileETag(current) != etag {
+		return "", nil
+	}
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("Unable to encode %s, %v", dir.file(key), err)
+	}
+	if err := dir.write(key, body); err != nil {
+		return "", err
+	}
+	return fileETag(body), nil
+}
+
+func fileETag(body []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(body))
+}
+
+func (dir *Directory) PutJSON(key string, v interface{}) error {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode %s, %v", dir.file(key), err)
+	}
+	return dir.write(key, body)
+}
+
+// UploadJSON is PutJSON, since files on disk have no metadata.
+func (dir *Directory) UploadJSON(key string, v interface{}) error {
+	return dir.PutJSON(key, v)
+}
+
+func (dir *Directory) CreateJSON(key string, v interface{}) (bool, error) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return false, fmt.Errorf("Unable to encode %s, %v", dir.file(key), err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dir.file(key)), 0755); err != nil {
+		return false, err
+	}
+	file, err := os.OpenFile(dir.file(key), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	_, err = file.Write(body)
+	return true, err
+}
+
+func (dir *Directory) Delete(key string) error {
+	err := os.Remove(dir.file(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// DeleteIfMatch checks the file's ETag before removing it, which like
+// ReplaceJSON isn't atomic.
+func (dir *Directory) DeleteIfMatch(key string, etag string) (bool, error) {
+	current, err := ioutil.ReadFile(dir.file(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fileETag(current) != etag {
+		return false, nil
+	}
+	return true, dir.Delete(key)
+}
+
+func (dir *Directory) DeleteKeys(keys []string) (int, error) {
+	for i, key := range keys {
+		if err := dir.Delete(key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+func (dir *Directory) ListKeys(prefix string) ([]string, error) {
+	keys := []string{}
+	err := filepath.Walk(dir.file(prefix), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir.file(""), path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	return keys, err
+}
+
+// ListPrefixes returns the names of the directories directly under prefix.
+func (dir *Directory) ListPrefixes(prefix string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir.file(prefix))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// DeletePrefix removes every file under prefix and returns how many there
+// were.
+func (dir *Directory) DeletePrefix(prefix string) (int, error) {
+	root := dir.file(strings.TrimSuffix(prefix, "/"))
+	deleted := 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		deleted++
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return deleted, os.RemoveAll(root)
+}
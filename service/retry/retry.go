@@ -0,0 +1,145 @@
+// Package retry is the retry policy shared by the S3, CloudFront, Route 53
+// and ACM services.
+package retry
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+)
+
+// throttleCodes are the errors AWS returns when requests are being sent too
+// fast.
+var throttleCodes = map[string]bool{
+	"Throttling":                true,
+	"ThrottlingException":       true,
+	"ThrottledException":        true,
+	"RequestThrottled":          true,
+	"RequestThrottledException": true,
+	"RequestLimitExceeded":      true,
+	"TooManyRequestsException":  true,
+	"SlowDown":                  true, // S3
+	"PriorRequestNotComplete":   true, // Route 53
+}
+
+// transientCodes are errors that go away when the request is sent again.
+var transientCodes = map[string]bool{
+	request.ErrCodeRequestError:    true,
+	request.ErrCodeResponseTimeout: true,
+	"RequestTimeout":               true,
+	"RequestTimeoutException":      true,
+	"InternalError":                true,
+	"InternalFailure":              true,
+	"ServiceUnavailable":           true,
+}
+
+// Policy retries requests that failed with a throttling or transient error,
+// waiting a random time up to an exponentially growing limit between
+// attempts. Other errors are returned straight away.
+type Policy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxElapsed  time.Duration
+}
+
+func NewPolicy() *Policy {
+	return &Policy{
+		MaxAttempts: 10,
+		BaseDelay:   200 * time.Millisecond,
+		MaxDelay:    20 * time.Second,
+		MaxElapsed:  2 * time.Minute,
+	}
+}
+
+func (policy *Policy) SetMaxAttempts(attempts int) {
+	policy.MaxAttempts = attempts
+}
+
+func (policy *Policy) SetMaxElapsed(elapsed time.Duration) {
+	policy.MaxElapsed = elapsed
+}
+
+func (policy *Policy) MaxRetries() int {
+	return policy.MaxAttempts - 1
+}
+
+// ShouldRetry reports whether r failed with an error worth retrying, and
+// hasn't been retried for longer than MaxElapsed.
+func (policy *Policy) ShouldRetry(r *request.Request) bool {
+	if !throttled(r) && !transient(r) {
+		return false
+	}
+	return time.Since(r.Time) < policy.MaxElapsed
+}
+
+// RetryRules returns how long to wait before the next attempt.
+func (policy *Policy) RetryRules(r *request.Request) time.Duration {
+	delay := policy.delay(r)
+	output.Verbosef("Retrying %s %s in %s (attempt %d of %d), %v\n", r.ClientInfo.ServiceName, r.Operation.Name,
+		delay.Round(time.Millisecond), r.RetryCount+2, policy.MaxAttempts, r.Error)
+	return delay
+}
+
+// delay is the wait before retrying r. Throttled requests start from a
+// longer delay, and a Retry-After header from the service is honoured.
+func (policy *Policy) delay(r *request.Request) time.Duration {
+	if after := retryAfter(r); after > 0 && after <= policy.MaxDelay {
+		return after
+	}
+	base := policy.BaseDelay
+	if throttled(r) {
+		base *= 5
+	}
+	limit := base << uint(r.RetryCount)
+	if limit > policy.MaxDelay || limit <= 0 {
+		limit = policy.MaxDelay
+	}
+	// Full jitter, so requests throttled together don't retry together.
+	return time.Duration(rand.Int63n(int64(limit)) + 1)
+}
+
+// throttled reports whether r was rejected for being sent too fast.
+func throttled(r *request.Request) bool {
+	if r.HTTPResponse != nil && r.HTTPResponse.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return throttleCodes[code(r.Error)]
+}
+
+func transient(r *request.Request) bool {
+	if transientCodes[code(r.Error)] || request.IsErrorRetryable(r.Error) {
+		return true
+	}
+	if r.HTTPResponse == nil {
+		return false
+	}
+	switch r.HTTPResponse.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func code(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+func retryAfter(r *request.Request) time.Duration {
+	if r.HTTPResponse == nil {
+		return 0
+	}
+	seconds, err := strconv.Atoi(r.HTTPResponse.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
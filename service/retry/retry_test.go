@@ -0,0 +1,110 @@
+package retry
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func failed(code string, status int, header http.Header) *request.Request {
+	r := &request.Request{Time: time.Now()}
+	if code != "" {
+		r.Error = awserr.New(code, "failed", nil)
+	}
+	if status != 0 {
+		r.HTTPResponse = &http.Response{StatusCode: status, Header: header}
+	}
+	return r
+}
+
+func TestShouldRetry(t *testing.T) {
+	tests := []struct {
+		code   string
+		status int
+		retry  bool
+	}{
+		// Throttling.
+		{"SlowDown", http.StatusServiceUnavailable, true},
+		{"Throttling", http.StatusBadRequest, true},
+		{"PriorRequestNotComplete", http.StatusBadRequest, true},
+		{"TooManyRequestsException", http.StatusBadRequest, true},
+		{"", http.StatusTooManyRequests, true},
+		// Transient failures.
+		{request.ErrCodeRequestError, 0, true},
+		{request.ErrCodeResponseTimeout, 0, true},
+		{"RequestTimeout", http.StatusBadRequest, true},
+		{"InternalError", http.StatusInternalServerError, true},
+		{"ServiceUnavailable", http.StatusServiceUnavailable, true},
+		{"", http.StatusBadGateway, true},
+		{"", http.StatusGatewayTimeout, true},
+		// Permanent errors.
+		{"AccessDenied", http.StatusForbidden, false},
+		{"NoSuchKey", http.StatusNotFound, false},
+		{"InvalidArgument", http.StatusBadRequest, false},
+		{"PreconditionFailed", http.StatusPreconditionFailed, false},
+		{"", 0, false},
+	}
+	policy := NewPolicy()
+	for _, test := range tests {
+		if retry := policy.ShouldRetry(failed(test.code, test.status, nil)); retry != test.retry {
+			t.Errorf("ShouldRetry(%q, %d) = %v, want %v", test.code, test.status, retry, test.retry)
+		}
+	}
+}
+
+func TestShouldRetryMaxElapsed(t *testing.T) {
+	policy := NewPolicy()
+	policy.SetMaxElapsed(time.Minute)
+	r := failed("SlowDown", http.StatusServiceUnavailable, nil)
+	r.Time = time.Now().Add(-59 * time.Second)
+	if !policy.ShouldRetry(r) {
+		t.Error("a request wasn't retried within MaxElapsed")
+	}
+	r.Time = time.Now().Add(-61 * time.Second)
+	if policy.ShouldRetry(r) {
+		t.Error("a request was retried after MaxElapsed")
+	}
+}
+
+func TestDelay(t *testing.T) {
+	policy := NewPolicy()
+	tests := []struct {
+		name       string
+		r          *request.Request
+		retryCount int
+		min, max   time.Duration
+	}{
+		{"Retry-After", failed("SlowDown", http.StatusServiceUnavailable, http.Header{"Retry-After": {"3"}}), 0, 3 * time.Second, 3 * time.Second},
+		// A Retry-After longer than MaxDelay is ignored.
+		{"long Retry-After", failed("SlowDown", http.StatusServiceUnavailable, http.Header{"Retry-After": {"60"}}), 0, 1, time.Second},
+		{"bad Retry-After", failed("InternalError", http.StatusInternalServerError, http.Header{"Retry-After": {"soon"}}), 0, 1, 200 * time.Millisecond},
+		{"transient", failed("InternalError", http.StatusInternalServerError, nil), 0, 1, 200 * time.Millisecond},
+		{"transient retried", failed("InternalError", http.StatusInternalServerError, nil), 3, 1, 1600 * time.Millisecond},
+		{"throttled", failed("SlowDown", http.StatusServiceUnavailable, nil), 0, 1, time.Second},
+		{"throttled retried", failed("SlowDown", http.StatusServiceUnavailable, nil), 2, 1, 4 * time.Second},
+		// The limit is capped at MaxDelay, even once the shift overflows.
+		{"capped", failed("SlowDown", http.StatusServiceUnavailable, nil), 10, 1, policy.MaxDelay},
+		{"overflow", failed("InternalError", http.StatusInternalServerError, nil), 62, 1, policy.MaxDelay},
+	}
+	for _, test := range tests {
+		test.r.RetryCount = test.retryCount
+		longest := time.Duration(0)
+		for i := 0; i < 200; i++ {
+			delay := policy.delay(test.r)
+			if delay < test.min || delay > test.max {
+				t.Fatalf("%s: delay = %s, want between %s and %s", test.name, delay, test.min, test.max)
+			}
+			if delay > longest {
+				longest = delay
+			}
+		}
+		// The delay is random up to the limit, so over many tries some
+		// come close to it.
+		if longest < test.max/2 {
+			t.Errorf("%s: longest delay %s, want close to %s", test.name, longest, test.max)
+		}
+	}
+}
@@ -1,18 +1,19 @@
 package route53
 
 import (
+	"errors"
 	"fmt"
-	"log"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/acm"
 	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
 	acmService "github.com/mitchdennett/hugo-s3-deploy/service/acm"
 )
 
-func InsertNewRecord(sess *session.Session, cert *acmService.Certificate, resourceRecord1 *acm.ResourceRecord) {
+func InsertNewRecord(sess *session.Session, cert *acmService.Certificate, resourceRecord1 *acm.ResourceRecord) error {
 	change1 := &route53.Change{
 		Action: aws.String("UPSERT"),
 		ResourceRecordSet: &route53.ResourceRecordSet{
@@ -40,28 +41,29 @@ func InsertNewRecord(sess *session.Session, cert *acmService.Certificate, resour
 		if aerr, ok := changeErr.(awserr.Error); ok {
 			switch aerr.Code() {
 			case route53.ErrCodeNoSuchHostedZone:
-				fmt.Println(route53.ErrCodeNoSuchHostedZone, aerr.Error())
+				output.Println(route53.ErrCodeNoSuchHostedZone, aerr.Error())
 			case route53.ErrCodeNoSuchHealthCheck:
-				fmt.Println(route53.ErrCodeNoSuchHealthCheck, aerr.Error())
+				output.Println(route53.ErrCodeNoSuchHealthCheck, aerr.Error())
 			case route53.ErrCodeInvalidChangeBatch:
-				fmt.Println(route53.ErrCodeInvalidChangeBatch, aerr.Error())
+				output.Println(route53.ErrCodeInvalidChangeBatch, aerr.Error())
 			case route53.ErrCodeInvalidInput:
-				fmt.Println(route53.ErrCodeInvalidInput, aerr.Error())
+				output.Println(route53.ErrCodeInvalidInput, aerr.Error())
 			case route53.ErrCodePriorRequestNotComplete:
-				fmt.Println(route53.ErrCodePriorRequestNotComplete, aerr.Error())
+				output.Println(route53.ErrCodePriorRequestNotComplete, aerr.Error())
 			default:
-				fmt.Println(aerr.Error())
+				output.Println(aerr.Error())
 			}
 		} else {
 			// Print the error, cast err to awserr.Error to get the Code and
 			// Message from an error.
-			fmt.Println(changeErr.Error())
+			output.Println(changeErr.Error())
 		}
-		log.Fatal("Error adding CNAME records")
+		return errors.New("Error adding CNAME records")
 	}
+	return nil
 }
 
-func ChangeHostedZoneRecord(cloudFrontDomain *string, sess *session.Session, domainName string, hostedZoneId string) {
+func ChangeHostedZoneRecord(cloudFrontDomain *string, sess *session.Session, domainName string, hostedZoneId string) error {
 	change1 := &route53.Change{
 		Action: aws.String("UPSERT"),
 		ResourceRecordSet: &route53.ResourceRecordSet{
@@ -102,23 +104,54 @@ func ChangeHostedZoneRecord(cloudFrontDomain *string, sess *session.Session, dom
 		if aerr, ok := changeErr.(awserr.Error); ok {
 			switch aerr.Code() {
 			case route53.ErrCodeNoSuchHostedZone:
-				fmt.Println(route53.ErrCodeNoSuchHostedZone, aerr.Error())
+				output.Println(route53.ErrCodeNoSuchHostedZone, aerr.Error())
 			case route53.ErrCodeNoSuchHealthCheck:
-				fmt.Println(route53.ErrCodeNoSuchHealthCheck, aerr.Error())
+				output.Println(route53.ErrCodeNoSuchHealthCheck, aerr.Error())
 			case route53.ErrCodeInvalidChangeBatch:
-				fmt.Println(route53.ErrCodeInvalidChangeBatch, aerr.Error())
+				output.Println(route53.ErrCodeInvalidChangeBatch, aerr.Error())
 			case route53.ErrCodeInvalidInput:
-				fmt.Println(route53.ErrCodeInvalidInput, aerr.Error())
+				output.Println(route53.ErrCodeInvalidInput, aerr.Error())
 			case route53.ErrCodePriorRequestNotComplete:
-				fmt.Println(route53.ErrCodePriorRequestNotComplete, aerr.Error())
+				output.Println(route53.ErrCodePriorRequestNotComplete, aerr.Error())
 			default:
-				fmt.Println(aerr.Error())
+				output.Println(aerr.Error())
 			}
 		} else {
 			// Print the error, cast err to awserr.Error to get the Code and
 			// Message from an error.
-			fmt.Println(changeErr.Error())
+			output.Println(changeErr.Error())
 		}
-		log.Fatal("Error adding CloudFront CNAME record")
+		return errors.New("Error adding CloudFront CNAME record")
 	}
+	return nil
+}
+
+// UpsertCNAME points name at value, for records such as the wildcard that
+// sends every preview host to the preview distribution.
+func UpsertCNAME(sess *session.Session, name string, value *string, hostedZoneId string) error {
+	change := &route53.Change{
+		Action: aws.String("UPSERT"),
+		ResourceRecordSet: &route53.ResourceRecordSet{
+			Name: aws.String(name),
+			Type: aws.String("CNAME"),
+			ResourceRecords: []*route53.ResourceRecord{
+				&route53.ResourceRecord{Value: value},
+			},
+			TTL: aws.Int64(60),
+		},
+	}
+
+	r53 := route53.New(sess)
+
+	_, changeErr := r53.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		ChangeBatch: &route53.ChangeBatch{
+			Changes: []*route53.Change{change},
+		},
+		HostedZoneId: aws.String(hostedZoneId),
+	})
+
+	if changeErr != nil {
+		return fmt.Errorf("Error adding CNAME record for %s, %v", name, changeErr)
+	}
+	return nil
 }
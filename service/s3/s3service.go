@@ -1,28 +1,60 @@
 package s3
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mitchdennett/hugo-s3-deploy/hugo"
+	"github.com/mitchdennett/hugo-s3-deploy/ignore"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	"github.com/mitchdennett/hugo-s3-deploy/redirects"
+	"github.com/mitchdennett/hugo-s3-deploy/service/storage"
 )
 
 type S3Bucket struct {
-	Name    string
-	Region  string
-	session *session.Session
+	Name         string
+	Region       string
+	Deployment   *hugo.Deployment
+	Redirects    []*redirects.Rule
+	Host         string
+	Errors       *storage.ErrorDocument
+	KeyPrefix    string
+	Root         string
+	Endpoint     string
+	Private      string
+	Metadata     map[string]string
+	Output       *output.Printer
+	Ignore       *ignore.Matcher
+	Symlinks     storage.Symlinks
+	Concurrency  int
+	CheckHeaders bool
+	session      *session.Session
+	etags        map[string]string
+	progress     *output.Progress
 }
 
 func NewBucket(session *session.Session) *S3Bucket {
 	bucket := new(S3Bucket)
 	bucket.session = session
+	bucket.Concurrency = 1
 	return bucket
 }
 
@@ -34,7 +66,86 @@ func (bucket *S3Bucket) SetName(name string) {
 	bucket.Name = name
 }
 
-func (bucket *S3Bucket) CreateOrRetrieve() bool {
+// SetEndpoint marks the bucket as living on an S3-compatible server rather
+// than AWS. The session must be configured with the same endpoint.
+func (bucket *S3Bucket) SetEndpoint(endpoint string) {
+	bucket.Endpoint = endpoint
+}
+
+// SetRedirects sets the _redirects rules served by the bucket. Redirects to
+// a path on the site are sent to host rather than the S3 website endpoint.
+func (bucket *S3Bucket) SetRedirects(rules []*redirects.Rule, host string) {
+	bucket.Redirects = rules
+	bucket.Host = host
+}
+
+// SetKeyPrefix sets the prefix the site is uploaded under, which the website
+// configuration's error document and routing conditions must include.
+func (bucket *S3Bucket) SetKeyPrefix(prefix string) {
+	bucket.KeyPrefix = prefix
+}
+
+// SetRoot sets the prefix every key the bucket reads or writes is under, so
+// several sites can share one bucket. Keys passed in and returned are
+// relative to it.
+func (bucket *S3Bucket) SetRoot(prefix string) {
+	bucket.Root = prefix
+}
+
+// objectKey is where key is stored in the bucket.
+func (bucket *S3Bucket) objectKey(key string) string {
+	return bucket.Root + key
+}
+
+func (bucket *S3Bucket) SetErrorDocument(errors *storage.ErrorDocument) {
+	bucket.Errors = errors
+}
+
+// SetPrivatePrefix sets a prefix the bucket policy keeps from anonymous
+// readers, and so from the website endpoint.
+func (bucket *S3Bucket) SetPrivatePrefix(prefix string) {
+	bucket.Private = prefix
+}
+
+// SetOutput sets where uploads and skipped files are reported.
+func (bucket *S3Bucket) SetOutput(out *output.Printer) {
+	bucket.Output = out
+}
+
+// SetMetadata sets user metadata, sent as x-amz-meta-* headers, for every
+// uploaded file.
+func (bucket *S3Bucket) SetMetadata(metadata map[string]string) {
+	bucket.Metadata = metadata
+}
+
+// SetIgnore sets the patterns of files left out of uploads.
+func (bucket *S3Bucket) SetIgnore(matcher *ignore.Matcher) {
+	bucket.Ignore = matcher
+}
+
+// SetConcurrency sets how many files UploadDirectory uploads at once.
+func (bucket *S3Bucket) SetConcurrency(concurrency int) {
+	bucket.Concurrency = concurrency
+}
+
+// SetSymlinks sets what UploadDirectory does with symbolic links.
+func (bucket *S3Bucket) SetSymlinks(symlinks storage.Symlinks) {
+	bucket.Symlinks = symlinks
+}
+
+// SetCheckHeaders sets whether UploadDirectory reads the headers of files
+// it would skip as unchanged, and uploads them again when they differ. It
+// costs a request per file, so it is only wanted when the header settings
+// changed.
+func (bucket *S3Bucket) SetCheckHeaders(check bool) {
+	bucket.CheckHeaders = check
+}
+
+func (bucket *S3Bucket) SetDeployment(deployment *hugo.Deployment) {
+	bucket.Deployment = deployment
+}
+
+func (bucket *S3Bucket) CreateOrRetrieve() (bool, error) {
 
 	svc := s3.New(bucket.session)
 	bucketExists := false
@@ -51,48 +162,69 @@ func (bucket *S3Bucket) CreateOrRetrieve() bool {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case s3.ErrCodeBucketAlreadyExists:
-				log.Fatal("Bucket: " + bucket.Name + " already exists. Please choose a different name")
+				return false, errors.New("Bucket: " + bucket.Name + " already exists. Please choose a different name")
 			case s3.ErrCodeBucketAlreadyOwnedByYou:
 				bucketExists = true
 			default:
-				log.Fatal(aerr.Error())
+				return false, aerr
 			}
 		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Fatal(err.Error())
+			return false, err
 		}
-	} else {
-
 	}
 
-	return bucketExists
+	return bucketExists, nil
 }
 
-func (bucket *S3Bucket) MakePublic() {
+// Exists reports whether the bucket has been created.
+func (bucket *S3Bucket) Exists() (bool, error) {
 	svc := s3.New(bucket.session)
+	_, err := svc.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(bucket.Name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeNoSuchBucket || aerr.Code() == "NotFound") {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Unable to read bucket %q, %v", bucket.Name, err)
+	}
+	return true, nil
+}
+
+func (bucket *S3Bucket) MakePublic() error {
+	svc := s3.New(bucket.session)
+	statements := "{\"Sid\":\"PublicReadGetObject\",\"Effect\":\"Allow\",\"Principal\":{\"AWS\":\"*\"},\"Action\":\"s3:GetObject\",\"Resource\":\"arn:aws:s3:::" + bucket.Name + "/*\"}"
+	// Anonymous requests carry no principal ARN, so this denies the website
+	// endpoint without locking out the deploy's own credentials. The prefix
+	// is denied under every site's root too, so sites sharing the bucket
+	// write the same policy.
+	// S3-compatible servers don't all support the condition.
+	if bucket.Private != "" && bucket.Endpoint == "" {
+		statements += ",{\"Sid\":\"DenyAnonymousPrivate\",\"Effect\":\"Deny\",\"Principal\":\"*\",\"Action\":\"s3:GetObject\",\"Resource\":[\"arn:aws:s3:::" + bucket.Name + "/" + bucket.Private + "*\",\"arn:aws:s3:::" + bucket.Name + "/*/" + bucket.Private + "*\"],\"Condition\":{\"Null\":{\"aws:PrincipalArn\":\"true\"}}}"
+	}
 	input := &s3.PutBucketPolicyInput{
 		Bucket: aws.String(bucket.Name),
-		Policy: aws.String("{\"Version\":\"2008-10-17\",\"Statement\":[{\"Sid\":\"PublicReadGetObject\",\"Effect\":\"Allow\",\"Principal\":{\"AWS\":\"*\"},\"Action\":\"s3:GetObject\",\"Resource\":\"arn:aws:s3:::" + bucket.Name + "/*\"}]}"),
+		Policy: aws.String("{\"Version\":\"2012-10-17\",\"Statement\":[" + statements + "]}"),
 	}
 
 	_, err := svc.PutBucketPolicy(input)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Fatal(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Fatal(err.Error())
-		}
-		return
+		return fmt.Errorf("Unable to set bucket %q policy, %v", bucket.Name, err)
 	}
+	return nil
 }
 
-func (bucket *S3Bucket) EnableWebHosting() {
+// websiteMu serializes changes to website configurations, which sites
+// sharing a bucket read and rewrite.
+var websiteMu sync.Mutex
+
+// EnableWebHosting configures the S3 website endpoint. S3-compatible servers
+// generally have no website hosting, so nothing is configured on them.
+func (bucket *S3Bucket) EnableWebHosting() error {
+	if bucket.Endpoint != "" {
+		output.Println("Website hosting isn't configured on " + bucket.Endpoint)
+		return nil
+	}
 	svc := s3.New(bucket.session)
 	params := s3.PutBucketWebsiteInput{
 		Bucket: aws.String(bucket.Name),
@@ -102,102 +234,792 @@ func (bucket *S3Bucket) EnableWebHosting() {
 			},
 		},
 	}
+	if bucket.Root != "" {
+		websiteMu.Lock()
+		defer websiteMu.Unlock()
+		if err := bucket.shareWebsite(svc, params.WebsiteConfiguration); err != nil {
+			return err
+		}
+	} else if bucket.Errors != nil {
+		params.WebsiteConfiguration.ErrorDocument = &s3.ErrorDocument{
+			Key: aws.String(bucket.KeyPrefix + bucket.Errors.Key),
+		}
+	}
+
+	if len(params.WebsiteConfiguration.RoutingRules) == 0 {
+		params.WebsiteConfiguration.RoutingRules = nil
+	}
 
 	_, err := svc.PutBucketWebsite(&params)
 	if err != nil {
-		log.Fatalf("Unable to set bucket %q website configuration, %v", bucket.Name, err)
+		return fmt.Errorf("Unable to set bucket %q website configuration, %v", bucket.Name, err)
+	}
+	return nil
+}
+
+// shareWebsite merges website into the configuration of a bucket shared with
+// other sites. Their routing rules and the bucket's error document are kept,
+// and the rules earlier versions set under this site's root are dropped. Missing keys are
+// sent to the site's error page by CloudFront rather than the error document.
+func (bucket *S3Bucket) shareWebsite(svc *s3.S3, website *s3.WebsiteConfiguration) error {
+	current, err := svc.GetBucketWebsite(&s3.GetBucketWebsiteInput{
+		Bucket: aws.String(bucket.Name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchWebsiteConfiguration" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read bucket %q website configuration, %v", bucket.Name, err)
+	}
+
+	website.ErrorDocument = current.ErrorDocument
+	rules := []*s3.RoutingRule{}
+	for _, rule := range current.RoutingRules {
+		if rule.Condition != nil && strings.HasPrefix(aws.StringValue(rule.Condition.KeyPrefixEquals), bucket.Root) {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	website.RoutingRules = append(rules, website.RoutingRules...)
+	return nil
+}
+
+// UploadRedirects writes an empty object carrying a website redirect for each
+// permanent single-path redirect, and returns their keys.
+func (bucket *S3Bucket) UploadRedirects(bucketPrefix string) ([]string, error) {
+	svc := s3.New(bucket.session)
+	objects, _, _ := redirects.Split(bucket.Redirects)
+	keys := []string{}
+	for _, rule := range objects {
+		key := bucketPrefix + rule.Key()
+		output.Println("redirect " + rule.From + " to " + rule.To)
+		_, err := svc.PutObject(&s3.PutObjectInput{
+			Bucket:                  aws.String(bucket.Name),
+			Key:                     aws.String(bucket.objectKey(key)),
+			Body:                    bytes.NewReader(nil),
+			WebsiteRedirectLocation: aws.String(rule.To),
+		})
+		if err != nil {
+			return keys, fmt.Errorf("Unable to write redirect %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
+		}
+		bucket.Output.File("redirect", rule.From, key)
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// RepointWebsite moves the website configuration's error document and
+// routing conditions from one key prefix to another, leaving the rest of
+// the configuration as it is.
+func (bucket *S3Bucket) RepointWebsite(from string, to string) error {
+	if bucket.Endpoint != "" {
+		return nil
+	}
+	websiteMu.Lock()
+	defer websiteMu.Unlock()
+	svc := s3.New(bucket.session)
+	website, err := svc.GetBucketWebsite(&s3.GetBucketWebsiteInput{
+		Bucket: aws.String(bucket.Name),
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to read bucket %q website configuration, %v", bucket.Name, err)
+	}
+
+	from, to = bucket.objectKey(from), bucket.objectKey(to)
+	repoint := func(key *string) *string {
+		if key == nil || !strings.HasPrefix(*key, from) {
+			return key
+		}
+		return aws.String(to + strings.TrimPrefix(*key, from))
+	}
+	if website.ErrorDocument != nil {
+		website.ErrorDocument.Key = repoint(website.ErrorDocument.Key)
+	}
+	for _, rule := range website.RoutingRules {
+		if rule.Condition != nil {
+			rule.Condition.KeyPrefixEquals = repoint(rule.Condition.KeyPrefixEquals)
+		}
+	}
+
+	_, err = svc.PutBucketWebsite(&s3.PutBucketWebsiteInput{
+		Bucket: aws.String(bucket.Name),
+		WebsiteConfiguration: &s3.WebsiteConfiguration{
+			ErrorDocument:         website.ErrorDocument,
+			IndexDocument:         website.IndexDocument,
+			RedirectAllRequestsTo: website.RedirectAllRequestsTo,
+			RoutingRules:          website.RoutingRules,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to set bucket %q website configuration, %v", bucket.Name, err)
+	}
+	return nil
+}
+
+// GetJSON decodes the JSON object at key into v. It returns false when the
+// object doesn't exist.
+func (bucket *S3Bucket) GetJSON(key string, v interface{}) (bool, error) {
+	_, found, err := bucket.GetJSONETag(key, v)
+	return found, err
+}
+
+func (bucket *S3Bucket) GetJSONETag(key string, v interface{}) (string, bool, error) {
+	svc := s3.New(bucket.session)
+	result, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket.Name),
+		Key:    aws.String(bucket.objectKey(key)),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("Unable to read %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
+	}
+	defer result.Body.Close()
+
+	if err := json.NewDecoder(result.Body).Decode(v); err != nil {
+		return "", false, fmt.Errorf("Unable to decode %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
+	}
+	return aws.StringValue(result.ETag), true, nil
+}
+
+func (bucket *S3Bucket) PutJSON(key string, v interface{}) error {
+	return bucket.putJSON(key, v, nil)
+}
+
+func (bucket *S3Bucket) UploadJSON(key string, v interface{}) error {
+	return bucket.putJSON(key, v, bucket.Metadata)
+}
+
+func (bucket *S3Bucket) putJSON(key string, v interface{}, metadata map[string]string) error {
+	svc := s3.New(bucket.session)
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
+	}
+	params := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket.Name),
+		Key:         aws.String(bucket.objectKey(key)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}
+	if len(metadata) > 0 {
+		params.Metadata = aws.StringMap(metadata)
+	}
+	_, err = svc.PutObject(params)
+	if err != nil {
+		return fmt.Errorf("Unable to write %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
 	}
+	return nil
 }
 
-func isDirectory(path string) bool {
-	fd, err := os.Stat(path)
+// CreateJSON writes v to key with a conditional write, so only one of two
+// concurrent writers succeeds. It returns false when key already exists.
+func (bucket *S3Bucket) CreateJSON(key string, v interface{}) (bool, error) {
+	svc := s3.New(bucket.session)
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return false, fmt.Errorf("Unable to encode %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
+	}
+	req, _ := svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(bucket.Name),
+		Key:         aws.String(bucket.objectKey(key)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	req.HTTPRequest.Header.Set("If-None-Match", "*")
+	err = req.Send()
+	if rerr, ok := err.(awserr.RequestFailure); ok && (rerr.StatusCode() == http.StatusPreconditionFailed || rerr.StatusCode() == http.StatusConflict) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Unable to write %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
+	}
+	return true, nil
+}
+
+// ReplaceJSON writes v to key with a conditional write on etag, so of two
+// writers that read the same object only one succeeds.
+func (bucket *S3Bucket) ReplaceJSON(key string, v interface{}, etag string) (string, error) {
+	svc := s3.New(bucket.session)
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("Unable to encode %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
+	}
+	req, result := svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(bucket.Name),
+		Key:         aws.String(bucket.objectKey(key)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	req.HTTPRequest.Header.Set("If-Match", etag)
+	err = req.Send()
+	if rerr, ok := err.(awserr.RequestFailure); ok && (rerr.StatusCode() == http.StatusPreconditionFailed || rerr.StatusCode() == http.StatusConflict || rerr.StatusCode() == http.StatusNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to write %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
+	}
+	return aws.StringValue(result.ETag), nil
+}
+
+func (bucket *S3Bucket) Delete(key string) error {
+	svc := s3.New(bucket.session)
+	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket.Name),
+		Key:    aws.String(bucket.objectKey(key)),
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to delete %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
+	}
+	return nil
+}
+
+func (bucket *S3Bucket) DeleteIfMatch(key string, etag string) (bool, error) {
+	svc := s3.New(bucket.session)
+	req, _ := svc.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket.Name),
+		Key:    aws.String(bucket.objectKey(key)),
+	})
+	req.HTTPRequest.Header.Set("If-Match", etag)
+	err := req.Send()
+	if rerr, ok := err.(awserr.RequestFailure); ok && (rerr.StatusCode() == http.StatusPreconditionFailed || rerr.StatusCode() == http.StatusConflict || rerr.StatusCode() == http.StatusNotFound) {
+		return false, nil
+	}
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(2)
+		return false, fmt.Errorf("Unable to delete %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
 	}
-	switch mode := fd.Mode(); {
-	case mode.IsDir():
+	return true, nil
+}
+
+// ListKeys returns the keys of every object under prefix.
+func (bucket *S3Bucket) ListKeys(prefix string) ([]string, error) {
+	svc := s3.New(bucket.session)
+	keys := []string{}
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket.Name),
+		Prefix: aws.String(bucket.objectKey(prefix)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.StringValue(object.Key), bucket.Root))
+		}
 		return true
-	case mode.IsRegular():
-		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list %s/%s, %v", bucket.Name, bucket.objectKey(prefix), err)
 	}
-	return false
+	return keys, nil
 }
 
-func (bucket S3Bucket) UploadDirectory(bucketPrefix string, dirPath string) {
-	fileList := []string{}
-	filepath.Walk(dirPath, func(path string, f os.FileInfo, err error) error {
-		if isDirectory(path) {
-			return nil
-		} else {
-			fileList = append(fileList, path)
-			return nil
+// ListPrefixes returns the names of the "directories" directly under prefix.
+func (bucket *S3Bucket) ListPrefixes(prefix string) ([]string, error) {
+	svc := s3.New(bucket.session)
+	names := []string{}
+	prefix = bucket.objectKey(prefix)
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket.Name),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, common := range page.CommonPrefixes {
+			name := strings.TrimPrefix(aws.StringValue(common.Prefix), prefix)
+			names = append(names, strings.TrimSuffix(name, "/"))
 		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list %s/%s, %v", bucket.Name, prefix, err)
+	}
+	return names, nil
+}
+
+// DeletePrefix deletes every object under prefix and returns how many were
+// deleted.
+func (bucket *S3Bucket) DeletePrefix(prefix string) (int, error) {
+	svc := s3.New(bucket.session)
+	deleted := 0
+	var deleteErr error
+	prefix = bucket.objectKey(prefix)
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket.Name),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
+		objects := []*s3.ObjectIdentifier{}
+		for _, object := range page.Contents {
+			objects = append(objects, &s3.ObjectIdentifier{Key: object.Key})
+		}
+		result, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket.Name),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			deleteErr = fmt.Errorf("Unable to delete objects under %s/%s, %v", bucket.Name, prefix, err)
+			return false
+		}
+		if len(result.Errors) > 0 {
+			deleteErr = fmt.Errorf("Unable to delete %s/%s, %s", bucket.Name, aws.StringValue(result.Errors[0].Key), aws.StringValue(result.Errors[0].Message))
+			return false
+		}
+		deleted += len(objects)
+		return true
+	})
+	if err != nil {
+		return deleted, fmt.Errorf("Unable to list objects under %s/%s, %v", bucket.Name, prefix, err)
+	}
+	return deleted, deleteErr
+}
+
+// DeleteKeys deletes keys, up to 1000 per request, and returns how many were
+// deleted.
+func (bucket *S3Bucket) DeleteKeys(keys []string) (int, error) {
+	svc := s3.New(bucket.session)
+	deleted := 0
+	for start := 0; start < len(keys); start += 1000 {
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+		objects := []*s3.ObjectIdentifier{}
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(bucket.objectKey(key))})
+		}
+		result, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket.Name),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return deleted, fmt.Errorf("Unable to delete objects from %s, %v", bucket.Name, err)
+		}
+		if len(result.Errors) > 0 {
+			return deleted, fmt.Errorf("Unable to delete %s/%s, %s", bucket.Name, aws.StringValue(result.Errors[0].Key), aws.StringValue(result.Errors[0].Message))
+		}
+		deleted += len(objects)
+	}
+	return deleted, nil
+}
+
+// UploadDirectory uploads every file under dirPath and returns the keys that
+// were uploaded, leaving out files that were skipped as unchanged. Files
+// that fail are reported as the upload goes on, and then returned as an
+// error.
+func (bucket *S3Bucket) UploadDirectory(bucketPrefix string, dirPath string) ([]string, error) {
+	files, err := storage.Files(dirPath, bucket.Symlinks, bucket.Ignore, bucket.Output)
+	if err != nil {
+		return nil, err
+	}
+	etags, err := bucket.listETags(bucketPrefix)
+	if err != nil {
+		return nil, err
+	}
+	bucket.etags = etags
+
+	total := int64(0)
+	for _, file := range files {
+		total += file.Size
+	}
+	bucket.progress = bucket.Output.StartProgress(len(files), total)
+	defer func() {
+		bucket.progress.Stop()
+		bucket.progress = nil
+	}()
+
+	uploaded := []string{}
+	failed := 0
+	var firstErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan *storage.File)
+	for i := 0; i < bucket.Concurrency && i < len(files); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				key, ok, err := bucket.UploadFile(bucketPrefix, file.Path, dirPath)
+				mu.Lock()
+				if err != nil {
+					bucket.progress.Fail(file.Path, file.Size, err)
+					if failed++; firstErr == nil {
+						firstErr = err
+					}
+				} else if ok {
+					bucket.progress.Add(file.Size)
+					uploaded = append(uploaded, key)
+				} else {
+					bucket.progress.Skip(file.Size)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, file := range files {
+		jobs <- file
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Strings(uploaded)
+	if failed > 0 {
+		return uploaded, fmt.Errorf("%d of %d files failed to upload, %v", failed, len(files), firstErr)
+	}
+	return uploaded, nil
+}
+
+// listETags returns the ETag of every object under prefix, by key, so
+// unchanged files can be skipped.
+func (bucket *S3Bucket) listETags(prefix string) (map[string]string, error) {
+	svc := s3.New(bucket.session)
+	etags := map[string]string{}
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket.Name),
+		Prefix: aws.String(bucket.objectKey(prefix)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			etags[strings.TrimPrefix(aws.StringValue(object.Key), bucket.Root)] = strings.Trim(aws.StringValue(object.ETag), "\"")
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list objects in bucket %q, %v", bucket.Name, err)
+	}
+	return etags, nil
+}
+
+// Object is a stored object with the metadata needed to upload it again as
+// it was. Key is relative to the bucket's root.
+type Object struct {
+	Key             string            `json:"key"`
+	ETag            string            `json:"etag"`
+	Size            int64             `json:"size"`
+	LastModified    time.Time         `json:"lastModified"`
+	ContentType     string            `json:"contentType,omitempty"`
+	CacheControl    string            `json:"cacheControl,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	Redirect        string            `json:"redirect,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+func (object *Object) setMetadata(contentType, cacheControl, contentEncoding, redirect *string, metadata map[string]*string) {
+	object.ContentType = aws.StringValue(contentType)
+	object.CacheControl = aws.StringValue(cacheControl)
+	object.ContentEncoding = aws.StringValue(contentEncoding)
+	object.Redirect = aws.StringValue(redirect)
+	object.Metadata = aws.StringValueMap(metadata)
+	if len(object.Metadata) == 0 {
+		object.Metadata = nil
+	}
+}
+
+// ListObjects lists the objects under prefix with their ETags. Their
+// metadata is left empty; ReadMetadata or DownloadObject fill it in.
+func (bucket *S3Bucket) ListObjects(prefix string) ([]*Object, error) {
+	svc := s3.New(bucket.session)
+	objects := []*Object{}
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket.Name),
+		Prefix: aws.String(bucket.objectKey(prefix)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, &Object{
+				Key:          strings.TrimPrefix(aws.StringValue(object.Key), bucket.Root),
+				ETag:         strings.Trim(aws.StringValue(object.ETag), "\""),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list %s/%s, %v", bucket.Name, bucket.objectKey(prefix), err)
+	}
+	return objects, nil
+}
+
+// ReadMetadata fills in object's metadata without downloading it.
+func (bucket *S3Bucket) ReadMetadata(object *Object) error {
+	svc := s3.New(bucket.session)
+	result, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket.Name),
+		Key:    aws.String(bucket.objectKey(object.Key)),
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to read %s/%s, %v", bucket.Name, bucket.objectKey(object.Key), err)
+	}
+	object.setMetadata(result.ContentType, result.CacheControl, result.ContentEncoding, result.WebsiteRedirectLocation, result.Metadata)
+	return nil
+}
+
+// DownloadObject writes object to path exactly as it is stored, so gzipped
+// files stay gzipped, and fills in its metadata. The file only replaces path
+// once it is complete and matches the object's ETag.
+func (bucket *S3Bucket) DownloadObject(object *Object, path string) error {
+	svc := s3.New(bucket.session)
+	key := bucket.objectKey(object.Key)
+	req, result := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket.Name),
+		Key:    aws.String(key),
+	})
+	// Asking for an encoding stops Go's transport from quietly gunzipping
+	// the body.
+	req.HTTPRequest.Header.Set("Accept-Encoding", "identity")
+	if err := req.Send(); err != nil {
+		return fmt.Errorf("Unable to download %s/%s, %v", bucket.Name, key, err)
+	}
+	defer result.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), result.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to download %s/%s, %v", bucket.Name, key, err)
+	}
+
+	etag := strings.Trim(aws.StringValue(result.ETag), "\"")
+	// Multipart ETags aren't an MD5 of the whole object.
+	if !strings.Contains(etag, "-") && etag != hex.EncodeToString(hash.Sum(nil)) {
+		return fmt.Errorf("Download of %s/%s doesn't match its ETag", bucket.Name, key)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+	object.ETag = etag
+	object.Size = size
+	object.LastModified = aws.TimeValue(result.LastModified)
+	object.setMetadata(result.ContentType, result.CacheControl, result.ContentEncoding, result.WebsiteRedirectLocation, result.Metadata)
+	return nil
+}
+
+// UploadObject uploads the file at path to object's key with the headers,
+// metadata and redirect object holds, so an object written by
+// DownloadObject is stored again as it was.
+func (bucket *S3Bucket) UploadObject(object *Object, path string) error {
+	svc := s3.New(bucket.session)
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open file %s, %v", path, err)
+	}
+	params := &s3.PutObjectInput{
+		Bucket:   aws.String(bucket.Name),
+		Key:      aws.String(bucket.objectKey(object.Key)),
+		Body:     bytes.NewReader(body),
+		Metadata: aws.StringMap(object.Metadata),
+	}
+	if object.ContentType != "" {
+		params.ContentType = aws.String(object.ContentType)
+	}
+	if object.CacheControl != "" {
+		params.CacheControl = aws.String(object.CacheControl)
+	}
+	if object.ContentEncoding != "" {
+		params.ContentEncoding = aws.String(object.ContentEncoding)
+	}
+	if object.Redirect != "" {
+		params.WebsiteRedirectLocation = aws.String(object.Redirect)
+	}
+	if _, err := svc.PutObject(params); err != nil {
+		return fmt.Errorf("Failed to upload data to %s/%s, %v", bucket.Name, bucket.objectKey(object.Key), err)
+	}
+	return nil
+}
+
+// RestoreRoutingRules replaces the website routing rules under the bucket's
+// root with rules read by WebsiteRoutingRules. from is the root they were
+// read under, which their conditions are moved from. Other sites' rules are
+// kept.
+func (bucket *S3Bucket) RestoreRoutingRules(rules []*s3.RoutingRule, from string) error {
+	if bucket.Endpoint != "" {
+		return nil
+	}
+	websiteMu.Lock()
+	defer websiteMu.Unlock()
+	svc := s3.New(bucket.session)
+	website, err := svc.GetBucketWebsite(&s3.GetBucketWebsiteInput{
+		Bucket: aws.String(bucket.Name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchWebsiteConfiguration" {
+		website = &s3.GetBucketWebsiteOutput{
+			IndexDocument: &s3.IndexDocument{Suffix: aws.String("index.html")},
+		}
+	} else if err != nil {
+		return fmt.Errorf("Unable to read bucket %q website configuration, %v", bucket.Name, err)
+	}
+
+	kept := []*s3.RoutingRule{}
+	for _, rule := range website.RoutingRules {
+		if bucket.Root == "" || rule.Condition != nil && strings.HasPrefix(aws.StringValue(rule.Condition.KeyPrefixEquals), bucket.Root) {
+			continue
+		}
+		kept = append(kept, rule)
+	}
+	for _, rule := range rules {
+		if rule.Condition != nil && rule.Condition.KeyPrefixEquals != nil {
+			rule.Condition.KeyPrefixEquals = aws.String(bucket.Root + strings.TrimPrefix(*rule.Condition.KeyPrefixEquals, from))
+		}
+		kept = append(kept, rule)
+	}
+	if len(kept) == 0 {
+		kept = nil
+	}
+
+	_, err = svc.PutBucketWebsite(&s3.PutBucketWebsiteInput{
+		Bucket: aws.String(bucket.Name),
+		WebsiteConfiguration: &s3.WebsiteConfiguration{
+			ErrorDocument:         website.ErrorDocument,
+			IndexDocument:         website.IndexDocument,
+			RedirectAllRequestsTo: website.RedirectAllRequestsTo,
+			RoutingRules:          kept,
+		},
 	})
+	if err != nil {
+		return fmt.Errorf("Unable to set bucket %q website configuration, %v", bucket.Name, err)
+	}
+	return nil
+}
 
-	for _, file := range fileList {
-		bucket.UploadFile(bucketPrefix, file, dirPath)
+// WebsiteRoutingRules returns the bucket's website routing rules under its
+// root, which hold the redirects that aren't stored as objects.
+func (bucket *S3Bucket) WebsiteRoutingRules() ([]*s3.RoutingRule, error) {
+	svc := s3.New(bucket.session)
+	website, err := svc.GetBucketWebsite(&s3.GetBucketWebsiteInput{
+		Bucket: aws.String(bucket.Name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NoSuchWebsiteConfiguration" || aerr.Code() == "NotImplemented") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read bucket %q website configuration, %v", bucket.Name, err)
+	}
+	rules := []*s3.RoutingRule{}
+	for _, rule := range website.RoutingRules {
+		if bucket.Root == "" || rule.Condition != nil && strings.HasPrefix(aws.StringValue(rule.Condition.KeyPrefixEquals), bucket.Root) {
+			rules = append(rules, rule)
+		}
 	}
+	return rules, nil
 }
 
-func (bucket *S3Bucket) UploadFile(bucketPrefix string, filePath string, dirPath string) {
+// UploadFile uploads a single file and reports whether it was uploaded.
+// Throttled and failed requests are retried by the session's retry policy,
+// so an error here stops the deploy.
+func (bucket *S3Bucket) UploadFile(bucketPrefix string, filePath string, dirPath string) (string, bool, error) {
 	svc := s3.New(bucket.session)
-	fmt.Println("upload " + filePath + " to S3")
-	// An s3 service
 
-	file, err := os.Open(filePath)
+	body, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		fmt.Println("Failed to open file", file, err)
-		os.Exit(1)
+		return "", false, fmt.Errorf("Failed to open file %s, %v", filePath, err)
 	}
-	defer file.Close()
-	var key string
-	fileDirectory, _ := filepath.Abs(filePath)
-	fileDirectory = strings.Replace(fileDirectory, dirPath+"/", "", 1)
-	key = bucketPrefix + fileDirectory
+	fileDirectory, err := storage.Key(dirPath, filePath)
+	if err != nil {
+		return "", false, err
+	}
+	key := bucketPrefix + fileDirectory
 	// Upload the file to the s3 given bucket
-	contentType := getFileContentType(filePath)
+	contentType := storage.ContentType(filePath)
 	params := &s3.PutObjectInput{
-		Bucket:      aws.String(bucket.Name), // Required
-		Key:         aws.String(key),         // Required
-		Body:        file,
+		Bucket:      aws.String(bucket.Name),           // Required
+		Key:         aws.String(bucket.objectKey(key)), // Required
 		ContentType: aws.String(contentType),
 		Metadata: map[string]*string{
 			"Content-Type": aws.String(contentType),
 		},
 	}
-	_, err = svc.PutObject(params)
-	if err != nil {
-		fmt.Printf("Failed to upload data to %s/%s, %s\n",
-			bucket.Name, key, err.Error())
-		return
+	for name, value := range bucket.Metadata {
+		params.Metadata[name] = aws.String(value)
 	}
-}
 
-func getFileContentType(filePath string) string {
+	// Apply the first matching rule from the site's [deployment] config.
+	var matcher *hugo.Matcher
+	if bucket.Deployment != nil {
+		matcher = bucket.Deployment.Matcher(fileDirectory)
+	}
+	if matcher != nil {
+		if matcher.CacheControl != "" {
+			params.CacheControl = aws.String(matcher.CacheControl)
+		}
+		if matcher.ContentType != "" {
+			params.ContentType = aws.String(matcher.ContentType)
+			params.Metadata["Content-Type"] = aws.String(matcher.ContentType)
+		}
+		if matcher.ContentEncoding != "" {
+			params.ContentEncoding = aws.String(matcher.ContentEncoding)
+		}
+		if matcher.Gzip {
+			body, err = gzipBody(body)
+			if err != nil {
+				return key, false, fmt.Errorf("Unable to gzip %s, %v", filePath, err)
+			}
+			params.ContentEncoding = aws.String("gzip")
+		}
+	}
 
-	if strings.HasSuffix(filePath, ".css") {
-		return "text/css"
+	sum := md5.Sum(body)
+	if etag, ok := bucket.etags[key]; ok && etag == hex.EncodeToString(sum[:]) && (matcher == nil || !matcher.Force) {
+		changed := false
+		if bucket.CheckHeaders {
+			if changed, err = bucket.headersChanged(key, params); err != nil {
+				return key, false, err
+			}
+		}
+		if !changed {
+			bucket.progress.Log("skip " + filePath + " (unchanged)")
+			bucket.Output.File("skip", filePath, key)
+			return key, false, nil
+		}
 	}
 
-	out, err := os.Open(filePath)
+	bucket.progress.Log("upload " + filePath + " to S3")
+	params.Body = bytes.NewReader(body)
+	_, err = svc.PutObject(params)
 	if err != nil {
-		fmt.Println("Failed to open file", out, err)
-		os.Exit(1)
+		return key, false, fmt.Errorf("Failed to upload data to %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
 	}
-	defer out.Close()
-
-	// Only the first 512 bytes are used to sniff the content type.
-	buffer := make([]byte, 1024)
+	bucket.Output.File("upload", filePath, key)
+	return key, true, nil
+}
 
-	_, readErr := out.Read(buffer)
-	if readErr != nil {
-		return ""
+// headersChanged reports whether the object stored at key was uploaded with
+// other headers than params, such as after the [deployment] matchers were
+// changed. Custom metadata like the git commit isn't compared, so files that
+// are otherwise unchanged aren't uploaded again on every commit.
+func (bucket *S3Bucket) headersChanged(key string, params *s3.PutObjectInput) (bool, error) {
+	svc := s3.New(bucket.session)
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket.Name),
+		Key:    aws.String(bucket.objectKey(key)),
+	})
+	if err != nil {
+		return false, fmt.Errorf("Unable to read %s/%s, %v", bucket.Name, bucket.objectKey(key), err)
 	}
+	return aws.StringValue(head.ContentType) != aws.StringValue(params.ContentType) ||
+		aws.StringValue(head.CacheControl) != aws.StringValue(params.CacheControl) ||
+		aws.StringValue(head.ContentEncoding) != aws.StringValue(params.ContentEncoding), nil
+}
 
-	// Use the net/http package's handy DectectContentType function. Always returns a valid
-	// content-type by returning "application/octet-stream" if no others seemed to match.
-	contentType := http.DetectContentType(buffer)
-
-	return strings.Split(contentType, ";")[0]
+// gzipBody compresses body the same way on every deploy so an unchanged
+// file keeps the same ETag.
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
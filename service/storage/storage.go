@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mitchdennett/hugo-s3-deploy/hugo"
+	"github.com/mitchdennett/hugo-s3-deploy/ignore"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	"github.com/mitchdennett/hugo-s3-deploy/redirects"
+)
+
+// ErrorDocument is the page served for missing keys. Languages get their own
+// page, found with LanguageKey, for requests under the language's prefix that
+// fail with one of Codes.
+type ErrorDocument struct {
+	Key         string
+	Codes       []int
+	Languages   []string
+	LanguageKey func(lang string) string
+}
+
+// ContentType is the type a file is uploaded with, sniffed from its first
+// bytes.
+func ContentType(filePath string) string {
+	if strings.HasSuffix(filePath, ".css") {
+		return "text/css"
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	// Only the first 512 bytes are used to sniff the content type.
+	buffer := make([]byte, 1024)
+	if _, err := file.Read(buffer); err != nil {
+		return ""
+	}
+	// DetectContentType always returns a valid content-type, falling back
+	// to "application/octet-stream".
+	return strings.Split(http.DetectContentType(buffer), ";")[0]
+}
+
+// Storage is where a site is deployed to: an S3 bucket, a bucket on an
+// S3-compatible server such as MinIO, or a local directory.
+type Storage interface {
+	SetDeployment(deployment *hugo.Deployment)
+	SetRedirects(rules []*redirects.Rule, host string)
+	SetKeyPrefix(prefix string)
+	// SetRoot sets the prefix every key is stored under, so several sites
+	// can share the storage. Keys passed in and returned are relative to it.
+	SetRoot(prefix string)
+	SetErrorDocument(errors *ErrorDocument)
+	// SetPrivatePrefix keeps keys under prefix off the website.
+	SetPrivatePrefix(prefix string)
+	// SetMetadata sets metadata stored with every uploaded file.
+	SetMetadata(metadata map[string]string)
+	// SetOutput sets where each uploaded or skipped file is reported.
+	SetOutput(out *output.Printer)
+	// SetIgnore sets the patterns of files UploadDirectory leaves out.
+	SetIgnore(matcher *ignore.Matcher)
+	// SetSymlinks sets what UploadDirectory does with symbolic links.
+	SetSymlinks(symlinks Symlinks)
+	// SetCheckHeaders makes UploadDirectory compare the headers of
+	// unchanged files with the ones they'd be uploaded with, for when the
+	// header settings have changed since the last deploy.
+	SetCheckHeaders(check bool)
+
+	// CreateOrRetrieve creates the storage and reports whether it already
+	// existed.
+	CreateOrRetrieve() (bool, error)
+	Exists() (bool, error)
+	MakePublic() error
+	EnableWebHosting() error
+	RepointWebsite(from string, to string) error
+
+	UploadDirectory(prefix string, dir string) ([]string, error)
+	// UploadRedirects writes the redirects that are stored as objects and
+	// returns their keys.
+	UploadRedirects(prefix string) ([]string, error)
+	GetJSON(key string, v interface{}) (bool, error)
+	PutJSON(key string, v interface{}) error
+	// UploadJSON is PutJSON for a file served with the site, so it's stored
+	// with the metadata set by SetMetadata like uploaded files are.
+	UploadJSON(key string, v interface{}) error
+	// CreateJSON writes v to key unless key already exists, and reports
+	// whether it was written.
+	CreateJSON(key string, v interface{}) (bool, error)
+	// GetJSONETag is GetJSON that also returns the object's ETag, for
+	// ReplaceJSON.
+	GetJSONETag(key string, v interface{}) (string, bool, error)
+	// ReplaceJSON writes v to key only if the object's ETag is still etag,
+	// and returns the new ETag, or "" when the object has changed or gone.
+	ReplaceJSON(key string, v interface{}, etag string) (string, error)
+	Delete(key string) error
+	// DeleteIfMatch deletes key only if the object's ETag is still etag,
+	// and reports whether it was deleted.
+	DeleteIfMatch(key string, etag string) (bool, error)
+	DeleteKeys(keys []string) (int, error)
+	ListKeys(prefix string) ([]string, error)
+	ListPrefixes(prefix string) ([]string, error)
+	DeletePrefix(prefix string) (int, error)
+}
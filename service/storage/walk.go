@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/mitchdennett/hugo-s3-deploy/ignore"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Symlinks is what Walk does with a symbolic link.
+type Symlinks string
+
+const (
+	// FollowSymlinks uploads what a link points to under the link's own
+	// key. Broken links are skipped.
+	FollowSymlinks Symlinks = "follow"
+	SkipSymlinks   Symlinks = "skip"
+	// RejectSymlinks fails on any link.
+	RejectSymlinks Symlinks = "error"
+)
+
+// ParseSymlinks reads an upload.symlinks setting.
+func ParseSymlinks(policy string) (Symlinks, error) {
+	switch symlinks := Symlinks(policy); symlinks {
+	case FollowSymlinks, SkipSymlinks, RejectSymlinks:
+		return symlinks, nil
+	}
+	return "", fmt.Errorf("upload.symlinks %q must be follow, skip or error", policy)
+}
+
+// Key is the key the file at path is uploaded as: its path relative to dir,
+// with forward slashes and in Unicode NFC. macOS writes names decomposed,
+// so without normalizing the same page could get a different key depending
+// on where it was built.
+func Key(dir string, path string) (string, error) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.ValidString(rel) {
+		return "", fmt.Errorf("%s isn't valid UTF-8, which S3 keys must be", path)
+	}
+	return norm.NFC.String(filepath.ToSlash(rel)), nil
+}
+
+// Walk calls fn for every regular file under dir with its key. Symbolic
+// links are handled as symlinks says, and broken ones are passed to broken,
+// which may be nil.
+func Walk(dir string, symlinks Symlinks, fn func(path string, key string, info os.FileInfo) error, broken func(path string, key string)) error {
+	w := &walker{root: dir, symlinks: symlinks, fn: fn, broken: broken, parents: map[string]bool{}}
+	return w.walk(dir)
+}
+
+type walker struct {
+	root     string
+	symlinks Symlinks
+	fn       func(path string, key string, info os.FileInfo) error
+	broken   func(path string, key string)
+	// parents holds the real paths of the directories being walked, so a
+	// link to one of them isn't followed forever.
+	parents map[string]bool
+}
+
+func (w *walker) walk(dir string) error {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if w.parents[real] {
+		return nil
+	}
+	w.parents[real] = true
+	defer delete(w.parents, real)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range entries {
+		path := filepath.Join(dir, info.Name())
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch w.symlinks {
+			case SkipSymlinks:
+				continue
+			case RejectSymlinks:
+				return fmt.Errorf("%s is a symbolic link, which upload.symlinks doesn't allow", path)
+			}
+			if info, err = os.Stat(path); err != nil {
+				if w.broken != nil {
+					key, err := Key(w.root, path)
+					if err != nil {
+						return err
+					}
+					w.broken(path, key)
+				}
+				continue
+			}
+		}
+
+		if info.IsDir() {
+			if err := w.walk(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		key, err := Key(w.root, path)
+		if err != nil {
+			return err
+		}
+		if err := w.fn(path, key, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// File is one file of a site to upload.
+type File struct {
+	Path string
+	Key  string
+	Size int64
+}
+
+// Files lists the files under dir that aren't ignored, for UploadDirectory.
+// Broken symbolic links are reported to out as skipped.
+func Files(dir string, symlinks Symlinks, matcher *ignore.Matcher, out *output.Printer) ([]*File, error) {
+	files := []*File{}
+	err := Walk(dir, symlinks, func(path string, key string, info os.FileInfo) error {
+		if !matcher.Ignored(key) {
+			files = append(files, &File{Path: path, Key: key, Size: info.Size()})
+		}
+		return nil
+	}, func(path string, key string) {
+		if !matcher.Ignored(key) {
+			out.Skip(path, key, "broken symbolic link")
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s, %v", dir, err)
+	}
+	return files, nil
+}
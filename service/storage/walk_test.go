@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		dir  string
+		path string
+		want string
+	}{
+		{dir: dir, path: filepath.Join(dir, "index.html"), want: "index.html"},
+		{dir: dir, path: filepath.Join(dir, "a", "b.html"), want: "a/b.html"},
+		{dir: dir + string(filepath.Separator), path: filepath.Join(dir, "a.html"), want: "a.html"},
+		{dir: "public", path: filepath.Join("public", "a", "b.html"), want: "a/b.html"},
+		{dir: "./public", path: filepath.Join("public", "a.html"), want: "a.html"},
+		{dir: "./public/", path: "public/./a/../b.html", want: "b.html"},
+		{dir: ".", path: filepath.Join("a", "b.html"), want: "a/b.html"},
+		// Decomposed names, as macOS writes them, get the composed key.
+		{dir: dir, path: filepath.Join(dir, "cafe\u0301.html"), want: "caf\u00e9.html"},
+		{dir: dir, path: filepath.Join(dir, "caf\u00e9.html"), want: "caf\u00e9.html"},
+	}
+	if runtime.GOOS == "windows" {
+		tests = append(tests, struct{ dir, path, want string }{dir: `C:\site`, path: `C:\site\a\b.html`, want: "a/b.html"})
+	} else {
+		// A backslash is an ordinary character in names elsewhere.
+		tests = append(tests, struct{ dir, path, want string }{dir: dir, path: filepath.Join(dir, `a\b.html`), want: `a\b.html`})
+	}
+	for _, test := range tests {
+		got, err := Key(test.dir, test.path)
+		if err != nil {
+			t.Errorf("Key(%q, %q) error = %v", test.dir, test.path, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Key(%q, %q) = %q, want %q", test.dir, test.path, got, test.want)
+		}
+	}
+
+	if _, err := Key(dir, filepath.Join(dir, "bad\xff.html")); err == nil {
+		t.Error("Key accepted a name that isn't UTF-8")
+	}
+}
+
+// site builds a directory of files and symbolic links. Links are given as
+// "link -> target", with targets relative to the link.
+func site(t *testing.T, entries ...string) string {
+	dir := t.TempDir()
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, " -> ", 2)
+		path := filepath.Join(dir, filepath.FromSlash(parts[0]))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		switch {
+		case len(parts) == 2:
+			err = os.Symlink(filepath.FromSlash(parts[1]), path)
+		case strings.HasSuffix(parts[0], "/"):
+			err = os.MkdirAll(path, 0755)
+		default:
+			err = os.WriteFile(path, []byte(parts[0]), 0644)
+		}
+		if err != nil {
+			t.Skipf("unable to create %s: %v", entry, err)
+		}
+	}
+	return dir
+}
+
+func walk(dir string, symlinks Symlinks) ([]string, []string, error) {
+	keys := []string{}
+	broken := []string{}
+	err := Walk(dir, symlinks, func(path string, key string, info os.FileInfo) error {
+		keys = append(keys, key)
+		return nil
+	}, func(path string, key string) {
+		broken = append(broken, key)
+	})
+	sort.Strings(keys)
+	return keys, broken, err
+}
+
+func TestWalk(t *testing.T) {
+	dir := site(t, "index.html", "a/b.html", "a/c/d.html", "empty/")
+	want := []string{"a/b.html", "a/c/d.html", "index.html"}
+	keys, _, err := walk(dir, RejectSymlinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Walk = %v, want %v", keys, want)
+	}
+
+	// A relative directory gives the same keys.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Dir(dir)); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	for _, rel := range []string{filepath.Base(dir), "./" + filepath.Base(dir), "./" + filepath.Base(dir) + "/"} {
+		keys, _, err := walk(rel, RejectSymlinks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("Walk(%q) = %v, want %v", rel, keys, want)
+		}
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	keys, _, err = walk(".", RejectSymlinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Walk(\".\") = %v, want %v", keys, want)
+	}
+}
+
+func TestWalkNFC(t *testing.T) {
+	dir := site(t, "cafe\u0301/menu\u0301.html")
+	keys, _, err := walk(dir, RejectSymlinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"caf\u00e9/men\u00fa.html"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Walk = %q, want %q", keys, want)
+	}
+}
+
+func TestWalkSymlinks(t *testing.T) {
+	outside := site(t, "shared/logo.png", "robots.txt")
+	dir := site(t,
+		"index.html",
+		"robots.txt -> "+filepath.ToSlash(filepath.Join(outside, "robots.txt")),
+		"shared -> "+filepath.ToSlash(filepath.Join(outside, "shared")),
+		"alias.html -> index.html",
+		"dangling.html -> missing.html",
+		"a/b.html",
+		// Links back up the tree would be followed forever.
+		"a/loop -> ..",
+		"a/self -> .",
+	)
+
+	keys, broken, err := walk(dir, FollowSymlinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/b.html", "alias.html", "index.html", "robots.txt", "shared/logo.png"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("follow: keys = %v, want %v", keys, want)
+	}
+	if want := []string{"dangling.html"}; !reflect.DeepEqual(broken, want) {
+		t.Errorf("follow: broken = %v, want %v", broken, want)
+	}
+
+	keys, broken, err = walk(dir, SkipSymlinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/b.html", "index.html"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("skip: keys = %v, want %v", keys, want)
+	}
+	if len(broken) != 0 {
+		t.Errorf("skip: broken = %v, want none", broken)
+	}
+
+	if _, _, err := walk(dir, RejectSymlinks); err == nil || !strings.Contains(err.Error(), "is a symbolic link") {
+		t.Errorf("error: err = %v, want a symbolic link error", err)
+	}
+	dangling := site(t, "index.html", "dangling.html -> missing.html")
+	if _, _, err := walk(dangling, RejectSymlinks); err == nil {
+		t.Error("error: accepted a dangling link")
+	}
+
+	// A loop of links between two directories is walked once.
+	loop := site(t, "a/x.html", "b/y.html", "a/b -> ../b", "b/a -> ../a")
+	keys, _, err = walk(loop, FollowSymlinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/b/y.html", "a/x.html", "b/a/x.html", "b/y.html"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("loop: keys = %v, want %v", keys, want)
+	}
+}
+
+func TestParseSymlinks(t *testing.T) {
+	for _, policy := range []string{"follow", "skip", "error"} {
+		if got, err := ParseSymlinks(policy); err != nil || string(got) != policy {
+			t.Errorf("ParseSymlinks(%q) = %q, %v", policy, got, err)
+		}
+	}
+	if _, err := ParseSymlinks("copy"); err == nil {
+		t.Error("ParseSymlinks accepted copy")
+	}
+}
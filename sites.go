@@ -0,0 +1,515 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/mitchdennett/hugo-s3-deploy/builder"
+	"github.com/mitchdennett/hugo-s3-deploy/hooks"
+	"github.com/mitchdennett/hugo-s3-deploy/hugo"
+	"github.com/mitchdennett/hugo-s3-deploy/ignore"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	"github.com/mitchdennett/hugo-s3-deploy/service/bandwidth"
+	"github.com/mitchdennett/hugo-s3-deploy/service/cloudfront"
+	"github.com/mitchdennett/hugo-s3-deploy/service/local"
+	"github.com/mitchdennett/hugo-s3-deploy/service/retry"
+	s3Service "github.com/mitchdennett/hugo-s3-deploy/service/s3"
+	"github.com/mitchdennett/hugo-s3-deploy/service/storage"
+	"github.com/pelletier/go-toml"
+)
+
+// site is one Hugo site and the storage it deploys to. deploy.toml
+// describes a single site, or several with [[site]] entries.
+type site struct {
+	Name           string
+	Dir            string
+	Config         *toml.Tree
+	Hugo           *hugo.SiteConfig
+	Builder        builder.Builder
+	Hooks          []*hooks.Hook
+	Ignore         *ignore.Matcher
+	Symlinks       storage.Symlinks
+	Concurrency    int
+	BucketName     string
+	DomainName     string
+	HostedZoneId   string
+	Region         string
+	DistributionId string
+	Storage        string
+	Endpoint       string
+	Prefix         string
+
+	// nestedSites are the prefixes, relative to Prefix, of the other
+	// [[site]] entries stored under this site in the same bucket.
+	nestedSites []string
+	// lock keeps the deploy lock while a command holds it.
+	lock *lockKeeper
+
+	session *session.Session
+	bucket  storage.Storage
+	dist    *cloudfront.Distribution
+	out     *output.Printer
+}
+
+// siteKeys are the keys of a [[site]] entry that are shorthand for the
+// matching aws.* setting.
+var siteKeys = map[string]string{
+	"bucketname":   "aws.bucketname",
+	"domain":       "aws.domain",
+	"hostedzoneid": "aws.hostedzoneid",
+	"region":       "aws.region",
+	"keyid":        "aws.keyid",
+	"secretkey":    "aws.secretkey",
+	"prefix":       "storage.prefix",
+}
+
+// loadSites reads the sites listed in deploy.toml. Each [[site]] entry is
+// overlaid on the rest of the file, so shared settings such as credentials
+// only need to be given once. Without [[site]] entries the file describes
+// the site in dir.
+func loadSites(dir string, config *toml.Tree) ([]*site, error) {
+	if err := applyEnvironment(config); err != nil {
+		return nil, err
+	}
+	entries, _ := config.Get("site").([]*toml.Tree)
+	if len(entries) == 0 {
+		s := &site{Dir: dir, Config: config}
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		return []*site{s}, nil
+	}
+
+	base := config.ToMap()
+	delete(base, "site")
+
+	sites := []*site{}
+	names := map[string]bool{}
+	for i, entry := range entries {
+		siteConfig, err := toml.TreeFromMap(base)
+		if err != nil {
+			return nil, err
+		}
+		s := &site{Dir: dir, Config: siteConfig}
+		for key, value := range entry.ToMap() {
+			switch key {
+			case "name":
+				s.Name, _ = value.(string)
+			case "dir":
+				path, _ := value.(string)
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(dir, path)
+				}
+				s.Dir = path
+			default:
+				if table, ok := value.(map[string]interface{}); ok {
+					overlay(siteConfig, []string{key}, table)
+				} else if setting, ok := siteKeys[key]; ok {
+					siteConfig.Set(setting, value)
+				} else {
+					siteConfig.Set(key, value)
+				}
+			}
+		}
+		if s.Name == "" {
+			return nil, fmt.Errorf("[[site]] entry %d has no name", i+1)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("There is more than one [[site]] named %q", s.Name)
+		}
+		names[s.Name] = true
+
+		if err := s.load(); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.Name, err)
+		}
+		sites = append(sites, s)
+	}
+	for _, s := range sites {
+		for _, other := range sites {
+			if other != s && other.Storage == s.Storage && other.Endpoint == s.Endpoint && other.BucketName == s.BucketName &&
+				other.Prefix != s.Prefix && strings.HasPrefix(other.Prefix, s.Prefix) {
+				s.nestedSites = append(s.nestedSites, strings.TrimPrefix(other.Prefix, s.Prefix))
+			}
+		}
+	}
+	return sites, nil
+}
+
+// load reads the site's settings from its config and its Hugo site config.
+func (s *site) load() error {
+	s.BucketName = configString(s.Config, "aws.bucketname", "")
+	s.DomainName = configString(s.Config, "aws.domain", "")
+	s.HostedZoneId = configString(s.Config, "aws.hostedzoneid", "")
+	s.Region = configString(s.Config, "aws.region", "")
+	s.Storage = configString(s.Config, "storage.type", "s3")
+	s.Endpoint = configString(s.Config, "storage.endpoint", "")
+
+	if err := s.loadBuilder(); err != nil {
+		return err
+	}
+	if err := s.loadHooks(); err != nil {
+		return err
+	}
+	if err := s.loadIgnore(); err != nil {
+		return err
+	}
+	symlinks, err := storage.ParseSymlinks(configString(s.Config, "upload.symlinks", "follow"))
+	if err != nil {
+		return err
+	}
+	s.Symlinks = symlinks
+	if s.Concurrency = configInt(s.Config, "upload.concurrency", 8); s.Concurrency < 1 {
+		return errors.New("upload.concurrency must be at least 1")
+	}
+
+	switch s.Storage {
+	case "s3":
+		if s.DomainName == "" {
+			return errors.New("aws.domain is not set in deploy.toml")
+		}
+	case "minio":
+		if s.Endpoint == "" {
+			return errors.New("storage.endpoint must be set for minio storage")
+		}
+	case "local":
+		path := configString(s.Config, "storage.path", "")
+		if path == "" {
+			return errors.New("storage.path must be set for local storage")
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(s.Dir, path)
+		}
+		s.BucketName = path
+	default:
+		return fmt.Errorf("Unknown storage type %q, expected s3, minio or local", s.Storage)
+	}
+
+	if s.Name == "" {
+		s.Name = s.DomainName
+	}
+	if s.Name == "" {
+		s.Name = filepath.Base(s.Dir)
+	}
+	if err := s.loadPrefix(); err != nil {
+		return err
+	}
+	if s.Storage == "local" {
+		return nil
+	}
+	return s.applyDeploymentTarget()
+}
+
+// loadPrefix reads storage.prefix, the key prefix the site is uploaded
+// under so it can share a bucket with other sites. true stands for
+// sites/<name>/.
+func (s *site) loadPrefix() error {
+	switch prefix := s.Config.Get("storage.prefix").(type) {
+	case nil:
+	case bool:
+		if prefix {
+			s.Prefix = "sites/" + s.Name + "/"
+		}
+	case string:
+		s.Prefix = strings.Trim(prefix, "/")
+		if s.Prefix != "" {
+			s.Prefix += "/"
+		}
+	default:
+		return errors.New("storage.prefix must be a key prefix such as \"sites/blog\", or true")
+	}
+	if strings.HasPrefix(s.Prefix, stateKeyPrefix) || strings.HasPrefix(s.Prefix, releasesPrefix) || strings.HasPrefix(s.Prefix, previewsPrefix) {
+		return fmt.Errorf("storage.prefix %q is used by the tool itself", s.Prefix)
+	}
+	return nil
+}
+
+// loadBuilder sets up the [build] step. Only Hugo sites have a Hugo site
+// config; other generators' output is uploaded without one.
+func (s *site) loadBuilder() error {
+	publishDir := configString(s.Config, "build.publishdir", "public")
+	switch buildType := configString(s.Config, "build.type", "hugo"); buildType {
+	case "hugo":
+		hugoSite, err := hugo.LoadSiteConfig(s.Dir)
+		if err != nil {
+			return fmt.Errorf("Could not read Hugo site config %v", err)
+		}
+		s.Hugo = hugoSite
+		hugoBuilder := builder.NewHugo(s.Dir, hugoSite)
+		hugoBuilder.SetTheme(configString(s.Config, "build.theme", "hugo-universal-theme"))
+		s.Builder = hugoBuilder
+		return nil
+	case "command":
+		command := configString(s.Config, "build.command", "")
+		if command == "" {
+			return errors.New("build.command must be set for the command build type")
+		}
+		s.Builder = builder.NewCommand(s.Dir, command, publishDir)
+	case "none":
+		s.Builder = builder.NewFolder(s.Dir, publishDir)
+	default:
+		return fmt.Errorf("Unknown build type %q, expected hugo, command or none", buildType)
+	}
+	s.Hugo = &hugo.SiteConfig{PublishDir: publishDir}
+	return nil
+}
+
+func (s *site) loadHooks() error {
+	entries, _ := s.Config.Get("hooks").([]*toml.Tree)
+	values := []map[string]interface{}{}
+	for _, entry := range entries {
+		values = append(values, entry.ToMap())
+	}
+	siteHooks, err := hooks.FromConfig(values)
+	if err != nil {
+		return err
+	}
+	s.Hooks = siteHooks
+	return nil
+}
+
+// loadIgnore reads the patterns of files left out of uploads: the defaults,
+// then .deployignore in the site directory, then upload.exclude and
+// upload.include from deploy.toml.
+func (s *site) loadIgnore() error {
+	matcher := ignore.NewMatcher()
+	if err := matcher.Add(ignore.Defaults...); err != nil {
+		return err
+	}
+	if err := matcher.AddFile(filepath.Join(s.Dir, ".deployignore")); err != nil {
+		return err
+	}
+	if err := matcher.Add(configStrings(s.Config, "upload.exclude", nil)...); err != nil {
+		return err
+	}
+	for _, pattern := range configStrings(s.Config, "upload.include", nil) {
+		if err := matcher.Add("!" + strings.TrimPrefix(pattern, "!")); err != nil {
+			return err
+		}
+	}
+	s.Ignore = matcher
+	return nil
+}
+
+// usesCloudFront reports whether the site is served by CloudFront, which is
+// only set up for sites stored on AWS S3.
+func (s *site) usesCloudFront() bool {
+	return s.Storage == "s3"
+}
+
+// selectSite picks the site named with -site, which may be left out when
+// deploy.toml only describes one.
+func selectSite(sites []*site) (*site, error) {
+	if *siteName == "" {
+		if len(sites) > 1 {
+			return nil, fmt.Errorf("deploy.toml lists %d sites, pass -site <name> or -all", len(sites))
+		}
+		return sites[0], nil
+	}
+	for _, s := range sites {
+		if s.Name == *siteName {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("No [[site]] named %q in deploy.toml", *siteName)
+}
+
+// connect creates the sessions the sites deploy with. Sites using the same
+// credentials, endpoint, region, bandwidth limit and retry settings share a
+// session.
+func connect(sites []*site) error {
+	sessions := map[string]*session.Session{}
+	limiters := map[int64]*bandwidth.Limiter{}
+	for _, s := range sites {
+		if s.Storage == "local" {
+			s.connect(nil)
+			continue
+		}
+		rate, err := bandwidthLimit(s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.Name, err)
+		}
+		policy, err := retryPolicy(s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.Name, err)
+		}
+		keyId, secretKey := configString(s.Config, "aws.keyid", ""), configString(s.Config, "aws.secretkey", "")
+		key := fmt.Sprintf("%q %q %q %q %d %d %s", keyId, secretKey, s.Region, s.Endpoint, rate, policy.MaxAttempts, policy.MaxElapsed)
+		sess, ok := sessions[key]
+		if !ok {
+			config := &aws.Config{
+				Region:      aws.String(s.Region),
+				Credentials: credentials.NewStaticCredentials(keyId, secretKey, ""),
+				Retryer:     policy,
+				// Let the policy decide every retry, including ones the
+				// SDK has already marked retryable.
+				EnforceShouldRetryCheck: aws.Bool(true),
+			}
+			if s.Endpoint != "" {
+				// S3-compatible servers don't resolve bucket subdomains.
+				config.Endpoint = aws.String(s.Endpoint)
+				config.S3ForcePathStyle = aws.Bool(true)
+			}
+			sess, err = session.NewSession(config)
+			if err != nil {
+				return fmt.Errorf("%s: %v", s.Name, err)
+			}
+			if rate > 0 {
+				// Sites with the same limit share it, so -all stays
+				// within it too.
+				if limiters[rate] == nil {
+					limiters[rate] = bandwidth.NewLimiter(rate)
+				}
+				limiters[rate].Attach(&sess.Handlers)
+			}
+			sessions[key] = sess
+		}
+		s.connect(sess)
+	}
+	return nil
+}
+
+// retryPolicy reads the [retry] settings for a site's AWS requests.
+func retryPolicy(s *site) (*retry.Policy, error) {
+	policy := retry.NewPolicy()
+	if attempts := configInt(s.Config, "retry.maxattempts", 0); attempts > 0 {
+		policy.SetMaxAttempts(attempts)
+	}
+	if elapsed := configString(s.Config, "retry.maxelapsed", ""); elapsed != "" {
+		duration, err := time.ParseDuration(elapsed)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid retry.maxelapsed %q, %v", elapsed, err)
+		}
+		policy.SetMaxElapsed(duration)
+	}
+	return policy, nil
+}
+
+// bandwidthLimit reads -max-bandwidth, or else upload.maxbandwidth, in bytes
+// per second. 0 means no limit.
+func bandwidthLimit(s *site) (int64, error) {
+	rate := *maxBandwidth
+	if rate == "" {
+		rate = configString(s.Config, "upload.maxbandwidth", "")
+	}
+	if rate == "" {
+		return 0, nil
+	}
+	return bandwidth.ParseRate(rate)
+}
+
+func (s *site) connect(sess *session.Session) {
+	s.session = sess
+	s.out = output.NewPrinter(s.Name)
+	s.dist = cloudfront.NewDistribution(sess)
+	s.dist.SetAliasName(s.DomainName)
+	s.dist.SetRegion(s.Region)
+	s.dist.SetId(s.DistributionId)
+
+	s.dist.SetRoot(s.Prefix)
+
+	if s.Storage == "local" {
+		s.bucket = local.NewDirectory(s.BucketName)
+		s.bucket.SetRoot(s.Prefix)
+		s.bucket.SetDeployment(&s.Hugo.Deployment)
+		s.bucket.SetOutput(s.out)
+		s.bucket.SetIgnore(s.Ignore)
+		s.bucket.SetSymlinks(s.Symlinks)
+		return
+	}
+
+	bucket := s3Service.NewBucket(sess)
+	bucket.SetName(s.BucketName)
+	bucket.SetRegion(s.Region)
+	bucket.SetEndpoint(s.Endpoint)
+	bucket.SetRoot(s.Prefix)
+	bucket.SetPrivatePrefix(stateKeyPrefix)
+	bucket.SetDeployment(&s.Hugo.Deployment)
+	bucket.SetOutput(s.out)
+	bucket.SetIgnore(s.Ignore)
+	bucket.SetSymlinks(s.Symlinks)
+	bucket.SetConcurrency(s.Concurrency)
+	s.bucket = bucket
+	s.dist.SetBucket(bucket)
+}
+
+// siteReport is a site's line in the summary of a run over several sites.
+type siteReport struct {
+	Site          string `json:"site"`
+	Status        string `json:"status"`
+	Duration      string `json:"duration"`
+	FilesUploaded int    `json:"filesUploaded"`
+	Error         string `json:"error,omitempty"`
+}
+
+type siteResult struct {
+	site     *site
+	uploaded int
+	duration time.Duration
+	err      error
+}
+
+// runAll runs command for every site, at most parallel at a time.
+func runAll(command string, args []string, sites []*site, parallel int) []*siteResult {
+	if parallel < 1 {
+		parallel = 1
+	}
+	results := make([]*siteResult, len(sites))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, s := range sites {
+		wg.Add(1)
+		go func(i int, s *site) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			start := time.Now()
+			uploaded, err := run(command, args, s)
+			if err != nil {
+				s.out.Fail(err)
+			}
+			results[i] = &siteResult{site: s, uploaded: uploaded, duration: time.Since(start), err: err}
+		}(i, s)
+	}
+	wg.Wait()
+	return results
+}
+
+// printReport summarises a run over several sites and reports whether every
+// site succeeded.
+func printReport(results []*siteResult) bool {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].err == nil && results[j].err != nil
+	})
+
+	output.Println("=================================")
+	output.Println("Deploy report")
+	output.Println("=================================")
+	ok := true
+	reports := []*siteReport{}
+	for _, result := range results {
+		duration := result.duration.Round(time.Second)
+		report := &siteReport{Site: result.site.Name, Status: "ok", Duration: duration.String(), FilesUploaded: result.uploaded}
+		reports = append(reports, report)
+		if result.err != nil {
+			ok = false
+			report.Status = "failed"
+			report.Error = result.err.Error()
+			output.Printf("FAILED  %-24s %8s  %v\n", result.site.Name, duration, result.err)
+			continue
+		}
+		output.Printf("OK      %-24s %8s  %d files uploaded\n", result.site.Name, duration, result.uploaded)
+	}
+	if err := output.NewPrinter("").Summary(map[string]interface{}{"ok": ok, "sites": reports}); err != nil {
+		output.Println(err)
+	}
+	return ok
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mitchdennett/hugo-s3-deploy/hugo"
+	"github.com/pelletier/go-toml"
+)
+
+func TestLoadSites(t *testing.T) {
+	config, err := toml.Load(`
+[build]
+type = "none"
+[storage]
+type = "local"
+path = "bucket"
+[upload]
+exclude = ["drafts/"]
+[errors]
+codes = [404]
+
+[env.staging.storage]
+path = "staging"
+[env.staging.upload]
+concurrency = 2
+
+[[site]]
+name = "blog"
+
+[[site]]
+name = "docs"
+[site.storage]
+path = "docs"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*envName = "staging"
+	defer func() { *envName = "" }()
+	sites, err := loadSites("/srv", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blog, docs := sites[0], sites[1]
+	if blog.BucketName != "/srv/staging" || blog.Concurrency != 2 {
+		t.Errorf("blog uses %s with concurrency %d, want the staging environment", blog.BucketName, blog.Concurrency)
+	}
+	// The site's own settings win over the environment.
+	if docs.BucketName != "/srv/docs" || docs.Concurrency != 2 {
+		t.Errorf("docs uses %s with concurrency %d, want /srv/docs with concurrency 2", docs.BucketName, docs.Concurrency)
+	}
+	// Arrays shared by every site are read from each site's copy.
+	for _, s := range sites {
+		if !s.Ignore.Ignored("drafts/post.html") {
+			t.Errorf("%s doesn't ignore drafts/", s.Name)
+		}
+		if codes := configInts(s.Config, "errors.codes", nil); !reflect.DeepEqual(codes, []int{404}) {
+			t.Errorf("%s has error codes %v, want [404]", s.Name, codes)
+		}
+	}
+}
+
+func TestConnectSessions(t *testing.T) {
+	newSite := func(name string, config string) *site {
+		tree, err := toml.Load("[aws]\nkeyid = \"KEY\"\nsecretkey = \"SECRET\"\n" + config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &site{Name: name, Config: tree, Hugo: &hugo.SiteConfig{}, Storage: "minio", Endpoint: "http://127.0.0.1:9000", Region: "us-east-1"}
+	}
+	base := newSite("base", "")
+	same := newSite("same", "")
+	secret := newSite("secret", "")
+	secret.Config.Set("aws.secretkey", "OTHER")
+	attempts := newSite("attempts", "[retry]\nmaxattempts = 3")
+	elapsed := newSite("elapsed", "[retry]\nmaxelapsed = \"10s\"")
+	region := newSite("region", "")
+	region.Region = "eu-west-1"
+	if err := connect([]*site{base, same, secret, attempts, elapsed, region}); err != nil {
+		t.Fatal(err)
+	}
+	if same.session != base.session {
+		t.Error("sites with the same settings don't share a session")
+	}
+	for _, s := range []*site{secret, attempts, elapsed, region} {
+		if s.session == base.session {
+			t.Errorf("%s shares a session with a site using other settings", s.Name)
+		}
+	}
+}
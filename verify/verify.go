@@ -0,0 +1,206 @@
+// Package verify checks that a deployed site serves what was built.
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchdennett/hugo-s3-deploy/hugo"
+	"github.com/mitchdennett/hugo-s3-deploy/output"
+	"github.com/mitchdennett/hugo-s3-deploy/service/storage"
+)
+
+// Client sends the verification requests. *http.Client satisfies it, so
+// checks can be pointed at a local server.
+type Client interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Check is the result of one request. It passed when Problem is empty.
+type Check struct {
+	URL     string `json:"url"`
+	Problem string `json:"problem,omitempty"`
+}
+
+// Verifier fetches pages from each of Hosts and compares them with the
+// built site in PublishDir.
+type Verifier struct {
+	Client     Client
+	Hosts      []string
+	PublishDir string
+	Deployment *hugo.Deployment
+}
+
+func NewVerifier(publishDir string, hosts []string) *Verifier {
+	verifier := new(Verifier)
+	verifier.PublishDir = publishDir
+	verifier.Hosts = hosts
+	verifier.Client = &http.Client{
+		Timeout: 30 * time.Second,
+		// Redirects are checked, not followed.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return verifier
+}
+
+func (verifier *Verifier) SetClient(client Client) {
+	verifier.Client = client
+}
+
+// SetDeployment sets the [deployment] matchers, whose content types override
+// the ones guessed from the files.
+func (verifier *Verifier) SetDeployment(deployment *hugo.Deployment) {
+	verifier.Deployment = deployment
+}
+
+// Verify requests every path from every host. HTTPS hosts must also redirect
+// plain HTTP requests to HTTPS.
+func (verifier *Verifier) Verify(paths []string) []*Check {
+	checks := []*Check{}
+	for _, host := range verifier.Hosts {
+		host = strings.TrimSuffix(host, "/")
+		if strings.HasPrefix(host, "https://") {
+			checks = append(checks, verifier.checkHTTPSRedirect(host))
+		}
+		for _, path := range paths {
+			checks = append(checks, verifier.checkPage(host, path))
+		}
+	}
+	return checks
+}
+
+func (verifier *Verifier) checkPage(host string, path string) *Check {
+	check := &Check{URL: host + path}
+	resp, body, err := verifier.get(check.URL)
+	if err != nil {
+		check.Problem = err.Error()
+		return check
+	}
+	if resp.StatusCode != http.StatusOK {
+		check.Problem = fmt.Sprintf("status %d, expected 200", resp.StatusCode)
+		return check
+	}
+
+	key := strings.TrimPrefix(path, "/")
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += "index.html"
+	}
+	if unescaped, err := url.PathUnescape(key); err == nil {
+		key = unescaped
+	}
+	file := filepath.Join(verifier.PublishDir, filepath.FromSlash(key))
+	local, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		// Not a file from the build, so there's nothing to compare.
+		return check
+	}
+	if err != nil {
+		check.Problem = err.Error()
+		return check
+	}
+
+	expected := verifier.contentType(key, file)
+	served, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if expected != "" && served != expected {
+		check.Problem = fmt.Sprintf("content type %q, expected %q", served, expected)
+		return check
+	}
+	if sha256.Sum256(body) != sha256.Sum256(local) {
+		check.Problem = "content differs from " + file
+	}
+	return check
+}
+
+func (verifier *Verifier) checkHTTPSRedirect(host string) *Check {
+	check := &Check{URL: "http://" + strings.TrimPrefix(host, "https://") + "/"}
+	resp, _, err := verifier.get(check.URL)
+	if err != nil {
+		check.Problem = err.Error()
+		return check
+	}
+	location := resp.Header.Get("Location")
+	if resp.StatusCode < 300 || resp.StatusCode > 399 {
+		check.Problem = fmt.Sprintf("status %d, expected a redirect to %s/", resp.StatusCode, host)
+	} else if !strings.HasPrefix(location, "https://") {
+		check.Problem = "redirects to " + location + ", expected HTTPS"
+	}
+	return check
+}
+
+func (verifier *Verifier) get(url string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := verifier.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+func (verifier *Verifier) contentType(key string, file string) string {
+	if verifier.Deployment != nil {
+		if matcher := verifier.Deployment.Matcher(key); matcher != nil && matcher.ContentType != "" {
+			contentType, _, _ := mime.ParseMediaType(matcher.ContentType)
+			return contentType
+		}
+	}
+	return storage.ContentType(file)
+}
+
+// PagePath is the URL path a key is visited at.
+func PagePath(key string) string {
+	if key == "index.html" || strings.HasSuffix(key, "/index.html") {
+		key = strings.TrimSuffix(key, "index.html")
+	}
+	return "/" + (&url.URL{Path: key}).EscapedPath()
+}
+
+// Sample picks up to n keys at random.
+func Sample(keys []string, n int) []string {
+	if len(keys) <= n {
+		return keys
+	}
+	picked := append([]string{}, keys...)
+	rand.Shuffle(len(picked), func(i, j int) {
+		picked[i], picked[j] = picked[j], picked[i]
+	})
+	picked = picked[:n]
+	sort.Strings(picked)
+	return picked
+}
+
+// Report prints each check and returns an error listing the failures.
+func Report(checks []*Check) error {
+	var failures bytes.Buffer
+	failed := 0
+	for _, check := range checks {
+		if check.Problem == "" {
+			output.Println("ok    " + check.URL)
+			continue
+		}
+		failed++
+		output.Println("FAIL  " + check.URL + " - " + check.Problem)
+		fmt.Fprintf(&failures, "\n  %s - %s", check.URL, check.Problem)
+	}
+	if failed > 0 {
+		return fmt.Errorf("Verification failed, %d of %d checks failed:%s", failed, len(checks), failures.String())
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package verify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const page = "<!DOCTYPE html><html><body>hello</body></html>"
+
+func publishDir(t *testing.T) string {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":      page,
+		"docs/index.html": page,
+		"site.css":        "body { color: red }",
+		"café.html":       page,
+	}
+	for name, body := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestVerify(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/", "/docs/", "/café.html", "/extra.html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(page))
+		case "/site.css":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("body { color: red }"))
+		case "/stale/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("old"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir := publishDir(t)
+	if err := os.MkdirAll(filepath.Join(dir, "stale"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "stale", "index.html"), []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewVerifier(dir, []string{server.URL + "/"})
+	verifier.SetClient(server.Client())
+	tests := map[string]string{
+		"/":                   "",
+		"/docs/":              "",
+		PagePath("café.html"): "",
+		// Pages that aren't in the build are only checked for their status.
+		"/extra.html": "",
+		"/missing/":   "status 404, expected 200",
+		"/site.css":   `content type "text/plain", expected "text/css"`,
+		"/stale/":     "content differs from " + filepath.Join(dir, "stale", "index.html"),
+	}
+	paths := []string{}
+	for path := range tests {
+		paths = append(paths, path)
+	}
+	checks := verifier.Verify(paths)
+	if len(checks) != len(paths) {
+		t.Fatalf("Verify made %d checks, want %d", len(checks), len(paths))
+	}
+	for i, check := range checks {
+		if want := tests[paths[i]]; check.Problem != want {
+			t.Errorf("%s: problem %q, want %q", check.URL, check.Problem, want)
+		}
+	}
+
+	if err := Report(checks); err == nil || !strings.Contains(err.Error(), "3 of 7 checks failed") {
+		t.Errorf("Report = %v, want 3 of 7 failures", err)
+	}
+}
+
+// redirectingClient sends every request to server, passing the URL it was
+// for in a header.
+type redirectingClient struct {
+	server *httptest.Server
+}
+
+func (client *redirectingClient) Do(req *http.Request) (*http.Response, error) {
+	target, err := url.Parse(client.server.URL)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Original-URL", req.URL.String())
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestVerifyHTTPSRedirect(t *testing.T) {
+	for location, want := range map[string]string{
+		"https://example.com/": "",
+		"http://example.com/":  "redirects to http://example.com/, expected HTTPS",
+		"":                     "status 200, expected a redirect to https://example.com/",
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.Header.Get("X-Original-URL"), "http://") && location != "" {
+				http.Redirect(w, r, location, http.StatusMovedPermanently)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(page))
+		}))
+
+		verifier := NewVerifier(publishDir(t), []string{"https://example.com"})
+		verifier.SetClient(&redirectingClient{server})
+		checks := verifier.Verify([]string{"/"})
+		server.Close()
+		if len(checks) != 2 {
+			t.Fatalf("Verify made %d checks, want 2", len(checks))
+		}
+		if checks[0].URL != "http://example.com/" || checks[0].Problem != want {
+			t.Errorf("redirect to %q: %s problem %q, want %q", location, checks[0].URL, checks[0].Problem, want)
+		}
+		if checks[1].Problem != "" {
+			t.Errorf("redirect to %q: %s problem %q", location, checks[1].URL, checks[1].Problem)
+		}
+	}
+}
+
+func TestPagePath(t *testing.T) {
+	tests := map[string]string{
+		"index.html":      "/",
+		"docs/index.html": "/docs/",
+		"a b.html":        "/a%20b.html",
+		"site.css":        "/site.css",
+	}
+	for key, want := range tests {
+		if got := PagePath(key); got != want {
+			t.Errorf("PagePath(%q) = %q, want %q", key, got, want)
+		}
+	}
+}